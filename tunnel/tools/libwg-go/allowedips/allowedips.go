@@ -0,0 +1,159 @@
+package allowedips
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"go4.org/netipx"
+)
+
+// Request is the input to Calculate. Prefixes may also be given as bare addresses, which are taken as host prefixes.
+type Request struct {
+	// Include are the ranges to route into the tunnel, e.g. 0.0.0.0/0 and ::/0
+	Include []string `json:"include"`
+	// Exclude are the ranges cut out of Include, e.g. the LAN
+	Exclude []string `json:"exclude"`
+	// TunnelAddresses are the interface addresses, used to warn when the tunnel's own subnet is excluded
+	TunnelAddresses []string `json:"tunnelAddresses,omitempty"`
+	// Endpoints are the peer endpoints as host:port, removed from the result so they never route into the tunnel
+	Endpoints []string `json:"endpoints,omitempty"`
+}
+
+// Result is the minimal prefix list covering the included ranges less the excluded ones.
+type Result struct {
+	V4 []netip.Prefix `json:"v4"`
+	V6 []netip.Prefix `json:"v6"`
+	// AllowedIPs is V4 and V6 joined in wg-quick AllowedIPs format
+	AllowedIPs string   `json:"allowedIps"`
+	Warnings   []string `json:"warnings,omitempty"`
+}
+
+// Calculate subtracts the excluded ranges and peer endpoints from the included ranges.
+func Calculate(req Request) (*Result, error) {
+	include, err := parsePrefixes(req.Include)
+	if err != nil {
+		return nil, fmt.Errorf("include: %w", err)
+	}
+	if len(include) == 0 {
+		return nil, errors.New("include is empty")
+	}
+	exclude, err := parsePrefixes(req.Exclude)
+	if err != nil {
+		return nil, fmt.Errorf("exclude: %w", err)
+	}
+	tunnelAddrs, err := parsePrefixes(req.TunnelAddresses)
+	if err != nil {
+		return nil, fmt.Errorf("tunnel addresses: %w", err)
+	}
+
+	res := &Result{}
+
+	var b netipx.IPSetBuilder
+	for _, p := range include {
+		b.AddPrefix(p)
+	}
+	for _, p := range exclude {
+		b.RemovePrefix(p)
+	}
+
+	// an endpoint routed into its own tunnel loops the encrypted traffic back into the tunnel
+	included, err := b.IPSet()
+	if err != nil {
+		return nil, fmt.Errorf("build set: %w", err)
+	}
+	for _, ep := range req.Endpoints {
+		addr, err := endpointAddr(ep)
+		if err != nil {
+			res.Warnings = append(res.Warnings, err.Error())
+			continue
+		}
+		if included.Contains(addr) {
+			b.Remove(addr)
+			res.Warnings = append(res.Warnings, fmt.Sprintf("peer endpoint %s removed from the tunnel routes", addr))
+		}
+	}
+
+	set, err := b.IPSet()
+	if err != nil {
+		return nil, fmt.Errorf("build set: %w", err)
+	}
+
+	for _, addr := range tunnelAddrs {
+		if !set.Contains(addr.Addr()) && overlapsAny(addr, include) {
+			res.Warnings = append(res.Warnings, fmt.Sprintf("tunnel address %s is excluded, peers on the tunnel subnet will be unreachable", addr))
+		}
+	}
+
+	var all []string
+	for _, p := range set.Prefixes() {
+		if p.Addr().Is4() {
+			res.V4 = append(res.V4, p)
+		} else {
+			res.V6 = append(res.V6, p)
+		}
+		all = append(all, p.String())
+	}
+	if len(all) == 0 {
+		return nil, errors.New("exclude removes every included range")
+	}
+	res.AllowedIPs = strings.Join(all, ", ")
+	return res, nil
+}
+
+// ParsePrefix parses a CIDR, or a bare address as a host prefix. The result is masked.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid address %q", s)
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid prefix %q", s)
+	}
+	return prefix.Masked(), nil
+}
+
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, v := range values {
+		if strings.TrimSpace(v) == "" {
+			continue
+		}
+		p, err := ParsePrefix(v)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
+
+// endpointAddr returns the address of a host:port endpoint, hostnames can't be checked without resolving.
+func endpointAddr(endpoint string) (netip.Addr, error) {
+	host, _, err := net.SplitHostPort(strings.TrimSpace(endpoint))
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid peer endpoint %q: %v", endpoint, err)
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("peer endpoint %q is a hostname and was not checked", endpoint)
+	}
+	return addr.Unmap(), nil
+}
+
+func overlapsAny(p netip.Prefix, prefixes []netip.Prefix) bool {
+	for _, other := range prefixes {
+		if p.Overlaps(other) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package allowedips
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCalculate(t *testing.T) {
+	tests := []struct {
+		name     string
+		req      Request
+		want     string
+		warnings int
+		wantErr  bool
+	}{
+		{
+			name: "default minus private v4",
+			req: Request{
+				Include: []string{"0.0.0.0/0"},
+				Exclude: []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"},
+			},
+			want: "0.0.0.0/5, 8.0.0.0/7, 11.0.0.0/8, 12.0.0.0/6, 16.0.0.0/4, 32.0.0.0/3, 64.0.0.0/2, 128.0.0.0/3, " +
+				"160.0.0.0/5, 168.0.0.0/6, 172.0.0.0/12, 172.32.0.0/11, 172.64.0.0/10, 172.128.0.0/9, 173.0.0.0/8, " +
+				"174.0.0.0/7, 176.0.0.0/4, 192.0.0.0/9, 192.128.0.0/11, 192.160.0.0/13, 192.169.0.0/16, " +
+				"192.170.0.0/15, 192.172.0.0/14, 192.176.0.0/12, 192.192.0.0/10, 193.0.0.0/8, 194.0.0.0/7, " +
+				"196.0.0.0/6, 200.0.0.0/5, 208.0.0.0/4, 224.0.0.0/3",
+		},
+		{
+			name: "v4 and v6 mix",
+			req: Request{
+				Include: []string{"10.0.0.0/24", "::/0"},
+				Exclude: []string{"10.0.0.128/25", "8000::/1"},
+			},
+			want: "10.0.0.0/25, ::/1",
+		},
+		{
+			name: "overlapping includes are merged",
+			req: Request{
+				Include: []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24"},
+			},
+			want: "10.0.0.0/8",
+		},
+		{
+			name: "overlapping excludes",
+			req: Request{
+				Include: []string{"10.0.0.0/24"},
+				Exclude: []string{"10.0.0.0/25", "10.0.0.64/26", "10.0.0.192/26"},
+			},
+			want: "10.0.0.128/26",
+		},
+		{
+			name: "host routes",
+			req: Request{
+				Include: []string{"192.168.1.0/30"},
+				Exclude: []string{"192.168.1.1", "192.168.1.2/32"},
+			},
+			want: "192.168.1.0/32, 192.168.1.3/32",
+		},
+		{
+			name: "bare v6 host",
+			req: Request{
+				Include: []string{"fd00::/127"},
+				Exclude: []string{"fd00::1"},
+			},
+			want: "fd00::/128",
+		},
+		{
+			name: "endpoint removed",
+			req: Request{
+				Include:   []string{"203.0.113.0/30"},
+				Endpoints: []string{"203.0.113.1:51820", "vpn.example.com:51820"},
+			},
+			want:     "203.0.113.0/32, 203.0.113.2/31",
+			warnings: 2,
+		},
+		{
+			name: "excluded tunnel address",
+			req: Request{
+				Include:         []string{"10.0.0.0/8"},
+				Exclude:         []string{"10.8.0.0/24"},
+				TunnelAddresses: []string{"10.8.0.2/24"},
+			},
+			want: "10.0.0.0/13, 10.8.1.0/24, 10.8.2.0/23, 10.8.4.0/22, 10.8.8.0/21, 10.8.16.0/20, 10.8.32.0/19, " +
+				"10.8.64.0/18, 10.8.128.0/17, 10.9.0.0/16, 10.10.0.0/15, 10.12.0.0/14, 10.16.0.0/12, 10.32.0.0/11, " +
+				"10.64.0.0/10, 10.128.0.0/9",
+			warnings: 1,
+		},
+		{
+			name:    "everything excluded",
+			req:     Request{Include: []string{"10.0.0.0/8"}, Exclude: []string{"0.0.0.0/0"}},
+			wantErr: true,
+		},
+		{
+			name:    "empty include",
+			req:     Request{Include: []string{" "}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid prefix",
+			req:     Request{Include: []string{"10.0.0.0/33"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := Calculate(tt.req)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Calculate() = %v, want error", res.AllowedIPs)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Calculate() error: %v", err)
+			}
+			if res.AllowedIPs != tt.want {
+				t.Errorf("AllowedIPs = %q, want %q", res.AllowedIPs, tt.want)
+			}
+			if len(res.Warnings) != tt.warnings {
+				t.Errorf("Warnings = %q, want %d", res.Warnings, tt.warnings)
+			}
+			if got := len(res.V4) + len(res.V6); got != len(strings.Split(tt.want, ", ")) {
+				t.Errorf("V4 and V6 hold %d prefixes, want %d", got, len(strings.Split(tt.want, ", ")))
+			}
+			for _, p := range res.V4 {
+				if !p.Addr().Is4() {
+					t.Errorf("V4 holds %v", p)
+				}
+			}
+		})
+	}
+}
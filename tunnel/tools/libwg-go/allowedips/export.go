@@ -0,0 +1,42 @@
+//go:build !android
+
+package allowedips
+
+import "C"
+import (
+	"encoding/json"
+
+	"github.com/wgtunnel/desktop/tunnel/shared"
+)
+
+var logger = shared.NewLogger("AllowedIPs")
+
+// response wraps Result with the error, so callers always get JSON back
+type response struct {
+	*Result
+	Error string `json:"error,omitempty"`
+}
+
+//export awgCalculateAllowedIPs
+func awgCalculateAllowedIPs(request *C.char) *C.char {
+	var resp response
+
+	var req Request
+	if err := json.Unmarshal([]byte(C.GoString(request)), &req); err != nil {
+		resp.Error = "invalid request: " + err.Error()
+	} else if res, err := Calculate(req); err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.Result = res
+	}
+	if resp.Error != "" {
+		logger.Errorf("Calculate allowed IPs: %s", resp.Error)
+	}
+
+	out, err := json.Marshal(resp)
+	if err != nil {
+		logger.Errorf("Marshal allowed IPs response: %v", err)
+		return nil
+	}
+	return C.CString(string(out))
+}
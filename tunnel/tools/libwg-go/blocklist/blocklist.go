@@ -0,0 +1,118 @@
+//go:build !android
+
+package blocklist
+
+import "C"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/wgtunnel/desktop/tunnel/shared"
+	"github.com/wgtunnel/desktop/tunnel/vpn/firewall"
+	"github.com/wgtunnel/desktop/tunnel/vpn/firewall/osfirewall/firewallmgr"
+)
+
+var logger = shared.NewLogger("Blocklist")
+
+// source is a blocklist file, as passed to awgSetBlocklists
+type source struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+var (
+	mu      sync.Mutex
+	sources []source
+)
+
+//export awgSetBlocklists
+func awgSetBlocklists(config *C.char) C.int {
+	var srcs []source
+	if err := json.Unmarshal([]byte(C.GoString(config)), &srcs); err != nil {
+		logger.Errorf("Invalid blocklist config: %v", err)
+		return C.int(-1)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if err := load(srcs); err != nil {
+		logger.Errorf("Failed to set blocklists: %v", err)
+		return C.int(-1)
+	}
+	sources = srcs
+	return C.int(0)
+}
+
+//export awgReloadBlocklists
+func awgReloadBlocklists() C.int {
+	mu.Lock()
+	defer mu.Unlock()
+	if err := load(sources); err != nil {
+		logger.Errorf("Failed to reload blocklists: %v", err)
+		return C.int(-1)
+	}
+	return C.int(0)
+}
+
+//export awgGetBlocklistCounters
+func awgGetBlocklistCounters() *C.char {
+	bl, err := blocklister()
+	if err != nil {
+		logger.Errorf("Failed to get blocklist counters: %v", err)
+		return nil
+	}
+	counters, err := bl.BlocklistCounters()
+	if err != nil {
+		logger.Errorf("Failed to get blocklist counters: %v", err)
+		return nil
+	}
+	if counters == nil {
+		counters = []firewall.BlocklistCounter{}
+	}
+	out, err := json.Marshal(counters)
+	if err != nil {
+		logger.Errorf("Marshal blocklist counters: %v", err)
+		return nil
+	}
+	return C.CString(string(out))
+}
+
+// load reads every list before applying any, so a bad file leaves the loaded lists in place.
+func load(srcs []source) error {
+	bl, err := blocklister()
+	if err != nil {
+		return err
+	}
+	lists := make([]firewall.Blocklist, 0, len(srcs))
+	seen := make(map[string]bool)
+	for _, s := range srcs {
+		if seen[s.Name] {
+			return fmt.Errorf("duplicate blocklist %q", s.Name)
+		}
+		seen[s.Name] = true
+		list, err := firewall.LoadBlocklist(s.Name, s.Path)
+		if err != nil {
+			return err
+		}
+		lists = append(lists, list)
+	}
+	if err := bl.SetBlocklists(lists); err != nil {
+		return err
+	}
+	logger.Verbosef("Applied %d blocklists", len(lists))
+	return nil
+}
+
+func blocklister() (firewall.Blocklister, error) {
+	fw, err := firewallmgr.Get()
+	if err != nil {
+		return nil, err
+	}
+	bl, ok := fw.(firewall.Blocklister)
+	if !ok {
+		return nil, errors.New("blocklists are not supported by this firewall")
+	}
+	return bl, nil
+}
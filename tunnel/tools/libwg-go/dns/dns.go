@@ -29,6 +29,8 @@ import (
 type ResolverOptions struct {
 	UpstreamURL string
 	Timeout     time.Duration
+	// BootstrapMark is the Linux socket mark for bootstrap queries, falls back to default if 0
+	BootstrapMark uint32
 }
 
 // DefaultOptions returns default resolver options with 1.1.1.1 over UDP.
@@ -42,10 +44,14 @@ func DefaultOptions() ResolverOptions {
 type Resolved struct {
 	V4 []netip.Addr
 	V6 []netip.Addr
+	// TTL is the lowest TTL of the answers, only set by ResolveRecords
+	TTL time.Duration
 }
 
-func resolveInner(host string, ipType uint16, u upstream.Upstream, dialer *net.Dialer, wg *sync.WaitGroup) ([]netip.Addr, error) {
+// resolveInner returns the addresses of the answer and its lowest TTL.
+func resolveInner(host string, ipType uint16, u upstream.Upstream, dialer *net.Dialer, wg *sync.WaitGroup) ([]netip.Addr, uint32, error) {
 	var addr []netip.Addr
+	var ttl uint32
 	defer wg.Done()
 
 	req := &dns.Msg{}
@@ -67,14 +73,17 @@ func resolveInner(host string, ipType uint16, u upstream.Upstream, dialer *net.D
 	// We use the Address from the upstream (e.g., "1.1.1.1:53")
 	res, _, err := client.Exchange(req, u.Address())
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	if res.Rcode != dns.RcodeSuccess {
-		return nil, fmt.Errorf("DNS query failed with Rcode: %d", res.Rcode)
+		return nil, 0, fmt.Errorf("DNS query failed with Rcode: %d", res.Rcode)
 	}
 
 	for _, ans := range res.Answer {
+		if h := ans.Header(); (h.Rrtype == dns.TypeA || h.Rrtype == dns.TypeAAAA) && (ttl == 0 || h.Ttl < ttl) {
+			ttl = h.Ttl
+		}
 		switch ipType {
 		case dns.TypeA:
 			if a, ok := ans.(*dns.A); ok {
@@ -90,52 +99,63 @@ func resolveInner(host string, ipType uint16, u upstream.Upstream, dialer *net.D
 			}
 		}
 	}
-	return addr, nil
+	return addr, ttl, nil
 }
 
 func Resolve(host string, opts ResolverOptions, preferIpv6 bool, physicalIfIndex uint32) ([]netip.Addr, []netip.Addr, error) {
-	dialer, err := GetBypassDialer(preferIpv6, physicalIfIndex)
+	r, err := ResolveRecords(host, opts, preferIpv6, physicalIfIndex)
+	return r.V4, r.V6, err
+}
+
+// ResolveRecords resolves like Resolve, also returning the lowest TTL of the answers.
+func ResolveRecords(host string, opts ResolverOptions, preferIpv6 bool, physicalIfIndex uint32) (Resolved, error) {
+	dialer, err := GetBypassDialer(preferIpv6, physicalIfIndex, opts.BootstrapMark)
 	if err != nil {
-		return nil, nil, fmt.Errorf("bypass dialer failed: %w", err)
+		return Resolved{}, fmt.Errorf("bypass dialer failed: %w", err)
 	}
 
 	// 2. Setup the library just to handle URL parsing and certificates
 	// We pass the CustomResolver (which uses our bypass dialer) for bootstrapping
 	u, err := upstream.AddressToUpstream(opts.UpstreamURL, &upstream.Options{
-		Bootstrap:  CustomResolver(preferIpv6, physicalIfIndex),
+		Bootstrap:  CustomResolver(preferIpv6, physicalIfIndex, opts.BootstrapMark),
 		Timeout:    opts.Timeout,
 		PreferIPv6: preferIpv6,
 	})
 	if err != nil {
-		return nil, nil, err
+		return Resolved{}, err
 	}
 	defer u.Close()
 
 	var wg sync.WaitGroup
 	var v4, v6 []netip.Addr
+	var v4TTL, v6TTL uint32
 	var v4Err, v6Err error
 
 	wg.Add(2)
 	// 3. We use the 'dialer' directly in resolveInner
-	go func() { v4, v4Err = resolveInner(host, dns.TypeA, u, dialer, &wg) }()
-	go func() { v6, v6Err = resolveInner(host, dns.TypeAAAA, u, dialer, &wg) }()
+	go func() { v4, v4TTL, v4Err = resolveInner(host, dns.TypeA, u, dialer, &wg) }()
+	go func() { v6, v6TTL, v6Err = resolveInner(host, dns.TypeAAAA, u, dialer, &wg) }()
 	wg.Wait()
 
 	if v4Err != nil && v6Err != nil {
-		return nil, nil, errors.Join(v4Err, v6Err)
+		return Resolved{}, errors.Join(v4Err, v6Err)
 	}
 
 	if len(v4) == 0 && len(v6) == 0 {
 		if v4Err != nil {
-			return nil, nil, v4Err
+			return Resolved{}, v4Err
 		}
 		if v6Err != nil {
-			return nil, nil, v6Err
+			return Resolved{}, v6Err
 		}
-		return nil, nil, errors.New("no IP addresses found")
+		return Resolved{}, errors.New("no IP addresses found")
 	}
 
-	return v4, v6, nil
+	ttl := v4TTL
+	if len(v4) == 0 || (len(v6) > 0 && v6TTL < ttl) {
+		ttl = v6TTL
+	}
+	return Resolved{V4: v4, V6: v6, TTL: time.Duration(ttl) * time.Second}, nil
 }
 
 // ResolveWithBackoff retries resolution with exponential backoff until success
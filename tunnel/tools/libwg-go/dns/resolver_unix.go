@@ -10,13 +10,14 @@ import (
 	"github.com/wgtunnel/desktop/tunnel/vpn/firewall/mark"
 )
 
-// GetBypassDialer returns a dialer that bypasses the VPN via SO_MARK
-func GetBypassDialer(preferIpv6 bool, physicalIfIndex uint32) (*net.Dialer, error) {
+// GetBypassDialer returns a dialer that bypasses the VPN via SO_MARK, using the default bootstrap mark if bootstrapMark is 0
+func GetBypassDialer(preferIpv6 bool, physicalIfIndex uint32, bootstrapMark uint32) (*net.Dialer, error) {
+	markVal := int(mark.OrDefault(bootstrapMark, mark.LinuxBootstrapMarkNum))
 	return &net.Dialer{
 		Control: func(network, address string, c syscall.RawConn) error {
 			var opErr error
 			err := c.Control(func(fd uintptr) {
-				opErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark.LinuxBootstrapMarkNum)
+				opErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, markVal)
 			})
 			if err != nil {
 				return err
@@ -27,11 +28,11 @@ func GetBypassDialer(preferIpv6 bool, physicalIfIndex uint32) (*net.Dialer, erro
 }
 
 // CustomResolver is still needed for the dnsproxy Bootstrap field
-func CustomResolver(preferIpv6 bool, physicalIfIndex uint32) *net.Resolver {
+func CustomResolver(preferIpv6 bool, physicalIfIndex uint32, bootstrapMark uint32) *net.Resolver {
 	return &net.Resolver{
 		PreferGo: true,
 		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-			d, err := GetBypassDialer(preferIpv6, physicalIfIndex)
+			d, err := GetBypassDialer(preferIpv6, physicalIfIndex, bootstrapMark)
 			if err != nil {
 				return nil, err
 			}
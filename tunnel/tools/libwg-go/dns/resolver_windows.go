@@ -20,8 +20,8 @@ const (
 
 // GetBypassDialer returns a net.Dialer that forces outbound DNS queries
 // to leave via the physical interface on Windows for tunnel bootstrapping to prevent request from getting
-// routed back into the tun.
-func GetBypassDialer(preferIPv6 bool, physicalIfIndex uint32) (*net.Dialer, error) {
+// routed back into the tun. The bootstrap mark is Linux only and ignored.
+func GetBypassDialer(preferIPv6 bool, physicalIfIndex uint32, _ uint32) (*net.Dialer, error) {
 	// TODO handle prefer ipv6
 	d := &net.Dialer{
 		Control: func(network, address string, c syscall.RawConn) error {
@@ -48,11 +48,11 @@ func GetBypassDialer(preferIPv6 bool, physicalIfIndex uint32) (*net.Dialer, erro
 }
 
 // CustomResolver returns a standard net.Resolver for Windows.
-func CustomResolver(preferIpv6 bool, physicalIfIndex uint32) *net.Resolver {
+func CustomResolver(preferIpv6 bool, physicalIfIndex uint32, bootstrapMark uint32) *net.Resolver {
 	return &net.Resolver{
 		PreferGo: true,
 		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-			d, _ := GetBypassDialer(preferIpv6, physicalIfIndex)
+			d, _ := GetBypassDialer(preferIpv6, physicalIfIndex, bootstrapMark)
 			return d.DialContext(ctx, network, address)
 		},
 	}
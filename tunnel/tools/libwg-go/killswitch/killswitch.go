@@ -4,7 +4,12 @@ package killswitch
 
 import "C"
 import (
+	"encoding/json"
+	"net/netip"
+	"time"
+
 	"github.com/wgtunnel/desktop/tunnel/shared"
+	"github.com/wgtunnel/desktop/tunnel/vpn/firewall"
 	"github.com/wgtunnel/desktop/tunnel/vpn/firewall/osfirewall/firewallmgr"
 )
 
@@ -75,6 +80,7 @@ func setKillSwitchLanBypass(enabled C.int) C.int {
 	} else {
 		fw.RemoveLocalNetworks()
 	}
+	syncBootKillSwitch(fw)
 	return enabled
 }
 
@@ -91,3 +97,225 @@ func getKillSwitchLanBypassStatus() C.int {
 	}
 	return C.int(0)
 }
+
+//export pauseKillSwitch
+func pauseKillSwitch(seconds C.int) C.int {
+	if seconds <= 0 {
+		logger.Errorf("Invalid pause duration: %d seconds", seconds)
+		return C.int(-1)
+	}
+	if err := firewallmgr.PauseKillSwitch(time.Duration(seconds) * time.Second); err != nil {
+		logger.Errorf("Failed to pause kill switch: %v", err)
+		return C.int(-1)
+	}
+	logger.Verbosef("Kill switch paused for %d seconds", seconds)
+	return seconds
+}
+
+//export resumeKillSwitch
+func resumeKillSwitch() C.int {
+	if err := firewallmgr.ResumeKillSwitch(); err != nil {
+		logger.Errorf("Failed to resume kill switch: %v", err)
+		return C.int(-1)
+	}
+	return C.int(0)
+}
+
+//export getKillSwitchPauseStatus
+func getKillSwitchPauseStatus() C.int {
+	fw, err := firewallmgr.Get()
+	if err != nil {
+		logger.Errorf("Failed to get firewall: %v", err)
+		return C.int(0)
+	}
+
+	if pauser, ok := fw.(firewall.Pauser); ok && pauser.IsKillSwitchPaused() {
+		return C.int(1)
+	}
+	return C.int(0)
+}
+
+//export setCaptivePortalURL
+func setCaptivePortalURL(url *C.char) {
+	firewallmgr.SetCaptivePortalURL(C.GoString(url))
+}
+
+// getCaptivePortalStatus returns 0 while unknown, 1 without a portal and 2 behind one.
+//
+//export getCaptivePortalStatus
+func getCaptivePortalStatus() C.int {
+	return C.int(firewallmgr.CaptivePortalStatus())
+}
+
+//export setKillSwitchExemptions
+func setKillSwitchExemptions(exemptions *C.char) C.int {
+	fw, err := firewallmgr.Get()
+	if err != nil {
+		logger.Errorf("Failed to get firewall: %v", err)
+		return C.int(-1)
+	}
+	exempter, ok := fw.(firewall.Exempter)
+	if !ok {
+		logger.Errorf("Kill switch exemptions are not supported by this firewall")
+		return C.int(-1)
+	}
+
+	// an empty list removes all exemptions
+	var list []firewall.Exemption
+	if raw := C.GoString(exemptions); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &list); err != nil {
+			logger.Errorf("Invalid kill switch exemptions: %v", err)
+			return C.int(-1)
+		}
+	}
+	if err := exempter.SetExemptions(list); err != nil {
+		logger.Errorf("Failed to set kill switch exemptions: %v", err)
+		return C.int(-1)
+	}
+	logger.Verbosef("Kill switch exemptions: %d", len(list))
+	return C.int(0)
+}
+
+//export getKillSwitchExemptions
+func getKillSwitchExemptions() *C.char {
+	fw, err := firewallmgr.Get()
+	if err != nil {
+		logger.Errorf("Failed to get firewall: %v", err)
+		return nil
+	}
+	exempter, ok := fw.(firewall.Exempter)
+	if !ok {
+		return nil
+	}
+	list := exempter.Exemptions()
+	if list == nil {
+		list = []firewall.Exemption{}
+	}
+	out, err := json.Marshal(list)
+	if err != nil {
+		logger.Errorf("Marshal kill switch exemptions: %v", err)
+		return nil
+	}
+	return C.CString(string(out))
+}
+
+//export addKillSwitchAllowedDomain
+func addKillSwitchAllowedDomain(domain *C.char) C.int {
+	if err := firewallmgr.AddAllowedDomain(C.GoString(domain)); err != nil {
+		logger.Errorf("Failed to allow domain: %v", err)
+		return C.int(-1)
+	}
+	return C.int(0)
+}
+
+//export removeKillSwitchAllowedDomain
+func removeKillSwitchAllowedDomain(domain *C.char) C.int {
+	if err := firewallmgr.RemoveAllowedDomain(C.GoString(domain)); err != nil {
+		logger.Errorf("Failed to remove allowed domain: %v", err)
+		return C.int(-1)
+	}
+	return C.int(0)
+}
+
+//export getKillSwitchAllowedDomains
+func getKillSwitchAllowedDomains() *C.char {
+	domains := firewallmgr.AllowedDomains()
+	if domains == nil {
+		domains = []string{}
+	}
+	out, err := json.Marshal(domains)
+	if err != nil {
+		logger.Errorf("Marshal allowed domains: %v", err)
+		return nil
+	}
+	return C.CString(string(out))
+}
+
+//export setBootKillSwitch
+func setBootKillSwitch(enabled C.int) C.int {
+	fw, err := firewallmgr.Get()
+	if err != nil {
+		logger.Errorf("Failed to get firewall: %v", err)
+		return C.int(-1)
+	}
+	boot, ok := fw.(firewall.BootKillSwitch)
+	if !ok {
+		logger.Errorf("Boot-time kill switch is not supported by this firewall")
+		return C.int(-1)
+	}
+
+	if err := boot.SetBootKillSwitch(enabled == 1, bootLocalNetworks(fw)); err != nil {
+		logger.Errorf("Failed to set boot-time kill switch: %v", err)
+		return C.int(-1)
+	}
+	logger.Verbosef("Boot-time kill switch enabled: %v", enabled == 1)
+	return enabled
+}
+
+//export getBootKillSwitchStatus
+func getBootKillSwitchStatus() C.int {
+	fw, err := firewallmgr.Get()
+	if err != nil {
+		logger.Errorf("Failed to get firewall: %v", err)
+		return C.int(0)
+	}
+
+	if boot, ok := fw.(firewall.BootKillSwitch); ok && boot.IsBootKillSwitchEnabled() {
+		return C.int(1)
+	}
+	return C.int(0)
+}
+
+// syncBootKillSwitch reinstalls an installed boot ruleset, so it keeps matching the kill switch's LAN bypass.
+func syncBootKillSwitch(fw firewall.Firewall) {
+	boot, ok := fw.(firewall.BootKillSwitch)
+	if !ok || !boot.IsBootKillSwitchEnabled() {
+		return
+	}
+	if err := boot.SetBootKillSwitch(true, bootLocalNetworks(fw)); err != nil {
+		logger.Errorf("Failed to update boot-time kill switch: %v", err)
+	}
+}
+
+// bootLocalNetworks returns the local networks the boot ruleset lets through, those of the LAN bypass if it's on.
+func bootLocalNetworks(fw firewall.Firewall) []netip.Prefix {
+	if !fw.IsAllowLocalNetworksEnabled() {
+		return nil
+	}
+	return firewallmgr.GetLocalAddresses()
+}
+
+//export setDnsLock
+func setDnsLock(enabled C.int) C.int {
+	fw, err := firewallmgr.Get()
+	if err != nil {
+		logger.Errorf("Failed to get firewall: %v", err)
+		return C.int(-1)
+	}
+	locker, ok := fw.(firewall.DnsLocker)
+	if !ok {
+		logger.Errorf("DNS lock is not supported by this firewall")
+		return C.int(-1)
+	}
+
+	if err := locker.SetDnsLock(enabled == 1); err != nil {
+		logger.Errorf("Failed to set DNS lock: %v", err)
+		return C.int(-1)
+	}
+	logger.Verbosef("DNS lock enabled: %v", enabled == 1)
+	return enabled
+}
+
+//export getDnsLockStatus
+func getDnsLockStatus() C.int {
+	fw, err := firewallmgr.Get()
+	if err != nil {
+		logger.Errorf("Failed to get firewall: %v", err)
+		return C.int(0)
+	}
+
+	if locker, ok := fw.(firewall.DnsLocker); ok && locker.IsDnsLockEnabled() {
+		return C.int(1)
+	}
+	return C.int(0)
+}
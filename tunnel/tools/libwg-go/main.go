@@ -1,6 +1,8 @@
 package main
 
 import (
+	_ "github.com/wgtunnel/desktop/tunnel/allowedips"
+	_ "github.com/wgtunnel/desktop/tunnel/blocklist"
 	_ "github.com/wgtunnel/desktop/tunnel/killswitch"
 	_ "github.com/wgtunnel/desktop/tunnel/proxy"
 	_ "github.com/wgtunnel/desktop/tunnel/vpn"
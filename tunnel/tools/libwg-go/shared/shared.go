@@ -83,4 +83,6 @@ const (
 	StatusHealthy = iota
 	StatusHandshakeFailure
 	StatusResolvingDNS
+	StatusStateDrift
+	StatusFailedClosed
 )
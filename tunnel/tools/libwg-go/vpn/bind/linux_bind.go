@@ -8,11 +8,11 @@ import (
 
 	"github.com/amnezia-vpn/amneziawg-go/conn"
 	"github.com/amnezia-vpn/amneziawg-go/device"
-	"github.com/wgtunnel/desktop/tunnel/vpn/firewall/mark"
 	"golang.org/x/sys/unix"
 )
 
-func SetupBind(logger *device.Logger, bind conn.Bind) error {
+// SetupBind applies fwMark to every socket of the bind so encrypted traffic bypasses the tunnel table.
+func SetupBind(logger *device.Logger, bind conn.Bind, fwMark uint32) error {
 	stdBind, ok := bind.(*conn.StdNetBind)
 	if !ok {
 		return fmt.Errorf("failed to cast to StdNetBind")
@@ -21,11 +21,11 @@ func SetupBind(logger *device.Logger, bind conn.Bind) error {
 		var opErr error
 		err := c.Control(func(fd uintptr) {
 			logger.Verbosef("Control called on socket FD %d - setting fwmark...", fd)
-			if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, mark.LinuxBypassMarkNum); err != nil {
+			if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, int(fwMark)); err != nil {
 				opErr = err
 				logger.Errorf("Failed to set fwmark on FD %d: %v", fd, err)
 			} else {
-				logger.Verbosef("Fwmark %d set on FD %d", mark.LinuxBypassMarkNum, fd)
+				logger.Verbosef("Fwmark %d set on FD %d", fwMark, fd)
 			}
 		})
 		if err != nil {
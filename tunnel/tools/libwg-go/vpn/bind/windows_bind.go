@@ -7,6 +7,6 @@ import (
 	"github.com/amnezia-vpn/amneziawg-go/device"
 )
 
-func SetupBind(logger *device.Logger, bind conn.Bind) error {
+func SetupBind(logger *device.Logger, bind conn.Bind, fwMark uint32) error {
 	return nil
 }
@@ -0,0 +1,256 @@
+//go:build linux
+
+package dns
+
+import (
+	"cmp"
+	"net/netip"
+	"slices"
+	"sync"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+)
+
+// linkConfig is the DNS configuration of a tunnel interface.
+type linkConfig struct {
+	dns            []netip.Addr
+	searchDomains  []string
+	routingDomains []string
+	fullTunnel     bool
+	// precedence orders the links, the full tunnel with the lowest one takes the default DNS route
+	precedence int
+	// shadowed is set on a full tunnel applied as a split one, as another full tunnel has a lower precedence
+	shadowed bool
+	// seq breaks precedence ties in the order the links were first configured
+	seq uint64
+}
+
+// backend applies a tunnel's DNS configuration through one of the system's resolver managers.
+type backend interface {
+	name() string
+	// available reports whether the backend manages DNS on this system
+	available() bool
+	set(iface string, cfg linkConfig, logger *device.Logger) error
+	revert(iface string, logger *device.Logger) error
+}
+
+var (
+	// backends in order of preference, the resolv.conf file backend is always available
+	backends = []backend{
+		resolvedBackend{},
+		newNetworkManagerBackend(),
+		newResolvconfBackend(),
+		fileBackend{},
+	}
+
+	activeMu sync.Mutex
+	// active is the backend each interface was configured with, so it is reverted through the same one
+	active = map[string]backend{}
+	// links are the configs of the interfaces in active, backends merging several links read them under activeMu
+	links   = map[string]linkConfig{}
+	linkSeq uint64
+)
+
+// SetDns configures DNS servers, search domains and routing domains through the first available of systemd-resolved,
+// NetworkManager and resolvconf (per-interface), falling back to overwriting /etc/resolv.conf otherwise. Routing
+// domains are only resolved by the tunnel's DNS servers, without being added to the search list. With several full
+// tunnels up, only the one with the lowest precedence takes the default DNS route, the others keep their routing
+// domains until it goes down.
+func SetDns(iface string, dns []netip.Addr, searchDomains, routingDomains []string, fullTunnel bool, precedence int, logger *device.Logger) error {
+	if len(dns) == 0 && len(searchDomains) == 0 {
+		logger.Verbosef("Skipping DNS apply (empty)")
+		return nil
+	}
+	if len(dns) == 0 && len(routingDomains) > 0 {
+		logger.Verbosef("Ignoring routing domains without DNS servers")
+		routingDomains = nil
+	}
+	cfg := linkConfig{
+		dns:            dns,
+		searchDomains:  searchDomains,
+		routingDomains: routingDomains,
+		fullTunnel:     fullTunnel,
+		precedence:     precedence,
+	}
+
+	activeMu.Lock()
+	defer activeMu.Unlock()
+	prevPrimary := primaryLink()
+	if prev, ok := links[iface]; ok {
+		cfg.seq = prev.seq
+	} else {
+		linkSeq++
+		cfg.seq = linkSeq
+	}
+	links[iface] = cfg
+
+	b, ok := active[iface]
+	if !ok {
+		b = selectBackend()
+	}
+	logger.Verbosef("Configuring DNS via %s...", b.name())
+	err := b.set(iface, effectiveConfig(iface), logger)
+	if err != nil {
+		if _, isFile := b.(fileBackend); isFile {
+			active[iface] = b
+			return err
+		}
+		logger.Errorf("Configure DNS via %s failed, falling back to resolv.conf: %v", b.name(), err)
+		if revertErr := b.revert(iface, logger); revertErr != nil {
+			logger.Verbosef("Revert partial %s config: %v", b.name(), revertErr)
+		}
+		b = fileBackend{}
+		err = b.set(iface, effectiveConfig(iface), logger)
+	}
+	active[iface] = b
+	if primary := primaryLink(); primary != prevPrimary {
+		// the other full tunnel gained or lost the default DNS route
+		for _, other := range []string{prevPrimary, primary} {
+			if other != "" && other != iface {
+				reapplyLink(other, logger)
+			}
+		}
+	}
+	return err
+}
+
+// RevertDns reverts DNS configuration through the backend the interface was configured with. A full tunnel next in
+// precedence takes over the default DNS route.
+func RevertDns(iface string, logger *device.Logger) error {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+	prevPrimary := primaryLink()
+	b, ok := active[iface]
+	if !ok {
+		b = selectBackend()
+	}
+	delete(active, iface)
+	delete(links, iface)
+	logger.Verbosef("Reverting DNS via %s...", b.name())
+	err := b.revert(iface, logger)
+	if primary := primaryLink(); primary != prevPrimary && primary != "" {
+		reapplyLink(primary, logger)
+	}
+	return err
+}
+
+// reapplyLink sets an interface's DNS again through its backend, after it gained or lost the default DNS route.
+func reapplyLink(iface string, logger *device.Logger) {
+	b, ok := active[iface]
+	if !ok {
+		return
+	}
+	logger.Verbosef("Re-applying DNS of %s via %s for the new precedence order", iface, b.name())
+	if err := b.set(iface, effectiveConfig(iface), logger); err != nil {
+		logger.Errorf("Re-apply DNS of %s: %v", iface, err)
+	}
+}
+
+// primaryLink returns the full tunnel with the lowest precedence, or "" without one.
+func primaryLink() string {
+	for _, iface := range sortedLinks() {
+		if links[iface].fullTunnel {
+			return iface
+		}
+	}
+	return ""
+}
+
+// sortedLinks returns the configured interfaces in precedence order.
+func sortedLinks() []string {
+	ifaces := make([]string, 0, len(links))
+	for iface := range links {
+		ifaces = append(ifaces, iface)
+	}
+	slices.SortFunc(ifaces, func(a, b string) int {
+		return cmp.Or(cmp.Compare(links[a].precedence, links[b].precedence), cmp.Compare(links[a].seq, links[b].seq))
+	})
+	return ifaces
+}
+
+// effectiveConfig returns the interface's config as its backend applies it, a full tunnel shadowed by another only
+// keeps its routing domains.
+func effectiveConfig(iface string) linkConfig {
+	cfg := links[iface]
+	if cfg.fullTunnel && primaryLink() != iface {
+		cfg.fullTunnel = false
+		cfg.shadowed = true
+	}
+	return cfg
+}
+
+func selectBackend() backend {
+	for _, b := range backends {
+		if b.available() {
+			return b
+		}
+	}
+	return fileBackend{}
+}
+
+// resolvedBackend configures the link through systemd-resolved.
+type resolvedBackend struct{}
+
+func (resolvedBackend) name() string { return "systemd-resolved" }
+
+func (resolvedBackend) available() bool { return isSystemdResolvedActive() }
+
+func (resolvedBackend) set(iface string, cfg linkConfig, _ *device.Logger) error {
+	index, err := getInterfaceIndex(iface)
+	if err != nil {
+		return err
+	}
+	return setDnsSystemd(index, cfg)
+}
+
+func (resolvedBackend) revert(iface string, _ *device.Logger) error {
+	index, err := getInterfaceIndex(iface)
+	if err != nil {
+		return err
+	}
+	return revertDnsSystemd(index)
+}
+
+// fileBackend overwrites /etc/resolv.conf with the merged configs of every interface using it, keeping a backup to
+// restore once the last one is reverted.
+type fileBackend struct{}
+
+func (fileBackend) name() string { return "resolv.conf" }
+
+func (fileBackend) available() bool { return true }
+
+func (fileBackend) set(iface string, _ linkConfig, logger *device.Logger) error {
+	return setDnsFile(fileLinks(iface), logger)
+}
+
+func (fileBackend) revert(_ string, logger *device.Logger) error {
+	if remaining := fileLinks(""); len(remaining) > 0 {
+		return setDnsFile(remaining, logger)
+	}
+	return revertDnsFile(logger)
+}
+
+// fileLinks returns the effective configs of the interfaces using the file backend in precedence order, along with
+// iface which is being configured through it.
+func fileLinks(iface string) []linkConfig {
+	var cfgs []linkConfig
+	for _, l := range sortedLinks() {
+		if _, isFile := active[l].(fileBackend); isFile || l == iface {
+			cfgs = append(cfgs, effectiveConfig(l))
+		}
+	}
+	return cfgs
+}
+
+// splitRoutes returns the forwarder routes of the split tunnels with routing domains, in precedence order.
+func splitRoutes() []ForwarderRoute {
+	var routes []ForwarderRoute
+	for _, l := range sortedLinks() {
+		cfg := effectiveConfig(l)
+		if cfg.fullTunnel || len(cfg.routingDomains) == 0 {
+			continue
+		}
+		routes = append(routes, ForwarderRoute{Domains: cfg.routingDomains, Upstreams: HostPorts(cfg.dns)})
+	}
+	return routes
+}
@@ -0,0 +1,154 @@
+//go:build linux
+
+package dns
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+)
+
+// fakeBackend records the effective config of each interface set through it.
+type fakeBackend struct {
+	applied map[string]linkConfig
+}
+
+func (b *fakeBackend) name() string    { return "fake" }
+func (b *fakeBackend) available() bool { return true }
+
+func (b *fakeBackend) set(iface string, cfg linkConfig, _ *device.Logger) error {
+	b.applied[iface] = cfg
+	return nil
+}
+
+func (b *fakeBackend) revert(iface string, _ *device.Logger) error {
+	delete(b.applied, iface)
+	return nil
+}
+
+// useFakeBackend replaces the backends for the test, with no interface configured.
+func useFakeBackend(t *testing.T) *fakeBackend {
+	fake := &fakeBackend{applied: make(map[string]linkConfig)}
+	prevBackends := backends
+	backends = []backend{fake}
+	active = map[string]backend{}
+	links = map[string]linkConfig{}
+	t.Cleanup(func() {
+		backends = prevBackends
+		active = map[string]backend{}
+		links = map[string]linkConfig{}
+	})
+	return fake
+}
+
+func TestSetDnsPrecedence(t *testing.T) {
+	logger := device.NewLogger(device.LogLevelSilent, "")
+	fake := useFakeBackend(t)
+	dnsA := []netip.Addr{netip.MustParseAddr("10.64.0.1")}
+	dnsB := []netip.Addr{netip.MustParseAddr("10.65.0.1")}
+
+	if err := SetDns("wgtun0", dnsA, nil, []string{"a.internal"}, true, 1, logger); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := fake.applied["wgtun0"]; !cfg.fullTunnel || cfg.shadowed {
+		t.Fatalf("only full tunnel applied as %+v", cfg)
+	}
+
+	// a lower precedence takes the default DNS route, the other keeps its routing domains
+	if err := SetDns("wgtun1", dnsB, nil, nil, true, 0, logger); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := fake.applied["wgtun1"]; !cfg.fullTunnel {
+		t.Errorf("primary applied as %+v", cfg)
+	}
+	if cfg := fake.applied["wgtun0"]; cfg.fullTunnel || !cfg.shadowed || len(cfg.routingDomains) != 1 {
+		t.Errorf("shadowed tunnel applied as %+v", cfg)
+	}
+
+	// the next in precedence takes over
+	if err := RevertDns("wgtun1", logger); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.applied["wgtun1"]; ok {
+		t.Error("reverted tunnel still applied")
+	}
+	if cfg := fake.applied["wgtun0"]; !cfg.fullTunnel || cfg.shadowed {
+		t.Errorf("remaining tunnel applied as %+v", cfg)
+	}
+}
+
+func TestSetDnsPrecedenceTie(t *testing.T) {
+	logger := device.NewLogger(device.LogLevelSilent, "")
+	fake := useFakeBackend(t)
+	dns := []netip.Addr{netip.MustParseAddr("10.64.0.1")}
+
+	for _, iface := range []string{"wgtun0", "wgtun1"} {
+		if err := SetDns(iface, dns, nil, nil, true, 0, logger); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// re-setting the first keeps its place
+	if err := SetDns("wgtun0", dns, []string{"corp"}, nil, true, 0, logger); err != nil {
+		t.Fatal(err)
+	}
+	if !fake.applied["wgtun0"].fullTunnel || fake.applied["wgtun1"].fullTunnel {
+		t.Errorf("first configured tunnel lost the default DNS route: %+v", fake.applied)
+	}
+}
+
+func TestSetDnsIgnoresRoutingDomainsWithoutServers(t *testing.T) {
+	logger := device.NewLogger(device.LogLevelSilent, "")
+	fake := useFakeBackend(t)
+
+	if err := SetDns("wgtun0", nil, nil, nil, false, 0, logger); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.applied) != 0 {
+		t.Errorf("empty config applied: %+v", fake.applied)
+	}
+	if err := SetDns("wgtun0", nil, []string{"corp"}, []string{"internal"}, false, 0, logger); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := fake.applied["wgtun0"]; cfg.routingDomains != nil || len(cfg.searchDomains) != 1 {
+		t.Errorf("applied as %+v", cfg)
+	}
+}
+
+func TestSplitRoutes(t *testing.T) {
+	logger := device.NewLogger(device.LogLevelSilent, "")
+	useFakeBackend(t)
+	dnsA := []netip.Addr{netip.MustParseAddr("10.64.0.1")}
+	dnsB := []netip.Addr{netip.MustParseAddr("10.65.0.1")}
+
+	links := []struct {
+		iface   string
+		dns     []netip.Addr
+		routing []string
+		full    bool
+		prec    int
+	}{
+		{"wgtun0", dnsA, []string{"a.internal"}, false, 1},
+		{"wgtun1", dnsB, []string{"b.internal"}, false, 0},
+		// a full tunnel shadowed by wgtun3 is routed like a split one
+		{"wgtun2", dnsA, []string{"c.internal"}, true, 2},
+		{"wgtun3", dnsB, []string{"d.internal"}, true, 0},
+	}
+	for _, l := range links {
+		if err := SetDns(l.iface, l.dns, nil, l.routing, l.full, l.prec, logger); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// in precedence order, without the primary full tunnel
+	want := []string{"b.internal", "a.internal", "c.internal"}
+	routes := splitRoutes()
+	if len(routes) != len(want) {
+		t.Fatalf("splitRoutes() = %+v, want domains %v", routes, want)
+	}
+	for i, r := range routes {
+		if len(r.Domains) != 1 || r.Domains[0] != want[i] || len(r.Upstreams) != 1 {
+			t.Errorf("route %d = %+v, want domain %s", i, r, want[i])
+		}
+	}
+}
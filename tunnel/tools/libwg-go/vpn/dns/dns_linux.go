@@ -9,6 +9,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/amnezia-vpn/amneziawg-go/device"
 	"github.com/godbus/dbus/v5"
@@ -25,6 +26,14 @@ const (
 	resolvConfBak  = "/var/lib/wgtunnel/resolv.conf.bak"
 )
 
+var (
+	// splitForwarderAddr is where the split DNS forwarder serves when systemd-resolved is unavailable
+	splitForwarderAddr = netip.MustParseAddrPort("127.0.0.153:53")
+
+	forwarderMu    sync.Mutex
+	splitForwarder *Forwarder
+)
+
 // Conn represents a systemd-resolved dbus connection.
 type Conn struct {
 	conn *dbus.Conn
@@ -32,6 +41,18 @@ type Conn struct {
 }
 
 func newConn() (*Conn, error) {
+	conn, err := newSystemBus()
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{
+		conn: conn,
+		obj:  conn.Object(dbusDest, dbusPath),
+	}, nil
+}
+
+// newSystemBus opens a private, authenticated connection to the system bus.
+func newSystemBus() (*dbus.Conn, error) {
 	conn, err := dbus.SystemBusPrivate()
 	if err != nil {
 		return nil, fmt.Errorf("failed to init private conn to system bus: %w", err)
@@ -47,10 +68,7 @@ func newConn() (*Conn, error) {
 		conn.Close()
 		return nil, fmt.Errorf("failed to make hello call: %w", err)
 	}
-	return &Conn{
-		conn: conn,
-		obj:  conn.Object(dbusDest, dbusPath),
-	}, nil
+	return conn, nil
 }
 
 // Call wraps obj.CallWithContext by using 0 as flags and formats the method with the dbus manager interface.
@@ -63,26 +81,6 @@ func (c *Conn) Close() error {
 	return c.conn.Close()
 }
 
-// SetDns configures DNS servers and search domains, using systemd-resolved if available (per-interface),
-// falling back to overwriting /etc/resolv.conf otherwise.
-func SetDns(iface string, dns []netip.Addr, searchDomains []string, fullTunnel bool, logger *device.Logger) error {
-	if len(dns) == 0 && len(searchDomains) == 0 {
-		logger.Verbosef("Skipping DNS apply (empty)")
-		return nil
-	}
-	index, err := getInterfaceIndex(iface)
-	if isSystemdResolvedActive() {
-		if err != nil {
-			logger.Errorf("Failed to get interface name, falling back to resolv.conf: %v", err)
-			return setDnsFile(dns, searchDomains, fullTunnel, logger)
-		}
-		logger.Verbosef("Configuring systemd-resolver...")
-		return setDnsSystemd(index, dns, searchDomains, fullTunnel)
-	}
-	logger.Verbosef("Systemd-resolver not detected, falling back to resolv.conf...")
-	return setDnsFile(dns, searchDomains, fullTunnel, logger)
-}
-
 func getInterfaceIndex(ifName string) (int, error) {
 	link, err := netlink.LinkByName(ifName)
 	if err != nil {
@@ -91,21 +89,6 @@ func getInterfaceIndex(ifName string) (int, error) {
 	return link.Attrs().Index, nil
 }
 
-// RevertDns reverts DNS configuration, using systemd-resolved if available, or restoring the resolv.conf backup otherwise.
-func RevertDns(iface string, logger *device.Logger) error {
-	index, err := getInterfaceIndex(iface)
-	if isSystemdResolvedActive() {
-		if err != nil {
-			logger.Errorf("Failed to get interface name, attempting to revert resolv.conf from backup...")
-			return revertDnsFile(logger)
-		}
-		logger.Verbosef("Reverting systemd-resolver...")
-		return revertDnsSystemd(index)
-	}
-	logger.Verbosef("Systemd-resolver not detected, attempting to revert dns from backup...")
-	return revertDnsFile(logger)
-}
-
 // isSystemdResolvedActive checks if systemd-resolved is available and responsive via DBus.
 func isSystemdResolvedActive() bool {
 	conn, err := newConn()
@@ -131,7 +114,7 @@ func isSystemdResolvedActive() bool {
 }
 
 // setDnsSystemd configures DNS via systemd-resolved DBus (per-interface).
-func setDnsSystemd(ifIndex int, dns []netip.Addr, searchDomains []string, fullTunnel bool) error {
+func setDnsSystemd(ifIndex int, cfg linkConfig) error {
 	conn, err := newConn()
 	if err != nil {
 		return fmt.Errorf("dbus connect: %w", err)
@@ -144,7 +127,7 @@ func setDnsSystemd(ifIndex int, dns []netip.Addr, searchDomains []string, fullTu
 	}
 
 	var linkDNS []dnsEntry
-	for _, ip := range dns {
+	for _, ip := range cfg.dns {
 		fam := int32(unix.AF_INET)
 		if ip.Is6() {
 			fam = int32(unix.AF_INET6)
@@ -165,14 +148,20 @@ func setDnsSystemd(ifIndex int, dns []netip.Addr, searchDomains []string, fullTu
 	}
 
 	var linkDomains []domainEntry
-	for _, domain := range searchDomains {
+	for _, domain := range cfg.searchDomains {
 		linkDomains = append(linkDomains, domainEntry{
 			Domain:  domain,
 			Routing: false,
 		})
 	}
+	for _, domain := range cfg.routingDomains {
+		linkDomains = append(linkDomains, domainEntry{
+			Domain:  strings.TrimPrefix(domain, "~"),
+			Routing: true,
+		})
+	}
 	// full tunnel, add "~." as routing domain to capture all queries
-	if fullTunnel && len(dns) > 0 {
+	if cfg.fullTunnel && len(cfg.dns) > 0 {
 		linkDomains = append(linkDomains, domainEntry{
 			Domain:  "~.",
 			Routing: true,
@@ -183,9 +172,10 @@ func setDnsSystemd(ifIndex int, dns []netip.Addr, searchDomains []string, fullTu
 		return fmt.Errorf("set link domains: %w", call.Err)
 	}
 
-	// set the link as the default DNS route for full tunnel
-	if fullTunnel {
-		call = conn.Call(context.Background(), "SetLinkDefaultRoute", ifIndex, true)
+	// set the link as the default DNS route for full tunnel, a split tunnel with routing domains or a full tunnel
+	// shadowed by another only answers those
+	if cfg.fullTunnel || cfg.shadowed || len(cfg.routingDomains) > 0 {
+		call = conn.Call(context.Background(), "SetLinkDefaultRoute", ifIndex, cfg.fullTunnel)
 		if call.Err != nil {
 			return fmt.Errorf("set link default route: %w", call.Err)
 		}
@@ -217,62 +207,57 @@ func revertDnsSystemd(ifIndex int) error {
 	return nil
 }
 
-// setDnsFile is the fallback: overwrites /etc/resolv.conf and locks if fullTunnel.
-func setDnsFile(dns []netip.Addr, searchDomains []string, fullTunnel bool, logger *device.Logger) error {
-	logger.Verbosef("--- DNS fallback mode --")
-
-	if err := backupResolvConf(logger); err != nil {
-		logger.Errorf("Backup failed: %v", err)
-	} else {
-		logger.Verbosef("Backup created at %s", resolvConfBak)
+// syncSplitForwarder serves the routing domains of every split tunnel from their DNS and everything else from system,
+// or stops the forwarder if no split tunnel has routing domains. It returns the address to use as the nameserver.
+func syncSplitForwarder(system []netip.Addr, logger *device.Logger) (netip.Addr, bool, error) {
+	stopSplitForwarder()
+	routes := splitRoutes()
+	if len(routes) == 0 {
+		return netip.Addr{}, false, nil
 	}
-
-	// Write new resolv.conf
-	f, err := os.Create(resolvConfPath)
+	f, err := StartForwarder(ForwarderConfig{
+		ListenAddr: splitForwarderAddr,
+		Upstreams:  HostPorts(system),
+		Routes:     routes,
+	}, logger)
 	if err != nil {
-		return fmt.Errorf("failed to create /etc/resolv.conf: %w", err)
+		return netip.Addr{}, false, err
 	}
-	defer f.Close()
 
-	for _, d := range dns {
-		fmt.Fprintf(f, "nameserver %s\n", d.String())
-	}
-	if len(searchDomains) > 0 {
-		fmt.Fprintf(f, "search %s\n", strings.Join(searchDomains, " "))
-	}
-	logger.Verbosef("Wrote %d nameservers to /etc/resolv.conf", len(dns))
-
-	return nil
+	forwarderMu.Lock()
+	splitForwarder = f
+	forwarderMu.Unlock()
+	return f.Addr().Addr(), true, nil
 }
 
-// revertDnsFile is the fallback: restores backup and unlocks.
-func revertDnsFile(logger *device.Logger) error {
-	if _, err := os.Stat(resolvConfBak); os.IsNotExist(err) {
-		logger.Verbosef("No backup file to restore")
-		return nil
-	}
+func stopSplitForwarder() {
+	forwarderMu.Lock()
+	f := splitForwarder
+	splitForwarder = nil
+	forwarderMu.Unlock()
 
-	src, err := os.ReadFile(resolvConfBak)
-	if err != nil {
-		return err
-	}
-	if err := os.WriteFile(resolvConfPath, src, 0644); err != nil {
-		return err
+	if err := f.Close(); err != nil {
+		f.logger.Errorf("Stop split DNS forwarder: %v", err)
 	}
-	os.Remove(resolvConfBak)
-	logger.Verbosef("Restored original /etc/resolv.conf from backup")
-	return nil
 }
 
-// backupResolvConf backs up resolv.conf if not already done.
-func backupResolvConf(logger *device.Logger) error {
-	if _, err := os.Stat(resolvConfBak); err == nil {
-		logger.Verbosef("Backup already exists, skipping")
-		return nil
-	}
-	src, err := os.ReadFile(resolvConfPath)
+// readNameservers returns the nameserver entries of a resolv.conf file, skipping our own forwarder.
+func readNameservers(path string) ([]netip.Addr, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return fmt.Errorf("read original resolv.conf: %w", err)
+		return nil, err
+	}
+	var servers []netip.Addr
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[1])
+		if err != nil || addr == splitForwarderAddr.Addr() {
+			continue
+		}
+		servers = append(servers, addr)
 	}
-	return os.WriteFile(resolvConfBak, src, 0644)
+	return servers, nil
 }
@@ -0,0 +1,185 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/amnezia-vpn/amneziawg-go/device"
+)
+
+const forwarderTimeout = 5 * time.Second
+
+// ForwarderConfig configures an in-process DNS forwarder.
+type ForwarderConfig struct {
+	// ListenAddr is the loopback address and port to serve on, over UDP and TCP
+	ListenAddr netip.AddrPort
+	// Upstreams answer every query not matching RoutingDomains, e.g. the system's original nameservers
+	Upstreams []string
+	// RoutingDomains are sent to RoutedUpstreams only, along with their subdomains
+	RoutingDomains  []string
+	RoutedUpstreams []string
+	// Routes reserve further domains for their own upstreams, e.g. one per split tunnel
+	Routes []ForwarderRoute
+	// Bootstrap are plain DNS servers resolving the hostnames of encrypted upstreams, so they don't loop through the
+	// system resolver back to the forwarder
+	Bootstrap []string
+	// CacheSize is the response cache size in bytes, 0 disables the cache
+	CacheSize int
+}
+
+// ForwarderRoute sends Domains, along with their subdomains, to Upstreams only.
+type ForwarderRoute struct {
+	Domains   []string
+	Upstreams []string
+}
+
+// Forwarder is an in-process DNS forwarder, used where the system resolver can't route domains itself.
+type Forwarder struct {
+	proxy     *proxy.Proxy
+	upstreams *proxy.UpstreamConfig
+	bootstrap upstream.ParallelResolver
+	addr      netip.AddrPort
+	logger    *device.Logger
+}
+
+// StartForwarder starts serving on cfg.ListenAddr.
+func StartForwarder(cfg ForwarderConfig, logger *device.Logger) (*Forwarder, error) {
+	lines := upstreamLines(cfg)
+	if len(lines) == 0 {
+		return nil, errors.New("no upstreams")
+	}
+	opts := &upstream.Options{Timeout: forwarderTimeout}
+	if len(cfg.Bootstrap) > 0 {
+		boot, err := bootstrapResolver(cfg.Bootstrap)
+		if err != nil {
+			return nil, err
+		}
+		opts.Bootstrap = boot
+	}
+	closeBootstrap := func() { closeResolvers(opts.Bootstrap) }
+	uc, err := proxy.ParseUpstreamsConfig(lines, opts)
+	if err != nil {
+		closeBootstrap()
+		return nil, fmt.Errorf("parse upstreams: %w", err)
+	}
+
+	udpAddr := net.UDPAddrFromAddrPort(cfg.ListenAddr)
+	tcpAddr := net.TCPAddrFromAddrPort(cfg.ListenAddr)
+	p, err := proxy.New(&proxy.Config{
+		UpstreamConfig: uc,
+		UpstreamMode:   proxy.UpstreamModeLoadBalance,
+		UDPListenAddr:  []*net.UDPAddr{udpAddr},
+		TCPListenAddr:  []*net.TCPAddr{tcpAddr},
+		CacheEnabled:   cfg.CacheSize > 0,
+		CacheSizeBytes: cfg.CacheSize,
+	})
+	if err != nil {
+		_ = uc.Close()
+		closeBootstrap()
+		return nil, fmt.Errorf("create forwarder: %w", err)
+	}
+	if err := p.Start(context.Background()); err != nil {
+		_ = uc.Close()
+		closeBootstrap()
+		return nil, fmt.Errorf("start forwarder on %v: %w", cfg.ListenAddr, err)
+	}
+
+	logger.Verbosef("DNS forwarder listening on %v", cfg.ListenAddr)
+	boot, _ := opts.Bootstrap.(upstream.ParallelResolver)
+	return &Forwarder{proxy: p, upstreams: uc, bootstrap: boot, addr: cfg.ListenAddr, logger: logger}, nil
+}
+
+// Addr returns the address the forwarder serves on.
+func (f *Forwarder) Addr() netip.AddrPort {
+	return f.addr
+}
+
+// Close stops the forwarder and its upstream connections.
+func (f *Forwarder) Close() error {
+	if f == nil {
+		return nil
+	}
+	err := f.proxy.Shutdown(context.Background())
+	if closeErr := f.upstreams.Close(); closeErr != nil {
+		err = errors.Join(err, closeErr)
+	}
+	closeResolvers(f.bootstrap)
+	f.logger.Verbosef("DNS forwarder on %v stopped", f.addr)
+	return err
+}
+
+// upstreamLines builds the dnsproxy upstream config, [/domain/]upstream lines reserve a domain for an upstream.
+// Routed domains fall back to the default upstreams when there are none.
+func upstreamLines(cfg ForwarderConfig) []string {
+	routes := append([]ForwarderRoute{{Domains: cfg.RoutingDomains, Upstreams: cfg.RoutedUpstreams}}, cfg.Routes...)
+	lines := append([]string{}, cfg.Upstreams...)
+	for _, route := range routes {
+		if len(route.Domains) == 0 || len(route.Upstreams) == 0 {
+			continue
+		}
+		if len(lines) == 0 {
+			lines = append(lines, route.Upstreams...)
+		}
+		lines = append(lines, routeLines(route)...)
+	}
+	return lines
+}
+
+// routeLines prefixes each of the route's upstreams with its domains.
+func routeLines(route ForwarderRoute) []string {
+	var domains []string
+	for _, d := range route.Domains {
+		d = strings.Trim(strings.TrimPrefix(d, "~"), ".")
+		if d != "" {
+			domains = append(domains, d)
+		}
+	}
+	if len(domains) == 0 {
+		return nil
+	}
+	prefix := "[/" + strings.Join(domains, "/") + "/]"
+	lines := make([]string, 0, len(route.Upstreams))
+	for _, u := range route.Upstreams {
+		lines = append(lines, prefix+u)
+	}
+	return lines
+}
+
+// bootstrapResolver resolves upstream hostnames through any of the given plain DNS servers.
+func bootstrapResolver(servers []string) (upstream.ParallelResolver, error) {
+	var resolvers upstream.ParallelResolver
+	for _, s := range servers {
+		r, err := upstream.NewUpstreamResolver(s, &upstream.Options{Timeout: forwarderTimeout})
+		if err != nil {
+			return nil, fmt.Errorf("bootstrap %s: %w", s, err)
+		}
+		resolvers = append(resolvers, r)
+	}
+	return resolvers, nil
+}
+
+func closeResolvers(r upstream.Resolver) {
+	resolvers, _ := r.(upstream.ParallelResolver)
+	for _, r := range resolvers {
+		if c, ok := r.(io.Closer); ok {
+			_ = c.Close()
+		}
+	}
+}
+
+// HostPorts formats DNS servers as plain DNS upstreams.
+func HostPorts(servers []netip.Addr) []string {
+	out := make([]string, 0, len(servers))
+	for _, s := range servers {
+		out = append(out, netip.AddrPortFrom(s, 53).String())
+	}
+	return out
+}
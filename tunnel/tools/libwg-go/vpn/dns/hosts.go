@@ -0,0 +1,123 @@
+package dns
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	hostsBlockBegin = "# BEGIN wgtunnel "
+	hostsBlockEnd   = "# END wgtunnel "
+)
+
+var (
+	hostsMu sync.Mutex
+
+	hostNameRe = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?)*$`)
+)
+
+// hostsPath returns the system hosts file.
+func hostsPath() string {
+	if runtime.GOOS == "windows" {
+		root := os.Getenv("SystemRoot")
+		if root == "" {
+			root = `C:\Windows`
+		}
+		return filepath.Join(root, "System32", "drivers", "etc", "hosts")
+	}
+	return "/etc/hosts"
+}
+
+// ValidHostName reports whether name can be used as a hosts file name.
+func ValidHostName(name string) bool {
+	return len(name) <= 253 && hostNameRe.MatchString(name)
+}
+
+// SetHosts replaces the managed block of the iface in the hosts file with the names, removing it when there are none.
+// Each tunnel has its own block, so tunnels come and go without touching each other's names.
+func SetHosts(iface string, names map[string][]netip.Addr) error {
+	hostsMu.Lock()
+	defer hostsMu.Unlock()
+
+	path, err := filepath.EvalSymlinks(hostsPath())
+	if err != nil {
+		return fmt.Errorf("resolve hosts file: %w", err)
+	}
+	current, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("read hosts file: %w", err)
+	}
+
+	updated := append(removeHostsBlock(current, iface), hostsBlock(iface, names)...)
+	if bytes.Equal(updated, current) {
+		return nil
+	}
+	if err := replaceFile(path, updated); err != nil {
+		return fmt.Errorf("write hosts file: %w", err)
+	}
+	return nil
+}
+
+// RevertHosts removes the managed block of the iface from the hosts file.
+func RevertHosts(iface string) error {
+	return SetHosts(iface, nil)
+}
+
+// hostsBlock formats the names as a managed block, one line per address and sorted so rewrites are stable.
+func hostsBlock(iface string, names map[string][]netip.Addr) []byte {
+	if len(names) == 0 {
+		return nil
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	slices.Sort(sorted)
+
+	var buf bytes.Buffer
+	buf.WriteString(hostsBlockBegin + iface + "\n")
+	for _, name := range sorted {
+		for _, addr := range names[name] {
+			fmt.Fprintf(&buf, "%s\t%s\n", addr, name)
+		}
+	}
+	buf.WriteString(hostsBlockEnd + iface + "\n")
+	return buf.Bytes()
+}
+
+// removeHostsBlock returns the hosts file without the managed block of the iface. The rest is kept byte for byte,
+// with a missing trailing newline added so a block can follow.
+func removeHostsBlock(content []byte, iface string) []byte {
+	begin, end := hostsBlockBegin+iface, hostsBlockEnd+iface
+
+	var out bytes.Buffer
+	inBlock := false
+	for _, line := range strings.SplitAfter(string(content), "\n") {
+		if line == "" {
+			continue
+		}
+		trimmed := strings.TrimRight(line, "\r\n")
+		switch {
+		case trimmed == begin:
+			inBlock = true
+		case trimmed == end && inBlock:
+			inBlock = false
+		case !inBlock:
+			out.WriteString(line)
+			if !strings.HasSuffix(line, "\n") {
+				out.WriteString("\n")
+			}
+		}
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,217 @@
+//go:build linux
+
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	nmDest            = "org.freedesktop.NetworkManager"
+	nmPath            = dbus.ObjectPath("/org/freedesktop/NetworkManager")
+	nmDnsManagerPath  = dbus.ObjectPath("/org/freedesktop/NetworkManager/DnsManager")
+	nmInterface       = "org.freedesktop.NetworkManager"
+	nmDeviceInterface = "org.freedesktop.NetworkManager.Device"
+
+	// nmPriorityFullTunnel is negative so NetworkManager uses only this connection's DNS servers
+	nmPriorityFullTunnel = int32(-50)
+	// nmPrioritySplit keeps other connections' DNS servers for everything but the tunnel's domains
+	nmPrioritySplit = int32(50)
+	// nmPriorityNone is the priority of a connection without DNS servers
+	nmPriorityNone = int32(100)
+
+	nmAppliedRetries = 10
+	nmAppliedBackoff = 100 * time.Millisecond
+)
+
+// busConn is the part of a D-Bus connection the NetworkManager backend uses, so it can run against a stub bus.
+type busConn interface {
+	Object(dest string, path dbus.ObjectPath) dbus.BusObject
+	Close() error
+}
+
+// networkManagerBackend configures the tunnel as an externally activated NetworkManager device, so DNS follows
+// NetworkManager's per-connection priorities.
+type networkManagerBackend struct {
+	connect func() (busConn, error)
+}
+
+func newNetworkManagerBackend() *networkManagerBackend {
+	return &networkManagerBackend{
+		connect: func() (busConn, error) { return newSystemBus() },
+	}
+}
+
+func (b *networkManagerBackend) name() string { return "NetworkManager" }
+
+// available reports whether NetworkManager runs and manages resolv.conf itself. With systemd-resolved as its DNS
+// plugin the resolved backend is preferred, and with dns=none another manager owns resolv.conf.
+func (b *networkManagerBackend) available() bool {
+	conn, err := b.connect()
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	mode, err := conn.Object(nmDest, nmDnsManagerPath).GetProperty(nmInterface + ".DnsManager.Mode")
+	if err != nil {
+		return false
+	}
+	m, _ := mode.Value().(string)
+	return m != "" && m != "none" && m != "systemd-resolved"
+}
+
+func (b *networkManagerBackend) set(iface string, cfg linkConfig, logger *device.Logger) error {
+	conn, err := b.connect()
+	if err != nil {
+		return fmt.Errorf("dbus connect: %w", err)
+	}
+	defer conn.Close()
+
+	dev, err := nmDevice(conn, iface)
+	if err != nil {
+		return err
+	}
+	if err := dev.SetProperty(nmDeviceInterface+".Managed", dbus.MakeVariant(true)); err != nil {
+		return fmt.Errorf("set %s managed: %w", iface, err)
+	}
+
+	settings, version, err := nmAppliedConnection(dev)
+	if err != nil {
+		return err
+	}
+	if !nmApplyDns(settings, cfg) && len(cfg.dns) > 0 {
+		return fmt.Errorf("NetworkManager device %s has no addresses to attach DNS to", iface)
+	}
+
+	if err := dev.CallWithContext(context.Background(), nmDeviceInterface+".Reapply", 0, settings, version, uint32(0)).Store(); err != nil {
+		return fmt.Errorf("reapply %s: %w", iface, err)
+	}
+	logger.Verbosef("Set %d nameservers on NetworkManager device %s", len(cfg.dns), iface)
+	return nil
+}
+
+// revert clears the DNS settings of the device and hands it back, the interface may already be gone on shutdown.
+func (b *networkManagerBackend) revert(iface string, logger *device.Logger) error {
+	conn, err := b.connect()
+	if err != nil {
+		return fmt.Errorf("dbus connect: %w", err)
+	}
+	defer conn.Close()
+
+	dev, err := nmDevice(conn, iface)
+	if err != nil {
+		logger.Verbosef("NetworkManager device %s not found, nothing to revert", iface)
+		return nil
+	}
+	settings, version, err := nmAppliedConnection(dev)
+	if err == nil {
+		nmApplyDns(settings, linkConfig{})
+		if err := dev.CallWithContext(context.Background(), nmDeviceInterface+".Reapply", 0, settings, version, uint32(0)).Store(); err != nil {
+			logger.Verbosef("Clear DNS of %s: %v", iface, err)
+		}
+	}
+	if err := dev.SetProperty(nmDeviceInterface+".Managed", dbus.MakeVariant(false)); err != nil {
+		return fmt.Errorf("set %s unmanaged: %w", iface, err)
+	}
+	return nil
+}
+
+func nmDevice(conn busConn, iface string) (dbus.BusObject, error) {
+	var path dbus.ObjectPath
+	err := conn.Object(nmDest, nmPath).CallWithContext(context.Background(), nmInterface+".GetDeviceByIpIface", 0, iface).Store(&path)
+	if err != nil {
+		return nil, fmt.Errorf("get device %s: %w", iface, err)
+	}
+	return conn.Object(nmDest, path), nil
+}
+
+// nmAppliedConnection waits for NetworkManager to generate the connection of a freshly managed device.
+func nmAppliedConnection(dev dbus.BusObject) (map[string]map[string]dbus.Variant, uint64, error) {
+	var (
+		settings map[string]map[string]dbus.Variant
+		version  uint64
+		err      error
+	)
+	for i := 0; i < nmAppliedRetries; i++ {
+		err = dev.CallWithContext(context.Background(), nmDeviceInterface+".GetAppliedConnection", 0, uint32(0)).Store(&settings, &version)
+		if err == nil {
+			return settings, version, nil
+		}
+		time.Sleep(nmAppliedBackoff)
+	}
+	return nil, 0, fmt.Errorf("get applied connection: %w", err)
+}
+
+// nmApplyDns sets the DNS servers, search list and priority of both families in the connection settings. Routing
+// domains take the ~ prefix NetworkManager uses for lookup-only domains, a full tunnel routes "~." to itself.
+// NetworkManager only takes DNS for a family with manual addresses, the router's, so a family without them gets
+// none and IPv6 is left alone instead of being autoconfigured on the tunnel. It reports whether any family took DNS.
+func nmApplyDns(settings map[string]map[string]dbus.Variant, cfg linkConfig) bool {
+	var (
+		dnsv4 []uint32
+		dnsv6 [][]byte
+	)
+	for _, ip := range cfg.dns {
+		if ip.Is4() {
+			b := ip.As4()
+			dnsv4 = append(dnsv4, binary.NativeEndian.Uint32(b[:]))
+		} else {
+			b := ip.As16()
+			dnsv6 = append(dnsv6, b[:])
+		}
+	}
+
+	search := append([]string{}, cfg.searchDomains...)
+	for _, d := range cfg.routingDomains {
+		search = append(search, "~"+strings.TrimPrefix(d, "~"))
+	}
+	priority := nmPriorityNone
+	switch {
+	case len(cfg.dns) == 0:
+	case cfg.fullTunnel:
+		search = append(search, "~.")
+		priority = nmPriorityFullTunnel
+	default:
+		priority = nmPrioritySplit
+	}
+
+	applied := false
+	for _, family := range []string{"ipv4", "ipv6"} {
+		if settings[family] == nil {
+			settings[family] = map[string]dbus.Variant{}
+		}
+		m := settings[family]
+		// deprecated, these conflict with address-data and route-data on reapply
+		delete(m, "addresses")
+		delete(m, "routes")
+
+		if method, _ := m["method"].Value().(string); method != "manual" {
+			if family == "ipv6" {
+				// SLAAC or DHCPv6 on the tunnel would fight the router's addresses and routes
+				m["method"] = dbus.MakeVariant("ignore")
+			}
+			delete(m, "dns")
+			delete(m, "dns-search")
+			delete(m, "dns-priority")
+			continue
+		}
+		if family == "ipv4" {
+			m["dns"] = dbus.MakeVariant(dnsv4)
+		} else {
+			m["dns"] = dbus.MakeVariant(dnsv6)
+		}
+		m["dns-search"] = dbus.MakeVariant(search)
+		m["dns-priority"] = dbus.MakeVariant(priority)
+		m["ignore-auto-dns"] = dbus.MakeVariant(true)
+		applied = true
+	}
+	return applied
+}
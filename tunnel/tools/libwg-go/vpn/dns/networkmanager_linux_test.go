@@ -0,0 +1,227 @@
+//go:build linux
+
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+	"github.com/godbus/dbus/v5"
+)
+
+// stubNM is a NetworkManager on a stub bus with a single device.
+type stubNM struct {
+	mode     string
+	iface    string
+	settings map[string]map[string]dbus.Variant
+	managed  bool
+	reapply  map[string]map[string]dbus.Variant
+	closed   int
+}
+
+func (n *stubNM) Object(_ string, path dbus.ObjectPath) dbus.BusObject {
+	return &stubObject{nm: n, path: path}
+}
+
+func (n *stubNM) Close() error {
+	n.closed++
+	return nil
+}
+
+type stubObject struct {
+	dbus.BusObject
+	nm   *stubNM
+	path dbus.ObjectPath
+}
+
+const stubDevicePath = dbus.ObjectPath("/org/freedesktop/NetworkManager/Devices/7")
+
+func (o *stubObject) CallWithContext(_ context.Context, method string, _ dbus.Flags, args ...any) *dbus.Call {
+	switch method {
+	case nmInterface + ".GetDeviceByIpIface":
+		if args[0] != o.nm.iface {
+			return &dbus.Call{Err: errors.New("org.freedesktop.NetworkManager.UnknownDevice")}
+		}
+		return &dbus.Call{Body: []any{stubDevicePath}}
+	case nmDeviceInterface + ".GetAppliedConnection":
+		return &dbus.Call{Body: []any{o.nm.settings, uint64(3)}}
+	case nmDeviceInterface + ".Reapply":
+		if args[1] != uint64(3) {
+			return &dbus.Call{Err: errors.New("org.freedesktop.NetworkManager.Device.VersionIdMismatch")}
+		}
+		o.nm.reapply = args[0].(map[string]map[string]dbus.Variant)
+		return &dbus.Call{}
+	}
+	return &dbus.Call{Err: errors.New("unknown method " + method)}
+}
+
+func (o *stubObject) GetProperty(p string) (dbus.Variant, error) {
+	if o.path == nmDnsManagerPath && p == nmInterface+".DnsManager.Mode" {
+		return dbus.MakeVariant(o.nm.mode), nil
+	}
+	return dbus.Variant{}, errors.New("unknown property " + p)
+}
+
+func (o *stubObject) SetProperty(p string, v any) error {
+	if o.path != stubDevicePath || p != nmDeviceInterface+".Managed" {
+		return errors.New("unknown property " + p)
+	}
+	o.nm.managed = v.(dbus.Variant).Value().(bool)
+	return nil
+}
+
+func newStubNM(ipv4Method, ipv6Method string) *stubNM {
+	return &stubNM{
+		mode:  "default",
+		iface: "wgtun0",
+		settings: map[string]map[string]dbus.Variant{
+			"connection": {"id": dbus.MakeVariant("wgtun0")},
+			"ipv4":       {"method": dbus.MakeVariant(ipv4Method), "addresses": dbus.MakeVariant([][]uint32{})},
+			"ipv6":       {"method": dbus.MakeVariant(ipv6Method)},
+		},
+	}
+}
+
+func (n *stubNM) backend() *networkManagerBackend {
+	return &networkManagerBackend{connect: func() (busConn, error) { return n, nil }}
+}
+
+func TestNetworkManagerAvailable(t *testing.T) {
+	for mode, want := range map[string]bool{
+		"default":          true,
+		"dnsmasq":          true,
+		"none":             false,
+		"systemd-resolved": false,
+		"":                 false,
+	} {
+		nm := newStubNM("manual", "manual")
+		nm.mode = mode
+		if got := nm.backend().available(); got != want {
+			t.Errorf("available() with mode %q = %v, want %v", mode, got, want)
+		}
+	}
+
+	b := &networkManagerBackend{connect: func() (busConn, error) { return nil, errors.New("no bus") }}
+	if b.available() {
+		t.Error("available() without a bus = true")
+	}
+}
+
+func TestNetworkManagerSet(t *testing.T) {
+	logger := device.NewLogger(device.LogLevelSilent, "")
+	v4 := netip.MustParseAddr("10.64.0.1")
+	v6 := netip.MustParseAddr("fd00::1")
+
+	tests := []struct {
+		name       string
+		ipv6Method string
+		cfg        linkConfig
+		wantSearch []string
+		wantPrio   int32
+		wantV6Dns  bool
+	}{
+		{
+			name:       "full tunnel",
+			ipv6Method: "manual",
+			cfg:        linkConfig{dns: []netip.Addr{v4, v6}, searchDomains: []string{"corp"}, fullTunnel: true},
+			wantSearch: []string{"corp", "~."},
+			wantPrio:   nmPriorityFullTunnel,
+			wantV6Dns:  true,
+		},
+		{
+			name:       "split tunnel with routing domains",
+			ipv6Method: "manual",
+			cfg:        linkConfig{dns: []netip.Addr{v4}, routingDomains: []string{"~internal", "lab"}},
+			wantSearch: []string{"~internal", "~lab"},
+			wantPrio:   nmPrioritySplit,
+			wantV6Dns:  true,
+		},
+		{
+			name:       "IPv4-only tunnel leaves IPv6 alone",
+			ipv6Method: "auto",
+			cfg:        linkConfig{dns: []netip.Addr{v4, v6}, fullTunnel: true},
+			wantSearch: []string{"~."},
+			wantPrio:   nmPriorityFullTunnel,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nm := newStubNM("manual", tt.ipv6Method)
+			if err := nm.backend().set("wgtun0", tt.cfg, logger); err != nil {
+				t.Fatalf("set: %v", err)
+			}
+			if !nm.managed {
+				t.Error("device not managed")
+			}
+			if nm.closed != 1 {
+				t.Errorf("bus closed %d times, want 1", nm.closed)
+			}
+
+			ipv4 := nm.reapply["ipv4"]
+			b := v4.As4()
+			if got := ipv4["dns"].Value(); !slices.Equal(got.([]uint32), []uint32{binary.NativeEndian.Uint32(b[:])}) {
+				t.Errorf("ipv4 dns = %v", got)
+			}
+			if got := ipv4["dns-search"].Value(); !slices.Equal(got.([]string), tt.wantSearch) {
+				t.Errorf("ipv4 dns-search = %v, want %v", got, tt.wantSearch)
+			}
+			if got := ipv4["dns-priority"].Value(); got != tt.wantPrio {
+				t.Errorf("ipv4 dns-priority = %v, want %v", got, tt.wantPrio)
+			}
+			if _, ok := ipv4["addresses"]; ok {
+				t.Error("deprecated ipv4 addresses kept")
+			}
+
+			ipv6 := nm.reapply["ipv6"]
+			_, hasDns := ipv6["dns"]
+			if hasDns != tt.wantV6Dns {
+				t.Errorf("ipv6 dns set = %v, want %v", hasDns, tt.wantV6Dns)
+			}
+			method := ipv6["method"].Value()
+			if tt.wantV6Dns && method != "manual" || !tt.wantV6Dns && method != "ignore" {
+				t.Errorf("ipv6 method = %v", method)
+			}
+		})
+	}
+}
+
+func TestNetworkManagerSetWithoutAddresses(t *testing.T) {
+	nm := newStubNM("disabled", "ignore")
+	cfg := linkConfig{dns: []netip.Addr{netip.MustParseAddr("10.64.0.1")}, fullTunnel: true}
+	if err := nm.backend().set("wgtun0", cfg, device.NewLogger(device.LogLevelSilent, "")); err == nil {
+		t.Fatal("set without addresses succeeded")
+	}
+	if nm.reapply != nil {
+		t.Error("reapplied without addresses")
+	}
+}
+
+func TestNetworkManagerRevert(t *testing.T) {
+	logger := device.NewLogger(device.LogLevelSilent, "")
+	nm := newStubNM("manual", "manual")
+	nm.managed = true
+	nm.settings["ipv4"]["dns-search"] = dbus.MakeVariant([]string{"~."})
+
+	if err := nm.backend().revert("wgtun0", logger); err != nil {
+		t.Fatalf("revert: %v", err)
+	}
+	if nm.managed {
+		t.Error("device still managed")
+	}
+	if got := nm.reapply["ipv4"]["dns-search"].Value(); len(got.([]string)) != 0 {
+		t.Errorf("ipv4 dns-search = %v, want none", got)
+	}
+	if got := nm.reapply["ipv4"]["dns-priority"].Value(); got != nmPriorityNone {
+		t.Errorf("ipv4 dns-priority = %v, want %v", got, nmPriorityNone)
+	}
+
+	// the interface is gone on shutdown
+	if err := nm.backend().revert("wgtun1", logger); err != nil {
+		t.Errorf("revert of a missing device: %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+//go:build linux
+
+package dns
+
+import (
+	"bytes"
+	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+)
+
+// resolvconfBackend hands a per-interface record to resolvconf, either Debian's resolvconf or openresolv, which
+// merges it with the other interfaces' records into /etc/resolv.conf.
+type resolvconfBackend struct {
+	lookPath func(file string) (string, error)
+	// run executes a command with stdin, returning its combined output
+	run func(stdin []byte, name string, args ...string) ([]byte, error)
+}
+
+func newResolvconfBackend() *resolvconfBackend {
+	return &resolvconfBackend{
+		lookPath: exec.LookPath,
+		run: func(stdin []byte, name string, args ...string) ([]byte, error) {
+			cmd := exec.Command(name, args...)
+			cmd.Stdin = bytes.NewReader(stdin)
+			return cmd.CombinedOutput()
+		},
+	}
+}
+
+func (b *resolvconfBackend) name() string { return "resolvconf" }
+
+// available reports whether a resolvconf binary is installed that isn't systemd's resolvconf compatibility shim,
+// which systemd-resolved covers already.
+func (b *resolvconfBackend) available() bool {
+	path, err := b.lookPath("resolvconf")
+	if err != nil {
+		return false
+	}
+	if target, err := os.Readlink(path); err == nil && strings.Contains(target, "resolvectl") {
+		return false
+	}
+	return true
+}
+
+// isOpenresolv tells openresolv, which supports exclusive records and metrics, from Debian's resolvconf.
+func (b *resolvconfBackend) isOpenresolv() bool {
+	out, err := b.run(nil, "resolvconf", "--version")
+	return err == nil && strings.Contains(string(out), "openresolv")
+}
+
+// set adds the interface's record, with the precedence as its metric. A full tunnel's record is exclusive on
+// openresolv, routing domains of split tunnels are served by the split forwarder since resolvconf can't route domains.
+func (b *resolvconfBackend) set(iface string, cfg linkConfig, logger *device.Logger) error {
+	dns := cfg.dns
+	stopSplitForwarder()
+	if len(splitRoutes()) > 0 {
+		system, err := b.systemNameservers(iface)
+		if err != nil {
+			logger.Errorf("Read resolvconf nameservers: %v", err)
+		}
+		addr, _, err := syncSplitForwarder(system, logger)
+		if err != nil {
+			return fmt.Errorf("start split DNS forwarder: %w", err)
+		}
+		if !cfg.fullTunnel && len(cfg.routingDomains) > 0 {
+			dns = []netip.Addr{addr}
+		}
+	}
+
+	args := []string{"-a", iface}
+	if b.isOpenresolv() {
+		args = append([]string{"-m", strconv.Itoa(cfg.precedence)}, args...)
+		if cfg.fullTunnel {
+			args = append([]string{"-x"}, args...)
+		}
+	}
+	if out, err := b.run(resolvConfRecord(dns, cfg.searchDomains), "resolvconf", args...); err != nil {
+		stopSplitForwarder()
+		return fmt.Errorf("resolvconf %s: %w (%s)", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	logger.Verbosef("Added resolvconf record for %s with %d nameservers", iface, len(dns))
+	return nil
+}
+
+// revert removes the interface's record, the split forwarder keeps serving the other split tunnels.
+func (b *resolvconfBackend) revert(iface string, logger *device.Logger) error {
+	args := []string{"-d", iface}
+	if b.isOpenresolv() {
+		// don't fail on a record that is already gone
+		args = append(args, "-f")
+	}
+	out, err := b.run(nil, "resolvconf", args...)
+	stopSplitForwarder()
+	if len(splitRoutes()) > 0 {
+		system, readErr := readNameservers(resolvConfPath)
+		if readErr != nil {
+			logger.Errorf("Read resolvconf nameservers: %v", readErr)
+		}
+		if _, _, syncErr := syncSplitForwarder(system, logger); syncErr != nil {
+			logger.Errorf("Restart split DNS forwarder: %v", syncErr)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("resolvconf %s: %w (%s)", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	logger.Verbosef("Removed resolvconf record for %s", iface)
+	return nil
+}
+
+// systemNameservers returns the nameservers of resolv.conf as resolvconf generates it without the interface's record.
+func (b *resolvconfBackend) systemNameservers(iface string) ([]netip.Addr, error) {
+	// the record may not exist yet, which some versions report as an error
+	_, _ = b.run(nil, "resolvconf", "-d", iface)
+	return readNameservers(resolvConfPath)
+}
+
+// resolvConfRecord formats nameservers and search domains as resolv.conf lines.
+func resolvConfRecord(dns []netip.Addr, searchDomains []string) []byte {
+	var buf bytes.Buffer
+	for _, d := range dns {
+		fmt.Fprintf(&buf, "nameserver %s\n", d.String())
+	}
+	if len(searchDomains) > 0 {
+		fmt.Fprintf(&buf, "search %s\n", strings.Join(searchDomains, " "))
+	}
+	return buf.Bytes()
+}
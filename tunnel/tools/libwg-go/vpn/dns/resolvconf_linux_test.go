@@ -0,0 +1,142 @@
+//go:build linux
+
+package dns
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+)
+
+// fakeResolvconf records the resolvconf invocations instead of running them.
+type fakeResolvconf struct {
+	version string
+	fail    string
+	calls   []string
+	stdin   map[string]string
+}
+
+func (f *fakeResolvconf) backend() *resolvconfBackend {
+	f.stdin = make(map[string]string)
+	return &resolvconfBackend{
+		lookPath: func(string) (string, error) { return "/sbin/resolvconf", nil },
+		run: func(stdin []byte, name string, args ...string) ([]byte, error) {
+			call := strings.Join(append([]string{name}, args...), " ")
+			if slices.Equal(args, []string{"--version"}) {
+				return []byte(f.version), nil
+			}
+			f.calls = append(f.calls, call)
+			f.stdin[call] = string(stdin)
+			if call == f.fail {
+				return []byte("resolvconf: error"), errors.New("exit status 1")
+			}
+			return nil, nil
+		},
+	}
+}
+
+func TestResolvconfSet(t *testing.T) {
+	logger := device.NewLogger(device.LogLevelSilent, "")
+	dns := []netip.Addr{netip.MustParseAddr("10.64.0.1"), netip.MustParseAddr("fd00::1")}
+
+	tests := []struct {
+		name    string
+		version string
+		cfg     linkConfig
+		want    string
+	}{
+		{
+			name:    "openresolv full tunnel is exclusive",
+			version: "openresolv 3.12.0",
+			cfg:     linkConfig{dns: dns, searchDomains: []string{"corp", "lab"}, fullTunnel: true, precedence: 2},
+			want:    "resolvconf -x -m 2 -a wgtun0",
+		},
+		{
+			name:    "openresolv split tunnel",
+			version: "openresolv 3.12.0",
+			cfg:     linkConfig{dns: dns, searchDomains: []string{"corp", "lab"}},
+			want:    "resolvconf -m 0 -a wgtun0",
+		},
+		{
+			name:    "Debian resolvconf has no metrics",
+			version: "",
+			cfg:     linkConfig{dns: dns, searchDomains: []string{"corp", "lab"}, fullTunnel: true, precedence: 2},
+			want:    "resolvconf -a wgtun0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeResolvconf{version: tt.version}
+			if err := f.backend().set("wgtun0", tt.cfg, logger); err != nil {
+				t.Fatalf("set: %v", err)
+			}
+			if !slices.Equal(f.calls, []string{tt.want}) {
+				t.Fatalf("calls = %q, want %q", f.calls, tt.want)
+			}
+			want := "nameserver 10.64.0.1\nnameserver fd00::1\nsearch corp lab\n"
+			if got := f.stdin[tt.want]; got != want {
+				t.Errorf("record = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestResolvconfSetError(t *testing.T) {
+	f := &fakeResolvconf{version: "openresolv 3.12.0", fail: "resolvconf -m 0 -a wgtun0"}
+	cfg := linkConfig{dns: []netip.Addr{netip.MustParseAddr("10.64.0.1")}}
+	err := f.backend().set("wgtun0", cfg, device.NewLogger(device.LogLevelSilent, ""))
+	if err == nil || !strings.Contains(err.Error(), "resolvconf: error") {
+		t.Fatalf("set error = %v, want the command output", err)
+	}
+}
+
+func TestResolvconfRevert(t *testing.T) {
+	logger := device.NewLogger(device.LogLevelSilent, "")
+	for version, want := range map[string]string{
+		"openresolv 3.12.0": "resolvconf -d wgtun0 -f",
+		"":                  "resolvconf -d wgtun0",
+	} {
+		f := &fakeResolvconf{version: version}
+		if err := f.backend().revert("wgtun0", logger); err != nil {
+			t.Fatalf("revert: %v", err)
+		}
+		if !slices.Equal(f.calls, []string{want}) {
+			t.Errorf("calls = %q, want %q", f.calls, want)
+		}
+	}
+}
+
+func TestResolvconfAvailable(t *testing.T) {
+	dir := t.TempDir()
+	shim := filepath.Join(dir, "resolvconf")
+	if err := os.Symlink("resolvectl", shim); err != nil {
+		t.Fatal(err)
+	}
+	binary := filepath.Join(dir, "resolvconf.openresolv")
+	if err := os.WriteFile(binary, []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		err  error
+		want bool
+	}{
+		{"installed", binary, nil, true},
+		{"systemd shim", shim, nil, false},
+		{"missing", "", errors.New("not found"), false},
+	}
+	for _, tt := range tests {
+		b := &resolvconfBackend{lookPath: func(string) (string, error) { return tt.path, tt.err }}
+		if got := b.available(); got != tt.want {
+			t.Errorf("%s: available() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+//go:build linux
+
+package dns
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"unsafe"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+	"golang.org/x/sys/unix"
+)
+
+// resolvConfLinkBak holds the target of resolv.conf when it was a symlink, e.g. to the systemd-resolved stub. It is
+// written before resolvConfBak, which marks a complete backup.
+const resolvConfLinkBak = resolvConfBak + ".link"
+
+var (
+	watcherMu     sync.Mutex
+	resolvWatcher *resolvConfWatcher
+)
+
+// setDnsFile is the fallback: replaces /etc/resolv.conf with the merged configs of the tunnels using it, in precedence
+// order, and rewrites it whenever something else changes it while a tunnel is up. The full tunnel's nameservers, or
+// else those of the split tunnels, are written. Routing domains of split tunnels are served by an in-process forwarder,
+// which sends everything else to those nameservers or the original ones.
+func setDnsFile(cfgs []linkConfig, logger *device.Logger) error {
+	logger.Verbosef("--- DNS fallback mode --")
+
+	if err := backupResolvConf(logger); err != nil {
+		logger.Errorf("Backup failed: %v", err)
+	}
+
+	stopResolvWatcher()
+	var dns []netip.Addr
+	var searchDomains []string
+	for _, cfg := range cfgs {
+		for _, d := range cfg.searchDomains {
+			if !slices.Contains(searchDomains, d) {
+				searchDomains = append(searchDomains, d)
+			}
+		}
+	}
+	if i := slices.IndexFunc(cfgs, func(cfg linkConfig) bool { return cfg.fullTunnel }); i >= 0 {
+		dns = cfgs[i].dns
+	} else {
+		for _, cfg := range cfgs {
+			if !cfg.shadowed && len(cfg.routingDomains) == 0 {
+				dns = append(dns, cfg.dns...)
+			}
+		}
+	}
+
+	system := dns
+	if len(system) == 0 {
+		var err error
+		if system, err = readNameservers(resolvConfBak); err != nil {
+			logger.Errorf("Read original nameservers: %v", err)
+		}
+	}
+	addr, ok, err := syncSplitForwarder(system, logger)
+	if err != nil {
+		return fmt.Errorf("start split DNS forwarder: %w", err)
+	}
+	if ok {
+		dns = []netip.Addr{addr}
+	}
+
+	content := resolvConfRecord(dns, searchDomains)
+	if err := replaceFile(resolvConfPath, content); err != nil {
+		return fmt.Errorf("failed to write /etc/resolv.conf: %w", err)
+	}
+	logger.Verbosef("Wrote %d nameservers to /etc/resolv.conf", len(dns))
+
+	if err := startResolvWatcher(content, logger); err != nil {
+		logger.Errorf("Watch /etc/resolv.conf: %v", err)
+	}
+	return nil
+}
+
+// revertDnsFile is the fallback once no tunnel uses it: stops watching and restores the backup, removing it so it is only restored once.
+func revertDnsFile(logger *device.Logger) error {
+	stopResolvWatcher()
+	stopSplitForwarder()
+
+	src, err := os.ReadFile(resolvConfBak)
+	if errors.Is(err, fs.ErrNotExist) {
+		logger.Verbosef("No backup file to restore")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if target, err := os.ReadFile(resolvConfLinkBak); err == nil {
+		err = replaceSymlink(resolvConfPath, string(target))
+		if err != nil {
+			return fmt.Errorf("restore /etc/resolv.conf symlink: %w", err)
+		}
+		logger.Verbosef("Restored /etc/resolv.conf symlink to %s", target)
+	} else if err := replaceFile(resolvConfPath, src); err != nil {
+		return fmt.Errorf("restore /etc/resolv.conf: %w", err)
+	} else {
+		logger.Verbosef("Restored original /etc/resolv.conf from backup")
+	}
+
+	// the backup goes first, a crash before the link backup is removed leaves it to be overwritten by the next backup
+	if err := os.Remove(resolvConfBak); err != nil {
+		return fmt.Errorf("remove backup: %w", err)
+	}
+	_ = os.Remove(resolvConfLinkBak)
+	return nil
+}
+
+// backupResolvConf backs up resolv.conf, and its symlink target if it is one, unless a backup exists. A backup left
+// by a crash holds the original file, not ours, so it is kept.
+func backupResolvConf(logger *device.Logger) error {
+	if _, err := os.Stat(resolvConfBak); err == nil {
+		logger.Verbosef("Backup already exists, skipping")
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(resolvConfBak), 0755); err != nil {
+		return fmt.Errorf("create backup dir: %w", err)
+	}
+
+	_ = os.Remove(resolvConfLinkBak)
+	if target, err := os.Readlink(resolvConfPath); err == nil {
+		if err := replaceFile(resolvConfLinkBak, []byte(target)); err != nil {
+			return fmt.Errorf("back up resolv.conf symlink: %w", err)
+		}
+	}
+	src, err := os.ReadFile(resolvConfPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("read original resolv.conf: %w", err)
+	}
+	if err := replaceFile(resolvConfBak, src); err != nil {
+		return err
+	}
+	logger.Verbosef("Backup created at %s", resolvConfBak)
+	return nil
+}
+
+// replaceSymlink atomically replaces path with a symlink to target.
+func replaceSymlink(path, target string) error {
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".wgtunnel-link")
+	_ = os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// resolvConfWatcher rewrites resolv.conf with our content when DHCP clients or network managers replace it.
+type resolvConfWatcher struct {
+	inotify *os.File
+	content []byte
+	done    chan struct{}
+	logger  *device.Logger
+}
+
+func startResolvWatcher(content []byte, logger *device.Logger) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return fmt.Errorf("inotify init: %w", err)
+	}
+	// the directory is watched, since the file is replaced by renames, ours included
+	mask := uint32(unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_MOVED_FROM | unix.IN_CREATE | unix.IN_DELETE)
+	if _, err := unix.InotifyAddWatch(fd, filepath.Dir(resolvConfPath), mask); err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("inotify watch: %w", err)
+	}
+
+	w := &resolvConfWatcher{
+		inotify: os.NewFile(uintptr(fd), "inotify"),
+		content: content,
+		done:    make(chan struct{}),
+		logger:  logger,
+	}
+	go w.run()
+
+	watcherMu.Lock()
+	resolvWatcher = w
+	watcherMu.Unlock()
+	return nil
+}
+
+func stopResolvWatcher() {
+	watcherMu.Lock()
+	w := resolvWatcher
+	resolvWatcher = nil
+	watcherMu.Unlock()
+
+	if w == nil {
+		return
+	}
+	// closing the non-blocking fd unblocks the pending read
+	w.inotify.Close()
+	<-w.done
+}
+
+func (w *resolvConfWatcher) run() {
+	defer close(w.done)
+
+	name := filepath.Base(resolvConfPath)
+	buf := make([]byte, 4096)
+	for {
+		n, err := w.inotify.Read(buf)
+		if err != nil {
+			return
+		}
+		touched := false
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nameBytes := buf[off+unix.SizeofInotifyEvent : off+unix.SizeofInotifyEvent+int(ev.Len)]
+			if string(bytes.TrimRight(nameBytes, "\x00")) == name {
+				touched = true
+			}
+			off += unix.SizeofInotifyEvent + int(ev.Len)
+		}
+		if touched {
+			w.restore()
+		}
+	}
+}
+
+// restore rewrites our content unless the file still holds it, so our own rename doesn't loop.
+func (w *resolvConfWatcher) restore() {
+	current, err := os.ReadFile(resolvConfPath)
+	if err == nil && bytes.Equal(current, w.content) {
+		if _, err := os.Readlink(resolvConfPath); err != nil {
+			return
+		}
+	}
+	if err := replaceFile(resolvConfPath, w.content); err != nil {
+		w.logger.Errorf("Restore tampered /etc/resolv.conf: %v", err)
+		return
+	}
+	w.logger.Verbosef("/etc/resolv.conf was changed while the tunnel is up, restored tunnel DNS")
+}
@@ -0,0 +1,48 @@
+//go:build !android
+
+package vpn
+
+import (
+	"errors"
+	"net/netip"
+
+	vpndns "github.com/wgtunnel/desktop/tunnel/vpn/dns"
+	"github.com/wgtunnel/desktop/tunnel/vpn/router"
+)
+
+// defaultDnsCacheSize is the forwarder's cache size in bytes unless DNSCacheSize sets one, where 0 disables the cache
+const defaultDnsCacheSize = 1 << 20
+
+// forwarderAddr is the loopback address the DNS forwarder of a tunnel serves on, one per handle and interface slot.
+func forwarderAddr(handleID int32, slot int) netip.AddrPort {
+	return netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, byte(53 + slot), byte(handleID >> 8), byte(handleID)}), 53)
+}
+
+// startDnsForwarder starts the tunnel's DNS forwarder, forwarding to the configured upstreams or else the tunnel's DNS
+// servers. Those are reached through the tunnel's routes like any other traffic and bootstrap encrypted upstreams.
+func startDnsForwarder(addr netip.AddrPort, servers []netip.Addr, ifOpts interfaceOptions) (*vpndns.Forwarder, error) {
+	upstreams := ifOpts.dnsUpstreams
+	if len(upstreams) == 0 {
+		upstreams = vpndns.HostPorts(servers)
+	}
+	if len(upstreams) == 0 {
+		return nil, errors.New("DNSForwarder needs DNS servers or DNSUpstreams")
+	}
+	cacheSize := ifOpts.dnsCacheSize
+	if cacheSize < 0 {
+		cacheSize = defaultDnsCacheSize
+	}
+	return vpndns.StartForwarder(vpndns.ForwarderConfig{
+		ListenAddr: addr,
+		Upstreams:  upstreams,
+		Bootstrap:  vpndns.HostPorts(servers),
+		CacheSize:  cacheSize,
+	}, logger)
+}
+
+// useDnsForwarder points the router config's DNS at the handle's forwarder, if it runs one.
+func (h *TunnelHandle) useDnsForwarder(cfg *router.Config) {
+	if h.dnsForwarder != nil {
+		cfg.DNS = []netip.Addr{h.dnsForwarder.Addr().Addr()}
+	}
+}
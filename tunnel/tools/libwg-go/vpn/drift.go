@@ -0,0 +1,20 @@
+//go:build !android
+
+package vpn
+
+import (
+	"github.com/wgtunnel/desktop/tunnel/shared"
+	"github.com/wgtunnel/desktop/tunnel/vpn/router"
+)
+
+// driftNotifier reports state drift found by the handle's router through the status callback.
+func driftNotifier(handleID int32) func(router.Drift) {
+	return func(d router.Drift) {
+		status := int32(shared.StatusStateDrift)
+		if d.Action == router.DriftFailClosed {
+			status = shared.StatusFailedClosed
+		}
+		shared.LogWarn("Handle %d state drift, missing %v, action %v", handleID, d.Missing, d.Action)
+		go shared.NotifyStatusCode(handleID, status)
+	}
+}
@@ -0,0 +1,96 @@
+package firewall
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var blocklistNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// Blocklist is a named list of CIDRs dropped in both directions while tunnels are up.
+type Blocklist struct {
+	Name     string
+	Prefixes []netip.Prefix
+}
+
+// BlocklistCounter is the traffic a blocklist dropped since the first tunnel came up. The counters live in the
+// blocklist rules, so they reset when the last tunnel goes down and the rules are removed.
+type BlocklistCounter struct {
+	Name    string `json:"name"`
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// Blocklister is implemented by firewalls that enforce blocklists.
+type Blocklister interface {
+	// SetBlocklists replaces the loaded blocklists in one transaction, lists keep their counters across reloads
+	SetBlocklists([]Blocklist) error
+
+	// BlocklistCounters returns the hit counters of the loaded blocklists
+	BlocklistCounters() ([]BlocklistCounter, error)
+}
+
+// LoadBlocklist reads a blocklist from a plain text file of CIDRs or addresses, one per line, with # comments.
+func LoadBlocklist(name, path string) (Blocklist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Blocklist{}, fmt.Errorf("open blocklist %s: %w", name, err)
+	}
+	defer f.Close()
+	return ParseBlocklist(name, f)
+}
+
+// ParseBlocklist parses a blocklist in the LoadBlocklist format.
+func ParseBlocklist(name string, r io.Reader) (Blocklist, error) {
+	if !blocklistNameRe.MatchString(name) {
+		return Blocklist{}, fmt.Errorf("invalid blocklist name %q", name)
+	}
+	list := Blocklist{Name: name}
+
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		prefix, err := parseBlocklistEntry(line)
+		if err != nil {
+			return Blocklist{}, fmt.Errorf("blocklist %s line %d: %w", name, lineNum, err)
+		}
+		list.Prefixes = append(list.Prefixes, prefix)
+	}
+	if err := scanner.Err(); err != nil {
+		return Blocklist{}, fmt.Errorf("read blocklist %s: %w", name, err)
+	}
+	return list, nil
+}
+
+func parseBlocklistEntry(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		if addr := prefix.Addr(); addr.Is4In6() && prefix.Bits() >= 96 {
+			return netip.PrefixFrom(addr.Unmap(), prefix.Bits()-96).Masked(), nil
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
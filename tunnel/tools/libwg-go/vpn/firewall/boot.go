@@ -0,0 +1,21 @@
+package firewall
+
+import "net/netip"
+
+// BootKillSwitch is implemented by firewalls that can install the kill switch to engage at boot, before the app
+// starts. The daemon takes the boot ruleset over once it starts.
+type BootKillSwitch interface {
+	// SetBootKillSwitch installs the boot ruleset letting the local networks through, or removes it
+	SetBootKillSwitch(enabled bool, localNets []netip.Prefix) error
+
+	IsBootKillSwitchEnabled() bool
+
+	// BootKillSwitchLoaded reports whether the boot ruleset is active in the kernel, waiting to be taken over
+	BootKillSwitchLoaded() bool
+
+	// BootLocalNetworks returns the local networks the installed boot ruleset lets through
+	BootLocalNetworks() []netip.Prefix
+
+	// ReleaseBootKillSwitch unloads the boot ruleset, once the daemon's kill switch is up
+	ReleaseBootKillSwitch() error
+}
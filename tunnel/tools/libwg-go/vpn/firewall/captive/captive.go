@@ -0,0 +1,59 @@
+// Package captive detects captive portals by probing a URL that answers 204 No Content on an open network.
+package captive
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// DefaultURL answers 204 unless a captive portal intercepts it.
+const DefaultURL = "http://connectivitycheck.gstatic.com/generate_204"
+
+type Status int32
+
+const (
+	StatusUnknown Status = iota
+	StatusNone
+	StatusPortal
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusNone:
+		return "none"
+	case StatusPortal:
+		return "portal"
+	}
+	return "unknown"
+}
+
+// Probe fetches the URL through the dialer without following redirects. Anything but a 204 is a portal, which
+// answers with its login page or a redirect to it.
+func Probe(ctx context.Context, url string, dialer *net.Dialer) (Status, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext:       dialer.DialContext,
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		Timeout: 10 * time.Second,
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return StatusUnknown, fmt.Errorf("probe request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return StatusUnknown, fmt.Errorf("probe %s: %w", url, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return StatusNone, nil
+	}
+	return StatusPortal, nil
+}
@@ -0,0 +1,9 @@
+package firewall
+
+// DnsLocker is implemented by firewalls that can lock DNS to the tunnels' resolvers, independent of the kill switch.
+type DnsLocker interface {
+	// SetDnsLock enables or disables dropping DNS not sent to or through a tunnel while tunnels are up
+	SetDnsLock(enabled bool) error
+
+	IsDnsLockEnabled() bool
+}
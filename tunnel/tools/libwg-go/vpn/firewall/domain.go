@@ -0,0 +1,15 @@
+package firewall
+
+import (
+	"net/netip"
+	"time"
+)
+
+// DomainAllower is implemented by firewalls that let the resolved addresses of domains through the kill switch. The
+// addresses are resolved and refreshed by the caller.
+type DomainAllower interface {
+	// AllowDomain replaces the domain's allowed addresses, which expire after ttl unless allowed again
+	AllowDomain(domain string, addrs []netip.Addr, ttl time.Duration) error
+
+	RemoveDomain(domain string) error
+}
@@ -0,0 +1,42 @@
+package firewall
+
+import (
+	"errors"
+	"strings"
+)
+
+// Exemption lets the traffic of processes in a cgroup v2, or of a user, through the kill switch.
+type Exemption struct {
+	// Cgroup is the cgroup path below the cgroup2 mount, e.g. "system.slice/updater.service"
+	Cgroup string  `json:"cgroup,omitempty"`
+	UID    *uint32 `json:"uid,omitempty"`
+}
+
+// Validate checks that the exemption names exactly one cgroup other than the root, or a UID.
+func (e Exemption) Validate() error {
+	cgroup := e.CgroupPath()
+	switch {
+	case e.Cgroup != "" && e.UID != nil:
+		return errors.New("exemption sets both cgroup and uid")
+	case e.Cgroup != "" && cgroup == "":
+		return errors.New("the root cgroup can't be exempted")
+	case e.Cgroup == "" && e.UID == nil:
+		return errors.New("exemption sets neither cgroup nor uid")
+	case strings.Contains(cgroup, ".."):
+		return errors.New("exemption cgroup must not contain ..")
+	}
+	return nil
+}
+
+// CgroupPath returns the cgroup path relative to the cgroup2 mount, without surrounding slashes.
+func (e Exemption) CgroupPath() string {
+	return strings.Trim(strings.TrimPrefix(e.Cgroup, "/sys/fs/cgroup"), "/")
+}
+
+// Exempter is implemented by firewalls that can let processes through the kill switch.
+type Exempter interface {
+	// SetExemptions replaces the exemptions, applied while the kill switch is enabled
+	SetExemptions(exemptions []Exemption) error
+
+	Exemptions() []Exemption
+}
@@ -0,0 +1,53 @@
+package firewall
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// InboundPort is a port new inbound connections from a tunnel may reach, Proto is "tcp", "udp" or "" for both.
+type InboundPort struct {
+	Proto string `json:"proto,omitempty"`
+	Port  uint16 `json:"port"`
+}
+
+// InboundPolicy restricts new connections arriving from a tunnel. Replies to our own connections always pass.
+type InboundPolicy struct {
+	// BlockNew drops new inbound connections except to Ports and from AllowFrom
+	BlockNew  bool           `json:"blockNew"`
+	Ports     []InboundPort  `json:"ports,omitempty"`
+	AllowFrom []netip.Prefix `json:"allowFrom,omitempty"`
+}
+
+// InboundGuard is implemented by firewalls that enforce per-tunnel inbound policies, independent of the kill switch.
+type InboundGuard interface {
+	// SetInboundPolicy replaces the tunnel's inbound policy, one that doesn't block removes it
+	SetInboundPolicy(iface string, policy InboundPolicy) error
+
+	RemoveInboundPolicy(iface string) error
+}
+
+// ParseInboundPorts parses a comma or space separated list of ports, each optionally prefixed with tcp/ or udp/.
+func ParseInboundPorts(value string) ([]InboundPort, error) {
+	var ports []InboundPort
+	for _, field := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+		var p InboundPort
+		portStr := field
+		if proto, port, ok := strings.Cut(field, "/"); ok {
+			p.Proto = strings.ToLower(proto)
+			portStr = port
+		}
+		if p.Proto != "" && p.Proto != "tcp" && p.Proto != "udp" {
+			return nil, fmt.Errorf("invalid inbound port %q: unknown protocol", field)
+		}
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("invalid inbound port %q", field)
+		}
+		p.Port = uint16(port)
+		ports = append(ports, p)
+	}
+	return ports, nil
+}
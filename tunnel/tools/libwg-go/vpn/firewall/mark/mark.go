@@ -14,3 +14,19 @@ var (
 	// 0x200000 -> [00, 00, 20, 00]
 	LinuxBootstrapMarkBytes = []byte{0x00, 0x00, 0x20, 0x00}
 )
+
+// MaskFor returns the mask to match markVal with, our mask when the mark fits in it, otherwise the full mark.
+func MaskFor(markVal uint32) uint32 {
+	if markVal&^LinuxFwmarkMaskNum == 0 {
+		return LinuxFwmarkMaskNum
+	}
+	return 0xffffffff
+}
+
+// OrDefault returns markVal, or def when markVal is unset.
+func OrDefault(markVal, def uint32) uint32 {
+	if markVal == 0 {
+		return def
+	}
+	return markVal
+}
@@ -0,0 +1,34 @@
+//go:build linux && !android
+
+package osfirewall
+
+import (
+	"net/netip"
+
+	"github.com/wgtunnel/desktop/tunnel/vpn/firewall"
+)
+
+// Backend is a Linux firewall as the router uses it. The kill switch is either our nftables tables, firewalld
+// direct rules or iptables chains, the other features live in our own nftables tables where nftables is available.
+type Backend interface {
+	firewall.Firewall
+
+	SetTunnelPort(port uint16) error
+	AddTunnelBypasses(iface string, bypassMark, bootstrapMark uint32) error
+	AddMarkBypasses(iface string, bypassMark, bootstrapMark uint32) error
+	AllowExcludedRoutes(iface string, prefixes []netip.Prefix) error
+	RemoveTunnelBypasses(iface string) error
+	ResetTunnelBypasses(iface string) error
+	TunnelBypassesDrifted(iface string) bool
+
+	Drift() []string
+	Reconcile() error
+	ForeignMarks() ([]MarkUse, error)
+
+	ActivateBlocklists(iface string) error
+	DeactivateBlocklists(iface string) error
+	SetDnsLockTunnel(iface string, servers []netip.Addr, bootstrapMark uint32) error
+	RemoveDnsLockTunnel(iface string) error
+	BlockIPv6(iface string, bypassMark, bootstrapMark uint32) error
+	UnblockIPv6(iface string) error
+}
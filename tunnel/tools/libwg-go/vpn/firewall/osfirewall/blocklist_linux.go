@@ -0,0 +1,302 @@
+//go:build linux && !android
+
+package osfirewall
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/wgtunnel/desktop/tunnel/vpn/firewall"
+	"go4.org/netipx"
+)
+
+const (
+	// blocklistTable is an owned table, see ownedTable, but with a chain per hook whose sets are reloaded in place
+	blocklistTable       = "wgtunnel-blocklist"
+	chainNameBlockInput  = "wgtunnel-block-input"
+	chainNameBlockOutput = "wgtunnel-block-output"
+	chainNameBlockFwd    = "wgtunnel-block-forward"
+	blocklistSetPrefix   = "bl-"
+)
+
+// blocklistPriority runs the blocklist chains ahead of the filter chains, a drop there is final
+var blocklistPriority = nftables.ChainPriorityRef(*nftables.ChainPriorityFilter - 10)
+
+// blocklistState holds the loaded blocklists, installed while any tunnel is up.
+type blocklistState struct {
+	lists  []firewall.Blocklist
+	ifaces map[string]struct{}
+}
+
+// SetBlocklists replaces the loaded blocklists. With tunnels up, the sets are reloaded in a single nftables
+// transaction, so traffic is never let through between the old and the new lists.
+func (f *LinuxFirewall) SetBlocklists(lists []firewall.Blocklist) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.blocklists.lists = lists
+	if len(f.blocklists.ifaces) == 0 {
+		return nil
+	}
+	if len(lists) == 0 {
+		return f.removeBlocklistTables()
+	}
+	return f.syncBlocklists()
+}
+
+// ActivateBlocklists installs the blocklists for a tunnel coming up.
+func (f *LinuxFirewall) ActivateBlocklists(iface string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.blocklists.ifaces == nil {
+		f.blocklists.ifaces = make(map[string]struct{})
+	}
+	_, active := f.blocklists.ifaces[iface]
+	f.blocklists.ifaces[iface] = struct{}{}
+	if active || len(f.blocklists.lists) == 0 || len(f.blocklists.ifaces) > 1 {
+		return nil
+	}
+	return f.syncBlocklists()
+}
+
+// DeactivateBlocklists removes the blocklists once the last tunnel is down.
+func (f *LinuxFirewall) DeactivateBlocklists(iface string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.blocklists.ifaces[iface]; !ok {
+		return nil
+	}
+	delete(f.blocklists.ifaces, iface)
+	if len(f.blocklists.ifaces) > 0 {
+		return nil
+	}
+	return f.removeBlocklistTables()
+}
+
+// BlocklistCounters sums the drop rule counters of each loaded blocklist over both families and directions.
+func (f *LinuxFirewall) BlocklistCounters() ([]firewall.BlocklistCounter, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	counters := make(map[string]*firewall.BlocklistCounter)
+	var out []firewall.BlocklistCounter
+	for _, list := range f.blocklists.lists {
+		out = append(out, firewall.BlocklistCounter{Name: list.Name})
+	}
+	for i := range out {
+		counters[out[i].Name] = &out[i]
+	}
+
+	for _, table := range f.getTables() {
+		t, err := getTableIfExists(f.conn, table.Proto, blocklistTable)
+		if err != nil {
+			return nil, fmt.Errorf("get blocklist table: %w", err)
+		}
+		if t == nil {
+			continue
+		}
+		for _, name := range []string{chainNameBlockInput, chainNameBlockOutput, chainNameBlockFwd} {
+			chain, err := getChainFromTable(f.conn, t, name)
+			if err != nil {
+				continue
+			}
+			rules, err := f.conn.GetRules(t, chain)
+			if err != nil {
+				return nil, fmt.Errorf("get rules of %s: %w", name, err)
+			}
+			for _, rule := range rules {
+				c, ok := counters[string(rule.UserData)]
+				if !ok {
+					continue
+				}
+				for _, e := range rule.Exprs {
+					if counter, ok := e.(*expr.Counter); ok {
+						c.Packets += counter.Packets
+						c.Bytes += counter.Bytes
+					}
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+// syncBlocklists brings the blocklist tables in line with the loaded lists. Existing sets are flushed and refilled
+// and their rules kept, so counters survive reloads.
+func (f *LinuxFirewall) syncBlocklists() error {
+	for _, table := range f.getTables() {
+		if err := f.syncBlocklistTable(table.Proto); err != nil {
+			return err
+		}
+	}
+	if err := f.conn.Flush(); err != nil {
+		return fmt.Errorf("flush blocklists: %w", err)
+	}
+	f.logger.Verbosef("Loaded %d blocklists", len(f.blocklists.lists))
+	return nil
+}
+
+// syncBlocklistTable queues the changes for one family, the caller flushes them as one transaction.
+func (f *LinuxFirewall) syncBlocklistTable(family nftables.TableFamily) error {
+	t, err := getTableIfExists(f.conn, family, blocklistTable)
+	if err != nil {
+		return fmt.Errorf("get blocklist table: %w", err)
+	}
+	if t == nil {
+		t = f.conn.AddTable(&nftables.Table{Family: family, Name: blocklistTable})
+	}
+
+	polAccept := nftables.ChainPolicyAccept
+	chains := make(map[string]*nftables.Chain)
+	for name, hook := range map[string]*nftables.ChainHook{
+		chainNameBlockInput:  nftables.ChainHookInput,
+		chainNameBlockOutput: nftables.ChainHookOutput,
+		chainNameBlockFwd:    nftables.ChainHookForward,
+	} {
+		chain, err := getChainFromTable(f.conn, t, name)
+		if err != nil {
+			chain = f.conn.AddChain(&nftables.Chain{
+				Name:     name,
+				Table:    t,
+				Type:     nftables.ChainTypeFilter,
+				Hooknum:  hook,
+				Priority: blocklistPriority,
+				Policy:   &polAccept,
+			})
+		}
+		chains[name] = chain
+	}
+
+	existing := make(map[string]*nftables.Set)
+	if sets, err := f.conn.GetSets(t); err == nil {
+		for _, s := range sets {
+			existing[s.Name] = s
+		}
+	}
+
+	keyType := nftables.TypeIPAddr
+	if family == nftables.TableFamilyIPv6 {
+		keyType = nftables.TypeIP6Addr
+	}
+
+	wanted := make(map[string]bool)
+	for _, list := range f.blocklists.lists {
+		setName := blocklistSetPrefix + list.Name
+		wanted[setName] = true
+		elems := blocklistElements(list.Prefixes, family == nftables.TableFamilyIPv6)
+
+		if set, ok := existing[setName]; ok {
+			f.conn.FlushSet(set)
+			if len(elems) > 0 {
+				if err := f.conn.SetAddElements(set, elems); err != nil {
+					return fmt.Errorf("reload blocklist %s: %w", list.Name, err)
+				}
+			}
+			continue
+		}
+
+		set := &nftables.Set{Table: t, Name: setName, KeyType: keyType, Interval: true}
+		if err := f.conn.AddSet(set, elems); err != nil {
+			return fmt.Errorf("add blocklist %s: %w", list.Name, err)
+		}
+		for _, rule := range blocklistRules(t, chains, set, list.Name) {
+			f.conn.AddRule(rule)
+		}
+	}
+
+	// drop lists no longer loaded, their rules first
+	for name, set := range existing {
+		if wanted[name] {
+			continue
+		}
+		for _, chain := range chains {
+			rules, err := f.conn.GetRules(t, chain)
+			if err != nil {
+				continue
+			}
+			for _, rule := range rules {
+				if blocklistSetPrefix+string(rule.UserData) == name {
+					f.conn.DelRule(rule)
+				}
+			}
+		}
+		f.conn.DelSet(set)
+	}
+	return nil
+}
+
+// blocklistRules drops traffic to the set's addresses on output and forward, and from them on input and forward.
+// The list name is kept in the rule's user data to find its counters.
+func blocklistRules(t *nftables.Table, chains map[string]*nftables.Chain, set *nftables.Set, name string) []*nftables.Rule {
+	v6 := t.Family == nftables.TableFamilyIPv6
+	rule := func(chain *nftables.Chain, src bool) *nftables.Rule {
+		return &nftables.Rule{
+			Table: t,
+			Chain: chain,
+			Exprs: []expr.Any{
+				newLoadAddrExpr(v6, src, 1),
+				&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+				&expr.Counter{},
+				&expr.Verdict{Kind: expr.VerdictDrop},
+			},
+			UserData: []byte(name),
+		}
+	}
+	return []*nftables.Rule{
+		rule(chains[chainNameBlockInput], true),
+		rule(chains[chainNameBlockOutput], false),
+		rule(chains[chainNameBlockFwd], true),
+		rule(chains[chainNameBlockFwd], false),
+	}
+}
+
+// newLoadAddrExpr loads the source or destination address of the packet to the register.
+func newLoadAddrExpr(v6, src bool, destReg uint32) expr.Any {
+	load := &expr.Payload{DestRegister: destReg, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4}
+	switch {
+	case v6 && src:
+		load.Offset, load.Len = 8, 16
+	case v6:
+		load.Offset, load.Len = 24, 16
+	case src:
+		load.Offset = 12
+	}
+	return load
+}
+
+// blocklistElements merges the family's prefixes into non-overlapping interval set elements.
+func blocklistElements(prefixes []netip.Prefix, v6 bool) []nftables.SetElement {
+	var b netipx.IPSetBuilder
+	for _, p := range prefixes {
+		if p.Addr().Is6() == v6 {
+			b.AddPrefix(p)
+		}
+	}
+	set, err := b.IPSet()
+	if err != nil {
+		return nil
+	}
+
+	var elems []nftables.SetElement
+	for _, r := range set.Ranges() {
+		elems = append(elems, nftables.SetElement{Key: r.From().AsSlice()})
+		// an interval reaching the end of the address space has no end element
+		if end := r.To().Next(); end.IsValid() {
+			elems = append(elems, nftables.SetElement{Key: end.AsSlice(), IntervalEnd: true})
+		}
+	}
+	return elems
+}
+
+// removeBlocklistTables deletes the blocklist tables of both families, including ones left by a previous run.
+func (f *LinuxFirewall) removeBlocklistTables() error {
+	if err := f.removeOwnedTables(blocklistTable); err != nil {
+		return err
+	}
+	f.logger.Verbosef("Removed blocklists")
+	return nil
+}
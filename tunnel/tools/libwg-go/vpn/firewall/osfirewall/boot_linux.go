@@ -0,0 +1,223 @@
+//go:build linux && !android
+
+package osfirewall
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/wgtunnel/desktop/tunnel/vpn/firewall/mark"
+)
+
+const (
+	// bootTable holds the boot-time kill switch, loaded before the network comes up and deleted once the daemon's
+	// kill switch has taken over
+	bootTable        = "wgtunnel-boot"
+	bootRulesetPath  = "/etc/wgtunnel/killswitch.nft"
+	bootUnitName     = "wgtunnel-killswitch.service"
+	bootUnitPath     = "/etc/systemd/system/" + bootUnitName
+	bootLocalNetsTag = "# local-networks:"
+)
+
+// bootInstaller writes the boot ruleset and the systemd unit loading it.
+type bootInstaller struct {
+	rulesetPath string
+	unitPath    string
+	lookPath    func(file string) (string, error)
+	// run executes a command, returning its combined output
+	run func(name string, args ...string) ([]byte, error)
+}
+
+func newBootInstaller() *bootInstaller {
+	return &bootInstaller{
+		rulesetPath: bootRulesetPath,
+		unitPath:    bootUnitPath,
+		lookPath:    exec.LookPath,
+		run: func(name string, args ...string) ([]byte, error) {
+			return exec.Command(name, args...).CombinedOutput()
+		},
+	}
+}
+
+// SetBootKillSwitch installs a ruleset matching the kill switch with the local networks allowed, loaded by a
+// systemd unit ordered before network-pre.target, or removes it. Installing again replaces the ruleset.
+func (f *LinuxFirewall) SetBootKillSwitch(enabled bool, localNets []netip.Prefix) error {
+	b := newBootInstaller()
+	if !enabled {
+		if err := b.uninstall(); err != nil {
+			return err
+		}
+		f.logger.Verbosef("Removed boot-time kill switch")
+		return nil
+	}
+	if err := b.install(bootRuleset(localNets, f.v6Available)); err != nil {
+		return err
+	}
+	f.logger.Verbosef("Installed boot-time kill switch, local networks: %v", localNets)
+	return nil
+}
+
+func (f *LinuxFirewall) IsBootKillSwitchEnabled() bool {
+	_, err := os.Stat(newBootInstaller().unitPath)
+	return err == nil
+}
+
+func (f *LinuxFirewall) BootKillSwitchLoaded() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t, err := getTableIfExists(f.conn, nftables.TableFamilyINet, bootTable)
+	return err == nil && t != nil
+}
+
+// BootLocalNetworks reads the local networks back from the installed ruleset's header.
+func (f *LinuxFirewall) BootLocalNetworks() []netip.Prefix {
+	ruleset, err := os.ReadFile(newBootInstaller().rulesetPath)
+	if err != nil {
+		return nil
+	}
+	return bootRulesetLocalNets(ruleset)
+}
+
+func (f *LinuxFirewall) ReleaseBootKillSwitch() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := deleteTableIfExists(f.conn, nftables.TableFamilyINet, bootTable); err != nil {
+		return fmt.Errorf("delete boot kill switch table: %w", err)
+	}
+	f.logger.Verbosef("Released boot-time kill switch")
+	return nil
+}
+
+func (b *bootInstaller) install(ruleset []byte) error {
+	nft, err := b.lookPath("nft")
+	if err != nil {
+		return fmt.Errorf("the boot-time kill switch needs nft: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(b.rulesetPath), 0755); err != nil {
+		return fmt.Errorf("create %s: %w", filepath.Dir(b.rulesetPath), err)
+	}
+	if err := writeFileAtomic(b.rulesetPath, ruleset); err != nil {
+		return err
+	}
+	if out, err := b.run(nft, "-c", "-f", b.rulesetPath); err != nil {
+		return fmt.Errorf("check boot ruleset: %w (%s)", err, strings.TrimSpace(string(out)))
+	}
+	if err := writeFileAtomic(b.unitPath, bootUnit(nft, b.rulesetPath)); err != nil {
+		return err
+	}
+	for _, args := range [][]string{{"daemon-reload"}, {"enable", bootUnitName}} {
+		if out, err := b.run("systemctl", args...); err != nil {
+			return fmt.Errorf("systemctl %s: %w (%s)", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+func (b *bootInstaller) uninstall() error {
+	// the unit may be gone already
+	_, _ = b.run("systemctl", "disable", bootUnitName)
+	for _, path := range []string{b.unitPath, b.rulesetPath} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("remove %s: %w", path, err)
+		}
+	}
+	if out, err := b.run("systemctl", "daemon-reload"); err != nil {
+		return fmt.Errorf("systemctl daemon-reload: %w (%s)", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// bootRuleset mirrors the kill switch rules: loopback and replies in, loopback, our bypass mark and the local
+// networks out, nothing forwarded. Loading it again replaces the table.
+func bootRuleset(localNets []netip.Prefix, v6 bool) []byte {
+	var nets []string
+	for _, p := range localNets {
+		if p.Addr().Is4() || v6 {
+			nets = append(nets, p.Masked().String())
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# wgtunnel boot-time kill switch, taken over by the daemon once it starts\n")
+	fmt.Fprintf(&buf, "%s %s\n", bootLocalNetsTag, strings.Join(nets, " "))
+	fmt.Fprintf(&buf, "table inet %s {}\ndelete table inet %s\n", bootTable, bootTable)
+	fmt.Fprintf(&buf, "table inet %s {\n", bootTable)
+
+	fmt.Fprintf(&buf, "\tchain input {\n\t\ttype filter hook input priority filter; policy accept;\n")
+	fmt.Fprintf(&buf, "\t\tiifname \"lo\" accept\n\t\tct state established,related accept\n\t\tdrop\n\t}\n")
+
+	fmt.Fprintf(&buf, "\tchain output {\n\t\ttype filter hook output priority filter; policy accept;\n")
+	fmt.Fprintf(&buf, "\t\toifname \"lo\" accept\n")
+	fmt.Fprintf(&buf, "\t\tmeta mark and %#x == %#x accept\n", mark.MaskFor(mark.LinuxBypassMarkNum), mark.LinuxBypassMarkNum)
+	for _, n := range nets {
+		family := "ip"
+		if strings.Contains(n, ":") {
+			family = "ip6"
+		}
+		fmt.Fprintf(&buf, "\t\t%s daddr %s accept\n", family, n)
+	}
+	fmt.Fprintf(&buf, "\t\tdrop\n\t}\n")
+
+	fmt.Fprintf(&buf, "\tchain forward {\n\t\ttype filter hook forward priority filter; policy accept;\n\t\tdrop\n\t}\n")
+	fmt.Fprintf(&buf, "}\n")
+	return buf.Bytes()
+}
+
+// bootRulesetLocalNets parses the local networks from the ruleset header.
+func bootRulesetLocalNets(ruleset []byte) []netip.Prefix {
+	scanner := bufio.NewScanner(bytes.NewReader(ruleset))
+	for scanner.Scan() {
+		list, ok := strings.CutPrefix(scanner.Text(), bootLocalNetsTag)
+		if !ok {
+			continue
+		}
+		var nets []netip.Prefix
+		for _, s := range strings.Fields(list) {
+			if p, err := netip.ParsePrefix(s); err == nil {
+				nets = append(nets, p)
+			}
+		}
+		return nets
+	}
+	return nil
+}
+
+// bootUnit loads the ruleset before any network is configured.
+func bootUnit(nft, rulesetPath string) []byte {
+	return []byte(fmt.Sprintf(`[Unit]
+Description=wgtunnel boot-time kill switch
+DefaultDependencies=no
+Before=network-pre.target
+Wants=network-pre.target
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+ExecStart=%s -f %s
+
+[Install]
+WantedBy=sysinit.target
+`, nft, rulesetPath))
+}
+
+// writeFileAtomic replaces the file through a rename, so a crash never leaves it half written.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("write %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("rename %s: %w", tmp, err)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+//go:build linux && !android
+
+package osfirewall
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	dnsLockTable               = "wgtunnel-dnslock"
+	chainNameDnsLockOut        = "wgtunnel-dnslock-output"
+	dnsPort             uint16 = 53
+	dnsOverTLSPort      uint16 = 853
+)
+
+// dnsLockOwned holds the DNS lock, its chain runs ahead of the filter chains, so the kill switch's LAN bypass can't
+// reopen DNS to LAN resolvers
+var dnsLockOwned = ownedTable{
+	name:  dnsLockTable,
+	chain: chainNameDnsLockOut,
+	hook:  nftables.ChainHookOutput,
+	prio:  nftables.ChainPriorityRef(*nftables.ChainPriorityFilter - 5),
+}
+
+// dnsLockTunnel is what a tunnel lets through the DNS lock.
+type dnsLockTunnel struct {
+	servers       []netip.Addr
+	bootstrapMark uint32
+}
+
+// dnsLockState holds the DNS lock setting and the tunnels it applies to, installed while enabled and tunnels are up.
+type dnsLockState struct {
+	enabled bool
+	tunnels map[string]dnsLockTunnel
+}
+
+// SetDnsLock enables or disables the DNS lock, which drops DNS and DNS over TLS except to the tunnels' DNS servers,
+// through the tunnels, to loopback resolvers and from the bootstrap resolver.
+func (f *LinuxFirewall) SetDnsLock(enabled bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.dnsLock.enabled = enabled
+	return f.syncDnsLock()
+}
+
+// IsDnsLockEnabled reports whether the DNS lock is enabled, it is only enforced while tunnels are up.
+func (f *LinuxFirewall) IsDnsLockEnabled() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.dnsLock.enabled
+}
+
+// SetDnsLockTunnel lets the tunnel's DNS servers and bootstrap marked lookups through the DNS lock, replacing any
+// previously set for the iface.
+func (f *LinuxFirewall) SetDnsLockTunnel(iface string, servers []netip.Addr, bootstrapMark uint32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.dnsLock.tunnels == nil {
+		f.dnsLock.tunnels = make(map[string]dnsLockTunnel)
+	}
+	prev, ok := f.dnsLock.tunnels[iface]
+	if ok && slices.Equal(prev.servers, servers) && prev.bootstrapMark == bootstrapMark {
+		return nil
+	}
+	f.dnsLock.tunnels[iface] = dnsLockTunnel{servers: slices.Clone(servers), bootstrapMark: bootstrapMark}
+	return f.syncDnsLock()
+}
+
+// RemoveDnsLockTunnel removes the tunnel from the DNS lock, the lock is lifted with the last tunnel.
+func (f *LinuxFirewall) RemoveDnsLockTunnel(iface string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.dnsLock.tunnels[iface]; !ok {
+		return nil
+	}
+	delete(f.dnsLock.tunnels, iface)
+	return f.syncDnsLock()
+}
+
+// syncDnsLock rebuilds the DNS lock tables in one transaction, or removes them when the lock is off or no tunnel is up.
+func (f *LinuxFirewall) syncDnsLock() error {
+	if !f.dnsLock.enabled || len(f.dnsLock.tunnels) == 0 {
+		return f.removeOwnedTables(dnsLockTable)
+	}
+
+	err := f.syncOwnedTable(dnsLockOwned, f.tableFamilies(), func(t *nftables.Table, chain *nftables.Chain) error {
+		// loopback resolvers, e.g. the systemd-resolved stub or our forwarders, send their upstream queries on their own
+		f.conn.AddRule(createOifnameAcceptRule(t, chain, "lo"))
+
+		var marks []uint32
+		for iface, tun := range f.dnsLock.tunnels {
+			f.conn.AddRule(createOifnameAcceptRule(t, chain, iface))
+			for _, server := range tun.servers {
+				if server.Is6() != (t.Family == nftables.TableFamilyIPv6) {
+					continue
+				}
+				rule, err := createRangeRule(t, chain, netip.PrefixFrom(server, server.BitLen()), expr.VerdictAccept)
+				if err != nil {
+					return fmt.Errorf("create DNS server rule for %v: %w", server, err)
+				}
+				f.conn.AddRule(rule)
+			}
+			if tun.bootstrapMark != 0 && !slices.Contains(marks, tun.bootstrapMark) {
+				marks = append(marks, tun.bootstrapMark)
+				f.conn.AddRule(createFwmarkRule(t, chain, tun.bootstrapMark))
+			}
+		}
+
+		for _, proto := range []byte{unix.IPPROTO_UDP, unix.IPPROTO_TCP} {
+			f.conn.AddRule(createDportDropRule(t, chain, proto, dnsPort))
+			f.conn.AddRule(createDportDropRule(t, chain, proto, dnsOverTLSPort))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	f.logger.Verbosef("DNS lock active for %d tunnels", len(f.dnsLock.tunnels))
+	return nil
+}
+
+// createOifnameAcceptRule accepts traffic leaving through the interface.
+func createOifnameAcceptRule(table *nftables.Table, chain *nftables.Chain, iface string) *nftables.Rule {
+	return &nftables.Rule{
+		Table: table,
+		Chain: chain,
+		Exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+			&expr.Cmp{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				Data:     []byte(iface + "\x00"),
+			},
+			&expr.Counter{},
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		},
+	}
+}
+
+// createDportDropRule drops the protocol's traffic to the destination port.
+func createDportDropRule(table *nftables.Table, chain *nftables.Chain, proto byte, port uint16) *nftables.Rule {
+	portBytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBytes, port)
+	return &nftables.Rule{
+		Table: table,
+		Chain: chain,
+		Exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				Data:     []byte{proto},
+			},
+			newLoadDportExpr(1),
+			&expr.Cmp{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				Data:     portBytes,
+			},
+			&expr.Counter{},
+			&expr.Verdict{Kind: expr.VerdictDrop},
+		},
+	}
+}
@@ -0,0 +1,140 @@
+//go:build linux && !android
+
+package osfirewall
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// domainSetName is the set of allowed domain addresses in each kill switch filter table
+const domainSetName = "wgtunnel-allow-domains"
+
+// domainAllowState holds the allowed domains' addresses with their expiry, installed while the kill switch is enabled.
+type domainAllowState struct {
+	domains map[string]domainAddrs
+}
+
+type domainAddrs struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+// AllowDomain replaces the domain's allowed addresses. The set elements time out in the kernel, so addresses a failed
+// refresh leaves behind are dropped after the TTL.
+func (f *LinuxFirewall) AllowDomain(domain string, addrs []netip.Addr, ttl time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.domainAllow.domains == nil {
+		f.domainAllow.domains = make(map[string]domainAddrs)
+	}
+	f.domainAllow.domains[domain] = domainAddrs{addrs: slices.Clone(addrs), expires: time.Now().Add(ttl)}
+	if !f.IsEnabled() {
+		return nil
+	}
+	return f.syncDomainSets()
+}
+
+func (f *LinuxFirewall) RemoveDomain(domain string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.domainAllow.domains[domain]; !ok {
+		return nil
+	}
+	delete(f.domainAllow.domains, domain)
+	if !f.IsEnabled() {
+		return nil
+	}
+	return f.syncDomainSets()
+}
+
+// addDomainAllowRules adds the domain sets and the rules accepting output to them, once the kill switch chains exist.
+func (f *LinuxFirewall) addDomainAllowRules() error {
+	for _, table := range f.getTables() {
+		if err := f.queueDomainAllow(table); err != nil {
+			return err
+		}
+	}
+	if err := f.conn.Flush(); err != nil {
+		return fmt.Errorf("flush after adding domain sets: %w", err)
+	}
+	return nil
+}
+
+// queueDomainAllow queues the table's domain set and the rule accepting output to it, the caller flushes it.
+func (f *LinuxFirewall) queueDomainAllow(table *nftable) error {
+	outputChain, err := getChainFromTable(f.conn, table.Filter, chainNameOutput)
+	if err != nil {
+		return fmt.Errorf("get output chain: %w", err)
+	}
+	v6 := table.Proto == nftables.TableFamilyIPv6
+	keyType := nftables.TypeIPAddr
+	if v6 {
+		keyType = nftables.TypeIP6Addr
+	}
+	set := &nftables.Set{Table: table.Filter, Name: domainSetName, KeyType: keyType, HasTimeout: true}
+	if err := f.conn.AddSet(set, f.domainElements(v6)); err != nil {
+		return fmt.Errorf("add domain set: %w", err)
+	}
+	f.conn.InsertRule(&nftables.Rule{
+		Table: table.Filter,
+		Chain: outputChain,
+		Exprs: []expr.Any{
+			newLoadAddrExpr(v6, false, 1),
+			&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+			&expr.Counter{},
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		},
+	})
+	return nil
+}
+
+// syncDomainSets refills the domain sets in one transaction.
+func (f *LinuxFirewall) syncDomainSets() error {
+	for _, table := range f.getTables() {
+		set, err := f.conn.GetSetByName(table.Filter, domainSetName)
+		if err != nil {
+			return fmt.Errorf("get domain set: %w", err)
+		}
+		f.conn.FlushSet(set)
+		if elems := f.domainElements(table.Proto == nftables.TableFamilyIPv6); len(elems) > 0 {
+			if err := f.conn.SetAddElements(set, elems); err != nil {
+				return fmt.Errorf("add domain addresses: %w", err)
+			}
+		}
+	}
+	if err := f.conn.Flush(); err != nil {
+		return fmt.Errorf("flush domain sets: %w", err)
+	}
+	return nil
+}
+
+// domainElements returns the family's unexpired addresses, timing out when their latest domain entry expires.
+func (f *LinuxFirewall) domainElements(v6 bool) []nftables.SetElement {
+	now := time.Now()
+	expires := make(map[netip.Addr]time.Time)
+	for _, d := range f.domainAllow.domains {
+		if !d.expires.After(now) {
+			continue
+		}
+		for _, addr := range d.addrs {
+			if addr.Unmap().Is6() == v6 && d.expires.After(expires[addr.Unmap()]) {
+				expires[addr.Unmap()] = d.expires
+			}
+		}
+	}
+
+	var elems []nftables.SetElement
+	for addr, exp := range expires {
+		// the kernel counts timeouts in milliseconds
+		elems = append(elems, nftables.SetElement{Key: addr.AsSlice(), Timeout: exp.Sub(now).Truncate(time.Millisecond)})
+	}
+	return elems
+}
@@ -0,0 +1,166 @@
+//go:build linux && !android
+
+package osfirewall
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/wgtunnel/desktop/tunnel/vpn/firewall"
+	"github.com/wgtunnel/desktop/tunnel/vpn/firewall/mark"
+	"golang.org/x/sys/unix"
+)
+
+const cgroup2Mount = "/sys/fs/cgroup"
+
+// SetExemptions replaces the exemptions, re-applying them if the kill switch is enabled.
+func (f *LinuxFirewall) SetExemptions(exemptions []firewall.Exemption) error {
+	for _, e := range exemptions {
+		if err := e.Validate(); err != nil {
+			return err
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.exemptions = slices.Clone(exemptions)
+	if !f.IsEnabled() {
+		return nil
+	}
+	f.removeExemptionRules()
+	return f.addExemptionRules()
+}
+
+func (f *LinuxFirewall) Exemptions() []firewall.Exemption {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.exemptions)
+}
+
+// addExemptionRules lets the exempted processes out ahead of the kill switch's drop, and the daemon's own
+// bootstrap marked traffic, so helpers it spawns can reach the network without a tunnel.
+func (f *LinuxFirewall) addExemptionRules() error {
+	daemon, daemonErr := daemonCgroup()
+	if daemonErr != nil {
+		f.logger.Verbosef("Not exempting the daemon's cgroup: %v", daemonErr)
+	}
+
+	var rules []*nftables.Rule
+	for _, table := range f.getTables() {
+		outputChain, err := getChainFromTable(f.conn, table.Filter, chainNameOutput)
+		if err != nil {
+			return fmt.Errorf("get output chain: %w", err)
+		}
+		for _, e := range f.exemptions {
+			match, err := exemptionExprs(e)
+			if err != nil {
+				f.logger.Errorf("Skipping kill switch exemption %+v: %v", e, err)
+				continue
+			}
+			rules = append(rules, createExemptionRule(table.Filter, outputChain, match))
+		}
+		if daemonErr == nil {
+			match, err := exemptionExprs(firewall.Exemption{Cgroup: daemon})
+			if err != nil {
+				f.logger.Verbosef("Not exempting the daemon's cgroup: %v", err)
+			} else {
+				rules = append(rules, createExemptionRule(table.Filter, outputChain, append(match, markExprs(mark.LinuxBootstrapMarkNum)...)))
+			}
+		}
+	}
+	for _, rule := range rules {
+		f.conn.InsertRule(rule)
+	}
+	if err := f.conn.Flush(); err != nil {
+		return fmt.Errorf("flush after adding exemptions: %w", err)
+	}
+	f.exemptRules = rules
+	return nil
+}
+
+func (f *LinuxFirewall) removeExemptionRules() {
+	for _, rule := range f.exemptRules {
+		if existing, _ := findRule(f.conn, rule); existing != nil {
+			f.conn.DelRule(existing)
+		}
+	}
+	f.exemptRules = nil
+	if err := f.conn.Flush(); err != nil {
+		f.logger.Errorf("Failed to remove exemptions: %v", err)
+	}
+}
+
+// exemptionExprs matches the socket's cgroup v2 by its id at the path's level, or the socket's UID.
+func exemptionExprs(e firewall.Exemption) ([]expr.Any, error) {
+	if e.UID != nil {
+		uid := make([]byte, 4)
+		binary.NativeEndian.PutUint32(uid, *e.UID)
+		return []expr.Any{
+			&expr.Meta{Key: expr.MetaKeySKUID, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: uid},
+		}, nil
+	}
+
+	path := e.CgroupPath()
+	var st unix.Stat_t
+	if err := unix.Stat(filepath.Join(cgroup2Mount, path), &st); err != nil {
+		return nil, fmt.Errorf("stat cgroup %s: %w", path, err)
+	}
+	id := make([]byte, 8)
+	binary.NativeEndian.PutUint64(id, st.Ino)
+	return []expr.Any{
+		&expr.Socket{Key: expr.SocketKeyCgroupv2, Level: uint32(strings.Count(path, "/") + 1), Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: id},
+	}, nil
+}
+
+// markExprs matches the packet mark under its mask.
+func markExprs(markVal uint32) []expr.Any {
+	maskBytes := make([]byte, 4)
+	binary.LittleEndian.PutUint32(maskBytes, mark.MaskFor(markVal))
+	markBytes := make([]byte, 4)
+	binary.LittleEndian.PutUint32(markBytes, markVal)
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: maskBytes, Xor: []byte{0x00, 0x00, 0x00, 0x00}},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: markBytes},
+	}
+}
+
+// createExemptionRule accepts output matching the exemption.
+func createExemptionRule(table *nftables.Table, chain *nftables.Chain, match []expr.Any) *nftables.Rule {
+	return &nftables.Rule{
+		Table: table,
+		Chain: chain,
+		Exprs: append(match, &expr.Counter{}, &expr.Verdict{Kind: expr.VerdictAccept}),
+	}
+}
+
+// daemonCgroup returns our own cgroup v2 path, failing in the root cgroup, which would exempt everything.
+func daemonCgroup() (string, error) {
+	file, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		path, ok := strings.CutPrefix(scanner.Text(), "0::")
+		if !ok {
+			continue
+		}
+		if path = strings.Trim(path, "/"); path == "" {
+			return "", fmt.Errorf("running in the root cgroup")
+		}
+		return path, nil
+	}
+	return "", fmt.Errorf("no cgroup v2 hierarchy")
+}
@@ -12,6 +12,7 @@ import (
 	"fmt"
 	"net/netip"
 	"reflect"
+	"sync"
 	"sync/atomic"
 
 	"github.com/amnezia-vpn/amneziawg-go/device"
@@ -36,6 +37,9 @@ const (
 )
 
 type LinuxFirewall struct {
+	// mu guards conn and the state below. A Flush sends every message queued on conn, so a batch is only built and
+	// flushed while holding it, and methods called with it held are unexported.
+	mu   sync.Mutex
 	conn *nftables.Conn
 	nft4 *nftable // IPv4 tables, never nil
 	nft6 *nftable // IPv6 tables or nil if no IPv6 support
@@ -49,7 +53,19 @@ type LinuxFirewall struct {
 	logger            *device.Logger
 
 	localAddrRules []*nftables.Rule            // For tracking AllowedLocalNetworks rules
+	localNets      []netip.Prefix              // The AllowedLocalNetworks prefixes, to re-apply them
 	tunnelRules    map[string][]*nftables.Rule // For tracking iface tunnel bypass rules
+	excludedRules  map[string][]*nftables.Rule // For tracking iface excluded route rules
+	pauseRules     []*nftables.Rule            // The PauseKillSwitch rules, nil unless paused
+	exemptRules    []*nftables.Rule            // For tracking the exemption rules
+	exemptions     []firewall.Exemption        // The exemptions, applied while the kill switch is enabled
+
+	blocklists  blocklistState
+	dnsLock     dnsLockState
+	v6Block     v6BlockState
+	share       shareState
+	inbound     inboundState
+	domainAllow domainAllowState
 }
 
 func (f *LinuxFirewall) IsPersistent() bool {
@@ -66,34 +82,66 @@ func New(logger *device.Logger) (firewall.Firewall, error) {
 		return nil, fmt.Errorf("nftables connection: %w", err)
 	}
 
-	nft4 := &nftable{Proto: nftables.TableFamilyIPv4}
-
 	supportsV6 := nettest.SupportsIPv6()
+	logger.Verbosef("nftables mode, v6 support: %v", supportsV6)
+	return newLinuxFirewall(conn, supportsV6, logger), nil
+}
 
+// newLinuxFirewall returns the firewall on the nftables conn, removing tables left by a previous run.
+func newLinuxFirewall(conn *nftables.Conn, supportsV6 bool, logger *device.Logger) *LinuxFirewall {
 	var nft6 *nftable
 	if supportsV6 {
 		nft6 = &nftable{Proto: nftables.TableFamilyIPv6}
 	}
-	logger.Verbosef("nftables mode, v6 support: %v", supportsV6)
 
 	f := &LinuxFirewall{
-		conn:        conn,
-		nft4:        nft4,
-		nft6:        nft6,
-		v6Available: supportsV6,
-		logger:      logger,
-		tunnelRules: make(map[string][]*nftables.Rule),
-	}
-	return f, nil
+		conn:          conn,
+		nft4:          &nftable{Proto: nftables.TableFamilyIPv4},
+		nft6:          nft6,
+		v6Available:   supportsV6,
+		logger:        logger,
+		tunnelRules:   make(map[string][]*nftables.Rule),
+		excludedRules: make(map[string][]*nftables.Rule),
+	}
+
+	// defensive cleanup, blocklists are only installed while tunnels are up
+	if err := f.removeBlocklistTables(); err != nil {
+		logger.Errorf("Failed to remove stale blocklists: %v", err)
+	}
+	if err := f.removeOwnedTables(dnsLockTable); err != nil {
+		logger.Errorf("Failed to remove stale DNS lock: %v", err)
+	}
+	if err := f.removeOwnedTables(v6BlockTable); err != nil {
+		logger.Errorf("Failed to remove stale IPv6 block: %v", err)
+	}
+	if err := f.removeOwnedTables(inboundTable); err != nil {
+		logger.Errorf("Failed to remove stale inbound policies: %v", err)
+	}
+	return f
+}
+
+// AddTunnelBypasses lets the tunnel interface and the tunnel's bypass and bootstrap marked traffic through the kill switch.
+func (f *LinuxFirewall) AddTunnelBypasses(iface string, bypassMark, bootstrapMark uint32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.addTunnelBypasses(iface, bypassMark, bootstrapMark, true)
 }
 
-func (f *LinuxFirewall) AddTunnelBypasses(iface string) error {
+// AddMarkBypasses replaces the tunnel's bypasses with its bypass and bootstrap marked traffic only, for a paused
+// tunnel whose device still sends keepalives and handshakes.
+func (f *LinuxFirewall) AddMarkBypasses(iface string, bypassMark, bootstrapMark uint32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.addTunnelBypasses(iface, bypassMark, bootstrapMark, false)
+}
+
+func (f *LinuxFirewall) addTunnelBypasses(iface string, bypassMark, bootstrapMark uint32, withIface bool) error {
 	if !f.IsEnabled() {
 		return errors.New("kill switch must be enabled to add tunnel bypasses")
 	}
 
 	// remove old rules
-	_ = f.RemoveTunnelBypasses(iface)
+	_ = f.removeTunnelBypasses(iface)
 
 	var newRules []*nftables.Rule
 
@@ -105,10 +153,17 @@ func (f *LinuxFirewall) AddTunnelBypasses(iface string) error {
 		}
 
 		// apply tunnel mark
-		bootstrapRule := createFwmarkRule(table.Filter, outputChain, mark.LinuxBootstrapMarkNum)
+		bootstrapRule := createFwmarkRule(table.Filter, outputChain, bootstrapMark)
 		f.conn.InsertRule(bootstrapRule)
 		newRules = append(newRules, bootstrapRule)
 
+		// the kill switch only lets our default bypass mark through, allow a custom tunnel FwMark as well
+		if bypassMark != mark.LinuxBypassMarkNum {
+			bypassRule := createFwmarkRule(table.Filter, outputChain, bypassMark)
+			f.conn.InsertRule(bypassRule)
+			newRules = append(newRules, bypassRule)
+		}
+
 		// allow input for DNS boostrap
 		stateRule := &nftables.Rule{
 			Table: table.Filter,
@@ -134,6 +189,10 @@ func (f *LinuxFirewall) AddTunnelBypasses(iface string) error {
 		f.conn.InsertRule(stateRule)
 		newRules = append(newRules, stateRule)
 
+		if !withIface {
+			continue
+		}
+
 		// add tunnel interface bypass rule
 		tunnelBypassRule := &nftables.Rule{
 			Table: table.Filter,
@@ -172,7 +231,56 @@ func (f *LinuxFirewall) AddTunnelBypasses(iface string) error {
 	return nil
 }
 
+// AllowExcludedRoutes lets traffic to the tunnel's excluded routes through the kill switch, replacing any
+// previously allowed for the iface.
+func (f *LinuxFirewall) AllowExcludedRoutes(iface string, prefixes []netip.Prefix) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.IsEnabled() {
+		return errors.New("kill switch must be enabled to allow excluded routes")
+	}
+
+	f.delRules(f.excludedRules[iface])
+	delete(f.excludedRules, iface)
+
+	var newRules []*nftables.Rule
+	for _, prefix := range prefixes {
+		table, err := f.getNFTByAddr(prefix.Addr())
+		if err != nil {
+			f.logger.Verbosef("Skipping excluded route %v: %v", prefix, err)
+			continue
+		}
+		outputChain, err := getChainFromTable(f.conn, table.Filter, chainNameOutput)
+		if err != nil {
+			return fmt.Errorf("get output chain: %w", err)
+		}
+		rule, err := createRangeRule(table.Filter, outputChain, prefix.Masked(), expr.VerdictAccept)
+		if err != nil {
+			return fmt.Errorf("create excluded route rule for %v: %w", prefix, err)
+		}
+		f.conn.InsertRule(rule)
+		newRules = append(newRules, rule)
+	}
+
+	if err := f.conn.Flush(); err != nil {
+		return fmt.Errorf("flush after allowing excluded routes: %w", err)
+	}
+
+	if len(newRules) > 0 {
+		f.excludedRules[iface] = newRules
+		f.logger.Verbosef("Allowed excluded routes for iface %s: %v", iface, prefixes)
+	}
+	return nil
+}
+
 func (f *LinuxFirewall) RemoveTunnelBypasses(iface string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.removeTunnelBypasses(iface)
+}
+
+func (f *LinuxFirewall) removeTunnelBypasses(iface string) error {
 	if !f.IsEnabled() {
 		f.logger.Verbosef("Firewall is not enabled, skipping")
 		return nil
@@ -182,22 +290,26 @@ func (f *LinuxFirewall) RemoveTunnelBypasses(iface string) error {
 	if !ok {
 		return nil
 	}
-
-	for _, rule := range rules {
-		f.conn.DelRule(rule)
-	}
+	f.delRules(append(rules, f.excludedRules[iface]...))
 
 	if err := f.conn.Flush(); err != nil {
 		return fmt.Errorf("flush after removing tunnel bypasses: %w", err)
 	}
 
 	delete(f.tunnelRules, iface)
+	delete(f.excludedRules, iface)
 
 	f.logger.Verbosef("Removed tunnel bypasses for iface %s", iface)
 	return nil
 }
 
 func (f *LinuxFirewall) Disable() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.disable()
+}
+
+func (f *LinuxFirewall) disable() error {
 	if !f.IsEnabled() {
 		f.logger.Verbosef("Firewall is not enabled, skipping")
 		return nil
@@ -233,21 +345,33 @@ func (f *LinuxFirewall) Disable() error {
 	}
 
 	f.localAddrRules = nil
+	f.pauseRules = nil
+	f.exemptRules = nil
 	f.tunnelRules = make(map[string][]*nftables.Rule)
+	f.excludedRules = make(map[string][]*nftables.Rule)
 
 	f.killSwitchEnabled.Store(false)
 
+	// sharing outlives the kill switch, its rules went with the tables
+	f.reapplySharing()
+
 	f.logger.Verbosef("Firewall cleaned up and kill switch disabled")
 	return nil
 }
 
 func (f *LinuxFirewall) AllowLocalNetworks(prefixes []netip.Prefix) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.allowLocalNetworks(prefixes)
+}
+
+func (f *LinuxFirewall) allowLocalNetworks(prefixes []netip.Prefix) error {
 	if !f.IsEnabled() {
 		return errors.New("kill switch must be enabled to allow local networks")
 	}
 
-	// remove any old rules
-	f.RemoveLocalNetworks()
+	// remove any old rules, in the same transaction
+	f.removeLocalNetworks()
 
 	// add bypass rules for each prefix
 	for _, table := range f.getTables() {
@@ -291,20 +415,32 @@ func (f *LinuxFirewall) AllowLocalNetworks(prefixes []netip.Prefix) error {
 		return fmt.Errorf("flush after bypassing local addrs: %w", err)
 	}
 
+	f.localNets = prefixes
 	f.logger.Verbosef("Bypassed local addrs: %v", prefixes)
 	return nil
 }
 
 func (f *LinuxFirewall) RemoveLocalNetworks() error {
-	for _, rule := range f.localAddrRules {
-		f.conn.DelRule(rule)
-	}
-	f.localAddrRules = nil
+	f.mu.Lock()
+	defer f.mu.Unlock()
 
+	f.removeLocalNetworks()
+	if err := f.conn.Flush(); err != nil {
+		return fmt.Errorf("flush after removing local addrs: %w", err)
+	}
 	return nil
 }
 
+// removeLocalNetworks queues the deletion of the local network rules, the caller flushes it.
+func (f *LinuxFirewall) removeLocalNetworks() {
+	f.delRules(f.localAddrRules)
+	f.localAddrRules = nil
+	f.localNets = nil
+}
+
 func (f *LinuxFirewall) IsAllowLocalNetworksEnabled() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	return f.localAddrRules != nil
 }
 
@@ -344,6 +480,9 @@ func (e errorChainNotFound) Is(target error) bool {
 
 // SetTunnelPort adds punch rules for inbound UDP on the port.
 func (f *LinuxFirewall) SetTunnelPort(port uint16) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
 	for _, table := range f.getTables() {
 		inputChain, err := getChainFromTable(f.conn, table.Filter, chainNameInput)
 		if err != nil {
@@ -559,32 +698,80 @@ func findRule(conn *nftables.Conn, rule *nftables.Rule) (*nftables.Rule, error)
 		return nil, fmt.Errorf("get rules: %w", err)
 	}
 	for _, r := range rules {
-		if len(r.Exprs) != len(rule.Exprs) {
+		if rulesEqual(r, rule) {
+			return r, nil
+		}
+	}
+	return nil, nil
+}
+
+// rulesEqual reports whether the live rule has the rule's expressions, ignoring counters.
+func rulesEqual(live, rule *nftables.Rule) bool {
+	if len(live.Exprs) != len(rule.Exprs) {
+		return false
+	}
+	for i, e := range live.Exprs {
+		if _, ok := e.(*expr.Counter); ok {
+			continue // Skip counters
+		}
+		if !reflect.DeepEqual(e, rule.Exprs[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// delRules queues the deletion of rules the firewall added, the caller flushes it. Added rules carry no kernel
+// handle, so each is matched against the live rules, deleting one live copy per rule as tunnels add identical ones.
+func (f *LinuxFirewall) delRules(rules []*nftables.Rule) {
+	queued := make(map[uint64]bool)
+	for _, rule := range rules {
+		live, err := f.conn.GetRules(rule.Table, rule.Chain)
+		if err != nil {
 			continue
 		}
-		match := true
-		for i, e := range r.Exprs {
-			if _, ok := e.(*expr.Counter); ok {
-				continue // Skip counters
-			}
-			if !reflect.DeepEqual(e, rule.Exprs[i]) {
-				match = false
+		for _, r := range live {
+			if !queued[r.Handle] && rulesEqual(r, rule) {
+				queued[r.Handle] = true
+				f.conn.DelRule(r)
 				break
 			}
 		}
-		if match {
-			return r, nil
-		}
 	}
-	return nil, nil
 }
 
 func (f *LinuxFirewall) Enable() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.enable()
+}
+
+func (f *LinuxFirewall) enable() error {
 	if f.IsEnabled() {
 		f.logger.Verbosef("Kill switch already active, skipping activation")
 		return nil
 	}
 
+	if err := f.createChains(); err != nil {
+		return err
+	}
+
+	if err := f.addKillSwitchRules(); err != nil {
+		return fmt.Errorf("add kill switch rules: %w", err)
+	}
+	if err := f.addExemptionRules(); err != nil {
+		f.logger.Errorf("Failed to add kill switch exemptions: %v", err)
+	}
+	if err := f.addDomainAllowRules(); err != nil {
+		f.logger.Errorf("Failed to add allowed domains: %v", err)
+	}
+
+	f.killSwitchEnabled.Store(true)
+	return nil
+}
+
+// createChains creates our tables and chains and hooks them into the base chains, keeping any that exist.
+func (f *LinuxFirewall) createChains() error {
 	polAccept := nftables.ChainPolicyAccept
 	for _, table := range f.getTables() {
 		// Create filter table
@@ -640,12 +827,6 @@ func (f *LinuxFirewall) Enable() error {
 	if err := f.addHooks(); err != nil {
 		return fmt.Errorf("add hooks: %w", err)
 	}
-
-	if err := f.addKillSwitchRules(); err != nil {
-		return fmt.Errorf("add kill switch rules: %w", err)
-	}
-
-	f.killSwitchEnabled.Store(true)
 	return nil
 }
 
@@ -704,9 +885,12 @@ func createHookRule(table *nftables.Table, fromChain *nftables.Chain, toChainNam
 	}
 }
 
-// addHookRule inserts a jump rule at the top.
+// addHookRule inserts a jump rule at the top, unless it exists.
 func addHookRule(conn *nftables.Conn, table *nftables.Table, fromChain *nftables.Chain, toChainName string) error {
 	rule := createHookRule(table, fromChain, toChainName)
+	if existing, _ := findRule(conn, rule); existing != nil {
+		return nil
+	}
 	conn.InsertRule(rule)
 	return conn.Flush()
 }
@@ -798,7 +982,13 @@ func (f *LinuxFirewall) addTunnelInterfaceRule(iface string, table *nftables.Tab
 }
 
 func (f *LinuxFirewall) addLoopbackRule(table *nftables.Table, chain *nftables.Chain) error {
-	loRule := &nftables.Rule{
+	f.conn.InsertRule(createLoopbackRule(table, chain))
+	return nil
+}
+
+// createLoopbackRule creates an ACCEPT for the loopback interface.
+func createLoopbackRule(table *nftables.Table, chain *nftables.Chain) *nftables.Rule {
+	return &nftables.Rule{
 		Table: table,
 		Chain: chain,
 		Exprs: []expr.Any{
@@ -816,8 +1006,6 @@ func (f *LinuxFirewall) addLoopbackRule(table *nftables.Table, chain *nftables.C
 			&expr.Verdict{Kind: expr.VerdictAccept},
 		},
 	}
-	f.conn.InsertRule(loRule)
-	return nil
 }
 
 // Helper to determine if we should look at Input or Output interface
@@ -829,7 +1017,13 @@ func getIfKeyForChain(chain *nftables.Chain) expr.MetaKey {
 }
 
 func (f *LinuxFirewall) addEstablishedRule(table *nftables.Table, chain *nftables.Chain) error {
-	rule := &nftables.Rule{
+	f.conn.InsertRule(createEstablishedRule(table, chain))
+	return nil
+}
+
+// createEstablishedRule creates an ACCEPT for established and related connections.
+func createEstablishedRule(table *nftables.Table, chain *nftables.Chain) *nftables.Rule {
+	return &nftables.Rule{
 		Table: table,
 		Chain: chain,
 		Exprs: []expr.Any{
@@ -855,9 +1049,6 @@ func (f *LinuxFirewall) addEstablishedRule(table *nftables.Table, chain *nftable
 			&expr.Verdict{Kind: expr.VerdictAccept},
 		},
 	}
-
-	f.conn.InsertRule(rule)
-	return nil
 }
 
 // delKillSwitchRules removes kill switch by flushing chains
@@ -989,7 +1180,7 @@ func newLoadDaddrExpr(proto nftables.TableFamily, destReg uint32) (expr.Any, err
 // createFwmarkRule generates a rule for a specific mark within our mask
 func createFwmarkRule(table *nftables.Table, chain *nftables.Chain, markVal uint32) *nftables.Rule {
 	maskBytes := make([]byte, 4)
-	binary.LittleEndian.PutUint32(maskBytes, mark.LinuxFwmarkMaskNum)
+	binary.LittleEndian.PutUint32(maskBytes, mark.MaskFor(markVal))
 
 	markBytes := make([]byte, 4)
 	binary.LittleEndian.PutUint32(markBytes, markVal)
@@ -0,0 +1,516 @@
+//go:build linux && !android
+
+package osfirewall
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// fakeNftObject is a table, chain or rule as it was sent, keyed by its family, table and chain.
+type fakeNftObject struct {
+	family byte
+	table  string
+	chain  string
+	handle uint64
+	// attrs are the attributes of the message that added it
+	attrs []byte
+}
+
+// fakeNftables is a ruleset behind a test netlink conn. It applies the batches sent to it and answers the table,
+// chain and rule dumps from them, so the firewall's lookups and live rule matching see its own changes. Sets and
+// other objects are accepted and ignored.
+type fakeNftables struct {
+	mu     sync.Mutex
+	tables []fakeNftObject
+	chains []fakeNftObject
+	// rules are in chain order, the rules of a chain being ordered as in the kernel
+	rules      []fakeNftObject
+	lastHandle uint64
+}
+
+func (k *fakeNftables) conn(t *testing.T) *nftables.Conn {
+	conn, err := nftables.New(nftables.WithTestDial(k.answer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func (k *fakeNftables) answer(req []netlink.Message) ([]netlink.Message, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var replies []netlink.Message
+	for _, msg := range req {
+		msgType := msg.Header.Type & 0xff
+		if msg.Header.Type>>8 != unix.NFNL_SUBSYS_NFTABLES || msgType > unix.NFT_MSG_DELRULE {
+			continue // batch begin and end, sets
+		}
+		obj := fakeNftObject{family: msg.Data[0], attrs: msg.Data[4:]}
+		ad, err := netlink.NewAttributeDecoder(obj.attrs)
+		if err != nil {
+			return nil, err
+		}
+		ad.ByteOrder = binary.BigEndian
+		for ad.Next() {
+			// the table is attribute 1 of tables, chains and rules
+			switch {
+			case ad.Type() == unix.NFTA_TABLE_NAME:
+				obj.table = ad.String()
+			case msgType >= unix.NFT_MSG_NEWRULE && ad.Type() == unix.NFTA_RULE_CHAIN:
+				obj.chain = ad.String()
+			case msgType >= unix.NFT_MSG_NEWRULE && ad.Type() == unix.NFTA_RULE_HANDLE:
+				obj.handle = ad.Uint64()
+			case msgType >= unix.NFT_MSG_NEWCHAIN && ad.Type() == unix.NFTA_CHAIN_NAME:
+				obj.chain = ad.String()
+			}
+		}
+		if err := ad.Err(); err != nil {
+			return nil, err
+		}
+
+		inTable := obj.in(func(fakeNftObject) bool { return true })
+		switch msgType {
+		case unix.NFT_MSG_NEWTABLE:
+			if !slices.ContainsFunc(k.tables, inTable) {
+				k.tables = append(k.tables, obj)
+			}
+		case unix.NFT_MSG_DELTABLE:
+			k.tables = slices.DeleteFunc(k.tables, inTable)
+			k.chains = slices.DeleteFunc(k.chains, inTable)
+			k.rules = slices.DeleteFunc(k.rules, inTable)
+		case unix.NFT_MSG_NEWCHAIN:
+			if !slices.ContainsFunc(k.chains, obj.in(obj.sameChain)) {
+				k.chains = append(k.chains, obj)
+			}
+		case unix.NFT_MSG_DELCHAIN:
+			k.chains = slices.DeleteFunc(k.chains, obj.in(obj.sameChain))
+		case unix.NFT_MSG_NEWRULE:
+			k.lastHandle++
+			obj.handle = k.lastHandle
+			first := slices.IndexFunc(k.rules, obj.in(obj.sameChain))
+			if msg.Header.Flags&unix.NLM_F_APPEND != 0 || first < 0 {
+				k.rules = append(k.rules, obj)
+			} else {
+				k.rules = slices.Insert(k.rules, first, obj)
+			}
+		case unix.NFT_MSG_DELRULE:
+			// without a handle, the chain is flushed
+			k.rules = slices.DeleteFunc(k.rules, obj.in(func(o fakeNftObject) bool {
+				return obj.sameChain(o) && (obj.handle == 0 || o.handle == obj.handle)
+			}))
+		case unix.NFT_MSG_GETTABLE:
+			replies = append(replies, k.dump(msg, unix.NFT_MSG_NEWTABLE, k.tables, nil)...)
+		case unix.NFT_MSG_GETCHAIN:
+			replies = append(replies, k.dump(msg, unix.NFT_MSG_NEWCHAIN, k.chains, nil)...)
+		case unix.NFT_MSG_GETRULE:
+			replies = append(replies, k.dump(msg, unix.NFT_MSG_NEWRULE, k.rules, obj.in(obj.sameChain))...)
+		}
+	}
+	return replies, nil
+}
+
+// in returns a match of objects in obj's family and table which also match.
+func (obj fakeNftObject) in(match func(o fakeNftObject) bool) func(o fakeNftObject) bool {
+	return func(o fakeNftObject) bool {
+		return (obj.family == unix.NFPROTO_UNSPEC || o.family == obj.family) && o.table == obj.table && match(o)
+	}
+}
+
+func (obj fakeNftObject) sameChain(o fakeNftObject) bool {
+	return o.chain == obj.chain
+}
+
+// dump answers a dump request with the objects of the requested family matching match, nil matching all of them.
+func (k *fakeNftables) dump(req netlink.Message, msgType uint16, objs []fakeNftObject, match func(o fakeNftObject) bool) []netlink.Message {
+	var replies []netlink.Message
+	for _, o := range objs {
+		if req.Data[0] != unix.NFPROTO_UNSPEC && o.family != req.Data[0] || match != nil && !match(o) {
+			continue
+		}
+		data := append([]byte{o.family, unix.NFNETLINK_V0, 0, 0}, o.attrs...)
+		if msgType == unix.NFT_MSG_NEWRULE {
+			handle, _ := netlink.MarshalAttributes([]netlink.Attribute{
+				{Type: unix.NFTA_RULE_HANDLE, Data: binary.BigEndian.AppendUint64(nil, o.handle)},
+			})
+			data = append(data, handle...)
+		}
+		replies = append(replies, k.reply(req, netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8|msgType), data))
+	}
+	// a dump ends with a done message
+	replies = append(replies, k.reply(req, netlink.Done, nil))
+	for i := range replies {
+		replies[i].Header.Flags |= netlink.Multi
+	}
+	return replies
+}
+
+func (k *fakeNftables) reply(req netlink.Message, t netlink.HeaderType, data []byte) netlink.Message {
+	return netlink.Message{
+		Header: netlink.Header{Type: t, Sequence: req.Header.Sequence, PID: req.Header.PID},
+		Data:   data,
+	}
+}
+
+// ruleLines formats the rules of our filter chains as "ipv chain args" in iptables syntax, in chain order.
+func (k *fakeNftables) ruleLines(t *testing.T) []string {
+	conn := k.conn(t)
+	var lines []string
+	for _, family := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+		table := &nftables.Table{Family: family, Name: "filter"}
+		for _, chain := range []string{chainNameInput, chainNameOutput, chainNameForward} {
+			rules, err := conn.GetRules(table, &nftables.Chain{Table: table, Name: chain})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ipv := "ipv4"
+			if family == nftables.TableFamilyIPv6 {
+				ipv = "ipv6"
+			}
+			for _, rule := range rules {
+				lines = append(lines, fmt.Sprintf("%s %s %s", ipv, chain, strings.Join(iptablesArgs(rule.Exprs), " ")))
+			}
+		}
+	}
+	return lines
+}
+
+// iptablesArgs translates the expressions our rules are built from into iptables arguments.
+func iptablesArgs(exprs []expr.Any) []string {
+	var args []string
+	cmpData := func(i int) []byte {
+		if i < len(exprs) {
+			if cmp, ok := exprs[i].(*expr.Cmp); ok {
+				return cmp.Data
+			}
+		}
+		return nil
+	}
+	bitwiseMask := func(i int) []byte {
+		if i < len(exprs) {
+			if bw, ok := exprs[i].(*expr.Bitwise); ok {
+				return bw.Mask
+			}
+		}
+		return nil
+	}
+
+	for i := 0; i < len(exprs); i++ {
+		switch e := exprs[i].(type) {
+		case *expr.Meta:
+			switch e.Key {
+			case expr.MetaKeyIIFNAME:
+				args = append(args, "-i", strings.TrimRight(string(cmpData(i+1)), "\x00"))
+				i++
+			case expr.MetaKeyOIFNAME:
+				args = append(args, "-o", strings.TrimRight(string(cmpData(i+1)), "\x00"))
+				i++
+			case expr.MetaKeyMARK:
+				mask, value := bitwiseMask(i+1), cmpData(i+2)
+				if len(mask) != 4 || len(value) != 4 {
+					return append(args, "?mark")
+				}
+				args = append(args, "-m", "mark", "--mark",
+					fmt.Sprintf("%#x/%#x", binary.LittleEndian.Uint32(value), binary.LittleEndian.Uint32(mask)))
+				i += 2
+			case expr.MetaKeyL4PROTO:
+				proto := map[string]string{"\x11": "udp", "\x06": "tcp"}
+				args = append(args, "-p", proto[string(cmpData(i+1))])
+				i++
+			case expr.MetaKeySKUID:
+				args = append(args, "-m", "owner", "--uid-owner", fmt.Sprint(binary.NativeEndian.Uint32(cmpData(i+1))))
+				i++
+			default:
+				args = append(args, fmt.Sprintf("?meta%d", e.Key))
+			}
+		case *expr.Payload:
+			if e.Base == expr.PayloadBaseTransportHeader {
+				args = append(args, "--dport", fmt.Sprint(binary.BigEndian.Uint16(cmpData(i+1))))
+				i++
+				continue
+			}
+			if i+1 < len(exprs) {
+				if _, ok := exprs[i+1].(*expr.Lookup); ok {
+					continue // the address is matched against the set
+				}
+			}
+			mask, addr := bitwiseMask(i+1), cmpData(i+2)
+			prefixLen := 0
+			for _, b := range mask {
+				prefixLen += bits.OnesCount8(b)
+			}
+			ip, _ := netip.AddrFromSlice(addr)
+			args = append(args, "-d", netip.PrefixFrom(ip, prefixLen).String())
+			i += 2
+		case *expr.Ct:
+			// the established rules are the only conntrack match
+			args = append(args, "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED")
+			i += 2
+		case *expr.Socket:
+			args = append(args, "-m", "cgroup", "--path")
+			i++
+		case *expr.Lookup:
+			args = append(args, "-m", "set", "--match-set", e.SetName, "dst")
+		case *expr.Counter:
+		case *expr.Verdict:
+			switch e.Kind {
+			case expr.VerdictAccept:
+				args = append(args, "-j", "ACCEPT")
+			case expr.VerdictDrop:
+				args = append(args, "-j", "DROP")
+			default:
+				args = append(args, "-j", e.Chain)
+			}
+		default:
+			args = append(args, fmt.Sprintf("?%T", e))
+		}
+	}
+	return args
+}
+
+func TestDelRulesMatchesLiveRules(t *testing.T) {
+	kernel := &fakeNftables{}
+	f := newLinuxFirewall(kernel.conn(t), false, device.NewLogger(device.LogLevelSilent, ""))
+	if err := f.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	chain, err := getChainFromTable(f.conn, f.nft4.Filter, chainNameOutput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// two tunnels sharing a mark add identical rules
+	for range 2 {
+		f.conn.InsertRule(createFwmarkRule(f.nft4.Filter, chain, 0xca6c))
+	}
+	if err := f.conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	markLine := "ipv4 wgtunnel-output -m mark --mark 0xca6c/0xffffffff -j ACCEPT"
+	count := func() int {
+		n := 0
+		for _, line := range kernel.ruleLines(t) {
+			if line == markLine {
+				n++
+			}
+		}
+		return n
+	}
+
+	// the stored rule has no handle, one live copy goes per stored rule
+	f.delRules([]*nftables.Rule{createFwmarkRule(f.nft4.Filter, chain, 0xca6c)})
+	if err := f.conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 1 {
+		t.Fatalf("%d mark rules left, want 1", n)
+	}
+
+	f.delRules([]*nftables.Rule{createFwmarkRule(f.nft4.Filter, chain, 0xca6c)})
+	if err := f.conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 0 {
+		t.Fatalf("%d mark rules left, want 0", n)
+	}
+}
+
+// killSwitchBackend is the part of the kill switch the rule-semantics cases drive, which every backend implements.
+type killSwitchBackend interface {
+	Enable() error
+	AddTunnelBypasses(iface string, bypassMark, bootstrapMark uint32) error
+	AddMarkBypasses(iface string, bypassMark, bootstrapMark uint32) error
+	AllowExcludedRoutes(iface string, prefixes []netip.Prefix) error
+	RemoveTunnelBypasses(iface string) error
+}
+
+// acceptedLines checks that no rule follows a chain's drop and returns the distinct rules sorted, without the
+// daemon's exemption, which depends on the test's cgroup, and the lookup of the empty domain set.
+func acceptedLines(t *testing.T, lines []string) []string {
+	t.Helper()
+	dropped := make(map[string]bool)
+	var out []string
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		chain := fields[0] + " " + fields[1]
+		if dropped[chain] {
+			t.Errorf("%q follows the drop", line)
+		}
+		dropped[chain] = strings.HasSuffix(line, "-j DROP")
+		if strings.Contains(line, "--path") || strings.Contains(line, "--match-set "+domainSetName) {
+			continue
+		}
+		out = append(out, line)
+	}
+	slices.Sort(out)
+	return slices.Compact(out)
+}
+
+// TestKillSwitchSemantics runs the same kill switch changes against the nftables firewall and the rule set of the
+// iptables and firewalld backends, expecting the same rules from both.
+func TestKillSwitchSemantics(t *testing.T) {
+	killSwitch := []string{
+		"ipv4 wgtunnel-input -i lo -j ACCEPT",
+		"ipv4 wgtunnel-input -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT",
+		"ipv4 wgtunnel-input -j DROP",
+		"ipv4 wgtunnel-output -o lo -j ACCEPT",
+		"ipv4 wgtunnel-output -m mark --mark 0x100000/0xff0000 -j ACCEPT",
+		"ipv4 wgtunnel-output -j DROP",
+		"ipv4 wgtunnel-forward -j DROP",
+	}
+	wg0 := "ipv4 wgtunnel-output -o wg0 -j ACCEPT"
+	wg1 := "ipv4 wgtunnel-output -o wg1 -j ACCEPT"
+	bootstrapMark := "ipv4 wgtunnel-output -m mark --mark 0x200000/0xff0000 -j ACCEPT"
+	bypassMark := "ipv4 wgtunnel-output -m mark --mark 0xca6c/0xffffffff -j ACCEPT"
+	excluded := "ipv4 wgtunnel-output -d 203.0.113.0/24 -j ACCEPT"
+	prefixes := []netip.Prefix{netip.MustParsePrefix("203.0.113.7/24"), netip.MustParsePrefix("fd00::/8")}
+
+	tests := []struct {
+		name  string
+		steps func(f killSwitchBackend) error
+		want  []string
+	}{
+		{
+			name:  "enable",
+			steps: func(killSwitchBackend) error { return nil },
+			want:  killSwitch,
+		},
+		{
+			name: "bypass per mark and iface",
+			steps: func(f killSwitchBackend) error {
+				return f.AddTunnelBypasses("wg0", 0xca6c, 0x200000)
+			},
+			want: slices.Concat(killSwitch, []string{wg0, bootstrapMark, bypassMark}),
+		},
+		{
+			name: "default bypass mark",
+			steps: func(f killSwitchBackend) error {
+				return f.AddTunnelBypasses("wg0", 0x100000, 0x200000)
+			},
+			want: slices.Concat(killSwitch, []string{wg0, bootstrapMark}),
+		},
+		{
+			name: "marks only",
+			steps: func(f killSwitchBackend) error {
+				return errors.Join(
+					f.AddTunnelBypasses("wg0", 0xca6c, 0x200000),
+					f.AllowExcludedRoutes("wg0", prefixes),
+					f.AddMarkBypasses("wg0", 0xca6c, 0x200000),
+				)
+			},
+			want: slices.Concat(killSwitch, []string{bootstrapMark, bypassMark}),
+		},
+		{
+			name: "marks only then resumed",
+			steps: func(f killSwitchBackend) error {
+				return errors.Join(
+					f.AddMarkBypasses("wg0", 0xca6c, 0x200000),
+					f.AddTunnelBypasses("wg0", 0xca6c, 0x200000),
+				)
+			},
+			want: slices.Concat(killSwitch, []string{wg0, bootstrapMark, bypassMark}),
+		},
+		{
+			name: "excluded prefixes",
+			steps: func(f killSwitchBackend) error {
+				return errors.Join(
+					f.AddTunnelBypasses("wg0", 0x100000, 0x200000),
+					f.AllowExcludedRoutes("wg0", prefixes),
+				)
+			},
+			want: slices.Concat(killSwitch, []string{wg0, bootstrapMark, excluded}),
+		},
+		{
+			name: "excluded prefixes replaced",
+			steps: func(f killSwitchBackend) error {
+				return errors.Join(
+					f.AddTunnelBypasses("wg0", 0x100000, 0x200000),
+					f.AllowExcludedRoutes("wg0", []netip.Prefix{netip.MustParsePrefix("198.51.100.0/24")}),
+					f.AllowExcludedRoutes("wg0", prefixes),
+				)
+			},
+			want: slices.Concat(killSwitch, []string{wg0, bootstrapMark, excluded}),
+		},
+		{
+			name: "remove one tunnel while another stays up",
+			steps: func(f killSwitchBackend) error {
+				return errors.Join(
+					f.AddTunnelBypasses("wg0", 0xca6c, 0x200000),
+					f.AllowExcludedRoutes("wg0", prefixes),
+					f.AddTunnelBypasses("wg1", 0xca6c, 0x200000),
+					f.RemoveTunnelBypasses("wg0"),
+				)
+			},
+			want: slices.Concat(killSwitch, []string{wg1, bootstrapMark, bypassMark}),
+		},
+		{
+			name: "remove the last tunnel",
+			steps: func(f killSwitchBackend) error {
+				return errors.Join(
+					f.AddTunnelBypasses("wg0", 0xca6c, 0x200000),
+					f.AllowExcludedRoutes("wg0", prefixes),
+					f.RemoveTunnelBypasses("wg0"),
+				)
+			},
+			want: killSwitch,
+		},
+	}
+
+	logger := device.NewLogger(device.LogLevelSilent, "")
+	backends := []struct {
+		name string
+		new  func(t *testing.T) (killSwitchBackend, func() []string)
+	}{
+		{
+			name: "nftables",
+			new: func(t *testing.T) (killSwitchBackend, func() []string) {
+				kernel := &fakeNftables{}
+				return newLinuxFirewall(kernel.conn(t), false, logger), func() []string { return kernel.ruleLines(t) }
+			},
+		},
+		{
+			name: "rule set",
+			new: func(*testing.T) (killSwitchBackend, func() []string) {
+				applier := &fakeApplier{}
+				return newRuleSetFirewall(logger, false, applier), func() []string {
+					var lines []string
+					for _, r := range applier.rules {
+						lines = append(lines, fmt.Sprintf("%s %s %s", r.ipv, r.chain, strings.Join(r.args, " ")))
+					}
+					return lines
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		for _, backend := range backends {
+			t.Run(tt.name+"/"+backend.name, func(t *testing.T) {
+				f, lines := backend.new(t)
+				if err := f.Enable(); err != nil {
+					t.Fatal(err)
+				}
+				if err := tt.steps(f); err != nil {
+					t.Fatal(err)
+				}
+				want := slices.Clone(tt.want)
+				slices.Sort(want)
+				if got := acceptedLines(t, lines()); !slices.Equal(got, want) {
+					t.Errorf("rules =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+				}
+			})
+		}
+	}
+}
@@ -39,6 +39,7 @@ type WindowsFirewall struct {
 
 	tunRules        []*wf.Rule
 	localAddrRules  []*wf.Rule
+	pauseRules      []*wf.Rule
 	permittedRoutes map[netip.Prefix][]*wf.Rule
 }
 
@@ -384,6 +385,8 @@ func (f *WindowsFirewall) Disable() error {
 		f.session = nil
 	}
 
+	// the pause rules went with the session
+	f.pauseRules = nil
 	f.killSwitchEnabled.Store(false)
 	f.logger.Verbosef("Firewall fully disabled and session closed")
 	return nil
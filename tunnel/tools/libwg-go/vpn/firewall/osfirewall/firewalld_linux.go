@@ -0,0 +1,283 @@
+//go:build linux && !android
+
+package osfirewall
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+	"github.com/godbus/dbus/v5"
+	"github.com/wgtunnel/desktop/tunnel/vpn/firewall"
+)
+
+const (
+	firewalldDest   = "org.fedoraproject.FirewallD1"
+	firewalldPath   = "/org/fedoraproject/FirewallD1"
+	firewalldDirect = firewalldDest + ".direct"
+	firewalldTable  = "filter"
+)
+
+// nftFeatures puts the nftables features one level deeper, so the rule set's kill switch methods shadow
+// LinuxFirewall's.
+type nftFeatures struct {
+	*LinuxFirewall
+}
+
+// FirewalldFirewall is the kill switch and IPv6 block as firewalld direct rules, for systems where firewalld owns the
+// ruleset and undoes our nftables changes on every reload. The runtime rules are re-added after each reload.
+// Features firewalld leaves alone stay in our nftables tables.
+type FirewalldFirewall struct {
+	*ruleSetFirewall
+	nftFeatures
+}
+
+// firewalldApplier installs the rule set as firewalld runtime direct rules.
+type firewalldApplier struct {
+	// direct calls a method of firewalld's direct interface
+	direct func(method string, args ...any) *dbus.Call
+}
+
+func newFirewalldApplier(bus *dbus.Conn) *firewalldApplier {
+	obj := bus.Object(firewalldDest, firewalldPath)
+	return &firewalldApplier{
+		direct: func(method string, args ...any) *dbus.Call {
+			return obj.Call(firewalldDirect+"."+method, 0, args...)
+		},
+	}
+}
+
+// firewalldRule is a direct rule of a chain, as getRules returns it.
+type firewalldRule struct {
+	Priority int32
+	Args     []string
+}
+
+func (r firewalldRule) equal(o firewalldRule) bool {
+	return r.Priority == o.Priority && slices.Equal(r.Args, o.Args)
+}
+
+// FirewalldRunning reports whether firewalld is on the system bus.
+func FirewalldRunning() bool {
+	bus, err := dialSystemBus()
+	if err != nil {
+		return false
+	}
+	defer bus.Close()
+	var running bool
+	err = bus.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, firewalldDest).Store(&running)
+	return err == nil && running
+}
+
+// NewFirewalld returns the firewalld backed firewall, removing direct rules left by a previous run.
+func NewFirewalld(logger *device.Logger) (firewall.Firewall, error) {
+	fw, err := New(logger)
+	if err != nil {
+		return nil, err
+	}
+	nft := fw.(*LinuxFirewall)
+	bus, err := dialSystemBus()
+	if err != nil {
+		return nil, err
+	}
+
+	applier := newFirewalldApplier(bus)
+	applier.remove()
+
+	f := &FirewalldFirewall{
+		ruleSetFirewall: newRuleSetFirewall(logger, nft.v6Available, applier),
+		nftFeatures:     nftFeatures{nft},
+	}
+	f.sharing = nft.SharingIfaces
+
+	if err := bus.AddMatchSignal(dbus.WithMatchInterface(firewalldDest), dbus.WithMatchMember("Reloaded")); err != nil {
+		bus.Close()
+		return nil, fmt.Errorf("watch firewalld reloads: %w", err)
+	}
+	signals := make(chan *dbus.Signal, 4)
+	bus.Signal(signals)
+	go f.watchReloads(signals)
+
+	logger.Verbosef("Using firewalld for the kill switch")
+	return f, nil
+}
+
+// watchReloads re-adds our runtime rules after firewalld reloads, which drops them.
+func (f *FirewalldFirewall) watchReloads(signals <-chan *dbus.Signal) {
+	for sig := range signals {
+		if sig.Name != firewalldDest+".Reloaded" {
+			continue
+		}
+		f.ruleSetFirewall.logger.Verbosef("firewalld reloaded, re-adding our rules")
+		if err := f.resync(); err != nil {
+			f.ruleSetFirewall.logger.Errorf("Failed to re-add rules after firewalld reload: %v", err)
+		}
+	}
+}
+
+// EnableSharing also lets the shared traffic through the kill switch's forward drop.
+func (f *FirewalldFirewall) EnableSharing(lanIface, tunIface string) error {
+	if err := f.LinuxFirewall.EnableSharing(lanIface, tunIface); err != nil {
+		return err
+	}
+	return f.resync()
+}
+
+func (f *FirewalldFirewall) DisableSharing() error {
+	if err := f.LinuxFirewall.DisableSharing(); err != nil {
+		return err
+	}
+	return f.resync()
+}
+
+// Drift adds the direct rules to the drift of our nftables tables.
+func (f *FirewalldFirewall) Drift() []string {
+	drifted := f.LinuxFirewall.Drift()
+	if f.ruleSetDrifted() {
+		drifted = append(drifted, "firewalld rules")
+	}
+	return drifted
+}
+
+func (f *FirewalldFirewall) Reconcile() error {
+	err := f.LinuxFirewall.Reconcile()
+	if f.ruleSetDrifted() {
+		f.ruleSetFirewall.logger.Verbosef("Re-applying drifted firewalld rules")
+		err = errors.Join(err, f.resync())
+	}
+	return err
+}
+
+// apply changes our chains rule by rule, adding the new rules before hooking a chain and removing the stale ones
+// last. firewalld orders a chain's rules by priority, drops last, so a hooked chain keeps its drop throughout and
+// stays closed when a call fails midway.
+func (a *firewalldApplier) apply(rules []ruleSpec) error {
+	for _, ipv := range []string{"ipv4", "ipv6"} {
+		for base, custom := range ruleSetJumps {
+			if err := ignoreFirewalldState(a.direct("addChain", ipv, firewalldTable, custom).Err); err != nil {
+				return fmt.Errorf("add %s chain %s: %w", ipv, custom, err)
+			}
+			live, err := a.getRules(ipv, custom)
+			if err != nil {
+				return fmt.Errorf("get %s chain %s: %w", ipv, custom, err)
+			}
+			want := firewalldRules(rules, ipv, custom)
+
+			for _, rule := range want {
+				if slices.ContainsFunc(live, rule.equal) {
+					continue
+				}
+				// tunnels may share a mark, firewalld refuses the duplicate
+				err := a.direct("addRule", ipv, firewalldTable, custom, rule.Priority, rule.Args).Err
+				if err := ignoreFirewalldState(err); err != nil {
+					return fmt.Errorf("add %s rule %v: %w", ipv, rule.Args, err)
+				}
+			}
+			jump := firewalldJump(custom)
+			err = a.direct("addRule", ipv, firewalldTable, base, jump.Priority, jump.Args).Err
+			if err := ignoreFirewalldState(err); err != nil {
+				return fmt.Errorf("hook %s chain %s: %w", ipv, custom, err)
+			}
+			for _, rule := range live {
+				if slices.ContainsFunc(want, rule.equal) {
+					continue
+				}
+				if err := a.direct("removeRule", ipv, firewalldTable, custom, rule.Priority, rule.Args).Err; err != nil {
+					return fmt.Errorf("remove %s rule %v: %w", ipv, rule.Args, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (a *firewalldApplier) remove() {
+	for _, ipv := range []string{"ipv4", "ipv6"} {
+		for base, custom := range ruleSetJumps {
+			jump := firewalldJump(custom)
+			_ = a.direct("removeRule", ipv, firewalldTable, base, jump.Priority, jump.Args).Err
+			_ = a.direct("removeRules", ipv, firewalldTable, custom).Err
+			_ = a.direct("removeChain", ipv, firewalldTable, custom).Err
+		}
+	}
+}
+
+func (a *firewalldApplier) missing(rules []ruleSpec) bool {
+	for _, ipv := range []string{"ipv4", "ipv6"} {
+		for base, custom := range ruleSetJumps {
+			jumps, err := a.getRules(ipv, base)
+			if err != nil || !slices.ContainsFunc(jumps, firewalldJump(custom).equal) {
+				return true
+			}
+			live, err := a.getRules(ipv, custom)
+			if err != nil {
+				return true
+			}
+			want := firewalldRules(rules, ipv, custom)
+			// a rule replaced by another one, or added to our chain, is drift as well
+			for _, rule := range want {
+				if !slices.ContainsFunc(live, rule.equal) {
+					return true
+				}
+			}
+			for _, rule := range live {
+				if !slices.ContainsFunc(want, rule.equal) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// firewalldRules returns the rules of the rule set in the family's chain.
+func firewalldRules(rules []ruleSpec, ipv, chain string) []firewalldRule {
+	var out []firewalldRule
+	for _, rule := range rules {
+		if rule.ipv == ipv && rule.chain == chain {
+			out = append(out, firewalldRule{rule.priority, rule.args})
+		}
+	}
+	return out
+}
+
+// getRules returns the direct rules of the chain.
+func (a *firewalldApplier) getRules(ipv, chain string) ([]firewalldRule, error) {
+	var rules []firewalldRule
+	err := a.direct("getRules", ipv, firewalldTable, chain).Store(&rules)
+	return rules, err
+}
+
+// firewalldJump is the direct rule hooking our chain into its base chain.
+func firewalldJump(custom string) firewalldRule {
+	return firewalldRule{specPrioAccept, []string{"-j", custom}}
+}
+
+// ignoreFirewalldState ignores firewalld's errors for adding what already exists.
+func ignoreFirewalldState(err error) error {
+	if err != nil && strings.Contains(err.Error(), "ALREADY_ENABLED") {
+		return nil
+	}
+	return err
+}
+
+// dialSystemBus opens a private system bus connection.
+func dialSystemBus() (*dbus.Conn, error) {
+	conn, err := dbus.SystemBusPrivate()
+	if err != nil {
+		return nil, fmt.Errorf("failed to init private conn to system bus: %w", err)
+	}
+	if err := conn.Auth([]dbus.Auth{dbus.AuthExternal(strconv.Itoa(os.Getuid()))}); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to auth with external method: %w", err)
+	}
+	if err := conn.Hello(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to make hello call: %w", err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,232 @@
+//go:build linux && !android
+
+package osfirewall
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// fakeFirewalld keeps firewalld's direct rules by "ipv chain", answering the direct interface calls like firewalld.
+type fakeFirewalld struct {
+	chains map[string][]firewalldRule
+	calls  []string
+	// fail makes the method fail once it was called this many times
+	fail      string
+	failAfter int
+}
+
+func newFakeFirewalld() *fakeFirewalld {
+	f := &fakeFirewalld{chains: make(map[string][]firewalldRule)}
+	for _, ipv := range []string{"ipv4", "ipv6"} {
+		for base := range ruleSetJumps {
+			f.chains[ipv+" "+base] = nil
+		}
+	}
+	return f
+}
+
+func (f *fakeFirewalld) applier() *firewalldApplier {
+	return &firewalldApplier{direct: f.direct}
+}
+
+func (f *fakeFirewalld) direct(method string, args ...any) *dbus.Call {
+	key := fmt.Sprintf("%s %s", args[0], args[2])
+	call := fmt.Sprintf("%s %s", method, key)
+	if len(args) == 5 {
+		call += fmt.Sprintf(" %d %v", args[3], args[4])
+	}
+	f.calls = append(f.calls, call)
+	if method == f.fail {
+		if f.failAfter == 0 {
+			return &dbus.Call{Err: errors.New("INVALID_RULE")}
+		}
+		f.failAfter--
+	}
+
+	rules, exists := f.chains[key]
+	switch method {
+	case "addChain":
+		if exists {
+			return &dbus.Call{Err: errors.New("ALREADY_ENABLED")}
+		}
+		f.chains[key] = nil
+	case "removeChain":
+		delete(f.chains, key)
+	case "removeRules":
+		if exists {
+			f.chains[key] = nil
+		}
+	case "getRules":
+		if !exists {
+			return &dbus.Call{Err: errors.New("INVALID_CHAIN")}
+		}
+		// structs come off the bus as slices of their fields
+		var body [][]any
+		for _, r := range rules {
+			body = append(body, []any{r.Priority, r.Args})
+		}
+		return &dbus.Call{Body: []any{body}}
+	case "addRule", "removeRule":
+		if !exists {
+			return &dbus.Call{Err: errors.New("INVALID_CHAIN")}
+		}
+		rule := firewalldRule{args[3].(int32), args[4].([]string)}
+		i := slices.IndexFunc(rules, rule.equal)
+		if method == "addRule" {
+			if i >= 0 {
+				return &dbus.Call{Err: errors.New("ALREADY_ENABLED")}
+			}
+			f.chains[key] = append(rules, rule)
+		} else if i >= 0 {
+			f.chains[key] = slices.Delete(rules, i, i+1)
+		}
+	}
+	return &dbus.Call{}
+}
+
+func firewalldTestRules(iface string) []ruleSpec {
+	var rules []ruleSpec
+	for _, ipv := range []string{"ipv4", "ipv6"} {
+		rules = append(rules,
+			ruleSpec{ipv, chainNameOutput, specPrioAccept, []string{"-o", iface, "-j", "ACCEPT"}},
+			ruleSpec{ipv, chainNameInput, specPrioDrop, []string{"-j", "DROP"}},
+			ruleSpec{ipv, chainNameOutput, specPrioDrop, []string{"-j", "DROP"}},
+			ruleSpec{ipv, chainNameForward, specPrioDrop, []string{"-j", "DROP"}},
+		)
+	}
+	return rules
+}
+
+func TestFirewalldApply(t *testing.T) {
+	f := newFakeFirewalld()
+	a := f.applier()
+	if err := a.apply(firewalldTestRules("wg0")); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	for _, ipv := range []string{"ipv4", "ipv6"} {
+		for base, custom := range ruleSetJumps {
+			if !slices.ContainsFunc(f.chains[ipv+" "+base], firewalldJump(custom).equal) {
+				t.Errorf("%s %s not hooked into %s", ipv, custom, base)
+			}
+		}
+		want := []firewalldRule{{specPrioAccept, []string{"-o", "wg0", "-j", "ACCEPT"}}, {specPrioDrop, []string{"-j", "DROP"}}}
+		if got := f.chains[ipv+" "+chainNameOutput]; !slices.EqualFunc(got, want, firewalldRule.equal) {
+			t.Errorf("%s output = %v, want %v", ipv, got, want)
+		}
+	}
+	if a.missing(firewalldTestRules("wg0")) {
+		t.Error("missing() after apply")
+	}
+
+	// switching tunnels adds the new accept before the old one is removed, the drop stays throughout
+	f.calls = nil
+	if err := a.apply(firewalldTestRules("wg1")); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	added := slices.Index(f.calls, "addRule ipv4 wgtunnel-output 0 [-o wg1 -j ACCEPT]")
+	removed := slices.Index(f.calls, "removeRule ipv4 wgtunnel-output 0 [-o wg0 -j ACCEPT]")
+	if added < 0 || removed < added {
+		t.Errorf("calls = %q, want the new accept added before the old one is removed", f.calls)
+	}
+	if slices.ContainsFunc(f.calls, func(c string) bool { return c == "removeRule ipv4 wgtunnel-output 100 [-j DROP]" }) {
+		t.Error("drop removed while switching tunnels")
+	}
+	if a.missing(firewalldTestRules("wg1")) {
+		t.Error("missing() after the switch")
+	}
+}
+
+func TestFirewalldApplyFailureKeepsDrop(t *testing.T) {
+	f := newFakeFirewalld()
+	a := f.applier()
+	if err := a.apply(firewalldTestRules("wg0")); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	// the second new rule fails, after the first made it in
+	f.fail, f.failAfter = "addRule", 1
+	if err := a.apply(firewalldTestRules("wg1")); err == nil {
+		t.Fatal("apply succeeded")
+	}
+	for _, ipv := range []string{"ipv4", "ipv6"} {
+		if !slices.ContainsFunc(f.chains[ipv+" "+chainNameOutput], firewalldRule{specPrioDrop, []string{"-j", "DROP"}}.equal) {
+			t.Errorf("%s output lost its drop on a failed apply", ipv)
+		}
+	}
+}
+
+func TestFirewalldMissing(t *testing.T) {
+	rules := firewalldTestRules("wg0")
+	tests := []struct {
+		name   string
+		change func(f *fakeFirewalld)
+	}{
+		{
+			name: "jump removed",
+			change: func(f *fakeFirewalld) {
+				f.direct("removeRule", "ipv4", firewalldTable, baseChainOutput, int32(specPrioAccept), []string{"-j", chainNameOutput})
+			},
+		},
+		{
+			name: "IPv6 jump removed",
+			change: func(f *fakeFirewalld) {
+				f.direct("removeRule", "ipv6", firewalldTable, baseChainInput, int32(specPrioAccept), []string{"-j", chainNameInput})
+			},
+		},
+		{
+			name: "drop removed",
+			change: func(f *fakeFirewalld) {
+				f.direct("removeRule", "ipv4", firewalldTable, chainNameForward, int32(specPrioDrop), []string{"-j", "DROP"})
+			},
+		},
+		{
+			name: "rule replaced by another",
+			change: func(f *fakeFirewalld) {
+				f.direct("removeRule", "ipv4", firewalldTable, chainNameOutput, int32(specPrioAccept), []string{"-o", "wg0", "-j", "ACCEPT"})
+				f.direct("addRule", "ipv4", firewalldTable, chainNameOutput, int32(specPrioAccept), []string{"-o", "eth0", "-j", "ACCEPT"})
+			},
+		},
+		{
+			name: "chain removed",
+			change: func(f *fakeFirewalld) {
+				f.direct("removeChain", "ipv6", firewalldTable, chainNameOutput)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeFirewalld()
+			a := f.applier()
+			if err := a.apply(rules); err != nil {
+				t.Fatalf("apply: %v", err)
+			}
+			tt.change(f)
+			if !a.missing(rules) {
+				t.Error("missing() = false")
+			}
+		})
+	}
+}
+
+func TestFirewalldRemove(t *testing.T) {
+	f := newFakeFirewalld()
+	a := f.applier()
+	if err := a.apply(firewalldTestRules("wg0")); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	a.remove()
+	for key, rules := range f.chains {
+		if len(rules) > 0 {
+			t.Errorf("%s left with %v", key, rules)
+		}
+	}
+	for _, custom := range ruleSetJumps {
+		if _, ok := f.chains["ipv4 "+custom]; ok {
+			t.Errorf("chain %s left behind", custom)
+		}
+	}
+}
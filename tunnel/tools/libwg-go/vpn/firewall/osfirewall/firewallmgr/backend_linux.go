@@ -0,0 +1,26 @@
+//go:build linux && !android
+
+package firewallmgr
+
+import (
+	"github.com/amnezia-vpn/amneziawg-go/device"
+	"github.com/wgtunnel/desktop/tunnel/vpn/firewall"
+	"github.com/wgtunnel/desktop/tunnel/vpn/firewall/osfirewall"
+)
+
+// newFirewall uses firewalld for the kill switch when it is running, as it undoes our nftables changes on every
+// reload, nftables directly when the kernel supports it, and iptables on kernels without nftables.
+func newFirewall(logger *device.Logger) (firewall.Firewall, error) {
+	if osfirewall.FirewalldRunning() {
+		fw, err := osfirewall.NewFirewalld(logger)
+		if err == nil {
+			return fw, nil
+		}
+		logger.Errorf("Failed to use firewalld, falling back to nftables: %v", err)
+	}
+	if !osfirewall.NftablesAvailable() && osfirewall.IptablesAvailable() {
+		logger.Verbosef("nftables unavailable, using iptables")
+		return osfirewall.NewIptables(logger)
+	}
+	return osfirewall.New(logger)
+}
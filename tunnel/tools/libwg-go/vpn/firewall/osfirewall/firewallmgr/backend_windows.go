@@ -0,0 +1,13 @@
+//go:build windows
+
+package firewallmgr
+
+import (
+	"github.com/amnezia-vpn/amneziawg-go/device"
+	"github.com/wgtunnel/desktop/tunnel/vpn/firewall"
+	"github.com/wgtunnel/desktop/tunnel/vpn/firewall/osfirewall"
+)
+
+func newFirewall(logger *device.Logger) (firewall.Firewall, error) {
+	return osfirewall.New(logger)
+}
@@ -0,0 +1,132 @@
+package firewallmgr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wgtunnel/desktop/tunnel/dns"
+	"github.com/wgtunnel/desktop/tunnel/shared"
+	"github.com/wgtunnel/desktop/tunnel/vpn/firewall"
+)
+
+const (
+	// domainMinRefresh and domainMaxRefresh bound how often an allowed domain is resolved again
+	domainMinRefresh = 30 * time.Second
+	domainMaxRefresh = 30 * time.Minute
+)
+
+// allowedDomains holds the refresh loop of each domain allowed through the kill switch.
+var allowedDomains struct {
+	mu      sync.Mutex
+	cancels map[string]context.CancelFunc
+}
+
+// AddAllowedDomain lets the domain's addresses through the kill switch, resolving them through the bypass resolver now and
+// again before their TTL runs out.
+func AddAllowedDomain(domain string) error {
+	domain = normalizeDomain(domain)
+	if domain == "" || strings.ContainsAny(domain, " /") {
+		return fmt.Errorf("invalid domain %q", domain)
+	}
+	allower, err := getDomainAllower()
+	if err != nil {
+		return err
+	}
+
+	allowedDomains.mu.Lock()
+	defer allowedDomains.mu.Unlock()
+
+	if _, ok := allowedDomains.cancels[domain]; ok {
+		return nil
+	}
+	if allowedDomains.cancels == nil {
+		allowedDomains.cancels = make(map[string]context.CancelFunc)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	allowedDomains.cancels[domain] = cancel
+	go refreshDomain(ctx, allower, domain)
+	return nil
+}
+
+// RemoveAllowedDomain stops refreshing the domain and removes its addresses.
+func RemoveAllowedDomain(domain string) error {
+	domain = normalizeDomain(domain)
+	allower, err := getDomainAllower()
+	if err != nil {
+		return err
+	}
+
+	allowedDomains.mu.Lock()
+	defer allowedDomains.mu.Unlock()
+
+	cancel, ok := allowedDomains.cancels[domain]
+	if !ok {
+		return nil
+	}
+	cancel()
+	delete(allowedDomains.cancels, domain)
+	return allower.RemoveDomain(domain)
+}
+
+// AllowedDomains returns the allowed domains, sorted.
+func AllowedDomains() []string {
+	allowedDomains.mu.Lock()
+	defer allowedDomains.mu.Unlock()
+	return slices.Sorted(maps.Keys(allowedDomains.cancels))
+}
+
+// refreshDomain resolves the domain until cancelled. The addresses are allowed for the TTL plus the refresh
+// interval, so they're replaced before they expire; a failed refresh is retried and lets them run out.
+func refreshDomain(ctx context.Context, allower firewall.DomainAllower, domain string) {
+	for {
+		wait := domainMinRefresh
+		resolved, err := dns.ResolveRecords(domain, dns.DefaultOptions(), false, 0)
+		if err != nil {
+			shared.LogWarn("Resolve allowed domain %s: %v", domain, err)
+		} else {
+			wait = min(max(resolved.TTL/2, domainMinRefresh), domainMaxRefresh)
+			addrs := append(resolved.V4, resolved.V6...)
+			// under the lock, so a removal can't be undone by a refresh in flight
+			allowedDomains.mu.Lock()
+			if ctx.Err() != nil {
+				allowedDomains.mu.Unlock()
+				return
+			}
+			err := allower.AllowDomain(domain, addrs, resolved.TTL+wait)
+			allowedDomains.mu.Unlock()
+			if err != nil {
+				shared.LogError("Allow domain %s: %v", domain, err)
+			} else {
+				shared.LogDebug("Allowed domain %s: %v for %v", domain, addrs, resolved.TTL+wait)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
+
+func getDomainAllower() (firewall.DomainAllower, error) {
+	fw, err := Get()
+	if err != nil {
+		return nil, err
+	}
+	allower, ok := fw.(firewall.DomainAllower)
+	if !ok {
+		return nil, errors.New("allowing domains is not supported by this firewall")
+	}
+	return allower, nil
+}
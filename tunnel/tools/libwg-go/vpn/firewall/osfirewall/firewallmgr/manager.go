@@ -4,9 +4,9 @@ import (
 	"net/netip"
 	"sync"
 
+	"github.com/amnezia-vpn/amneziawg-go/device"
 	"github.com/wgtunnel/desktop/tunnel/shared"
 	"github.com/wgtunnel/desktop/tunnel/vpn/firewall"
-	"github.com/wgtunnel/desktop/tunnel/vpn/firewall/osfirewall"
 )
 
 var (
@@ -19,9 +19,7 @@ func Get() (firewall.Firewall, error) {
 	once.Do(func() {
 		var fw firewall.Firewall
 		logger := shared.NewLogger("Firewall")
-		fw, initErr = osfirewall.New(
-			logger,
-		)
+		fw, initErr = newFirewall(logger)
 		if initErr != nil {
 			return
 		}
@@ -34,12 +32,36 @@ func Get() (firewall.Firewall, error) {
 			}
 		}
 
+		if boot, ok := fw.(firewall.BootKillSwitch); ok && boot.BootKillSwitchLoaded() {
+			takeOverBootKillSwitch(fw, boot, logger)
+		}
+
 		instance = fw
 	})
 
 	return instance, initErr
 }
 
+// takeOverBootKillSwitch replaces the boot ruleset with a persistent kill switch of our own. The boot ruleset is only
+// released once ours is up, so traffic is never let through in between, and stays loaded if ours fails.
+func takeOverBootKillSwitch(fw firewall.Firewall, boot firewall.BootKillSwitch, logger *device.Logger) {
+	fw.SetPersist(true)
+	if err := fw.Enable(); err != nil {
+		logger.Errorf("Failed to take over boot-time kill switch: %v", err)
+		return
+	}
+	if localNets := boot.BootLocalNetworks(); len(localNets) > 0 {
+		if err := fw.AllowLocalNetworks(localNets); err != nil {
+			logger.Errorf("Failed to allow local networks of boot-time kill switch: %v", err)
+		}
+	}
+	if err := boot.ReleaseBootKillSwitch(); err != nil {
+		logger.Errorf("Failed to release boot-time kill switch: %v", err)
+		return
+	}
+	logger.Verbosef("Took over boot-time kill switch")
+}
+
 func GetLocalAddresses() []netip.Prefix {
 	return []netip.Prefix{
 		// IPv4 Private Ranges (RFC 1918)
@@ -0,0 +1,163 @@
+package firewallmgr
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/wgtunnel/desktop/tunnel/dns"
+	"github.com/wgtunnel/desktop/tunnel/shared"
+	"github.com/wgtunnel/desktop/tunnel/vpn/firewall"
+	"github.com/wgtunnel/desktop/tunnel/vpn/firewall/captive"
+)
+
+// portalProbeInterval is how often a paused kill switch probes for a captive portal
+const portalProbeInterval = 5 * time.Second
+
+// pauseState re-arms a paused kill switch when its timer expires or a tunnel handshakes, and probes for a captive
+// portal in the meantime.
+var pauseState struct {
+	mu        sync.Mutex
+	timer     *time.Timer
+	cancel    context.CancelFunc
+	portalURL string
+	portal    captive.Status
+}
+
+// PauseKillSwitch pauses the kill switch for d, restarting the timer if it's paused already.
+func PauseKillSwitch(d time.Duration) error {
+	pauser, err := getPauser()
+	if err != nil {
+		return err
+	}
+
+	pauseState.mu.Lock()
+	defer pauseState.mu.Unlock()
+
+	if err := pauser.PauseKillSwitch(); err != nil {
+		return err
+	}
+	stopPauseLocked()
+	pauseState.timer = time.AfterFunc(d, func() { resumeKillSwitch("pause expired") })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pauseState.cancel = cancel
+	pauseState.portal = captive.StatusUnknown
+	go probePortal(ctx, portalURL())
+	return nil
+}
+
+// ResumeKillSwitch re-arms a paused kill switch.
+func ResumeKillSwitch() error {
+	pauser, err := getPauser()
+	if err != nil {
+		return err
+	}
+
+	pauseState.mu.Lock()
+	defer pauseState.mu.Unlock()
+
+	stopPauseLocked()
+	return pauser.ResumeKillSwitch()
+}
+
+// TunnelHandshake re-arms a paused kill switch, the tunnel is through any captive portal.
+func TunnelHandshake() {
+	pauseState.mu.Lock()
+	paused := pauseState.timer != nil
+	pauseState.mu.Unlock()
+	if paused {
+		resumeKillSwitch("tunnel handshake")
+	}
+}
+
+// SetCaptivePortalURL sets the URL probed for a captive portal, empty for the default.
+func SetCaptivePortalURL(url string) {
+	pauseState.mu.Lock()
+	defer pauseState.mu.Unlock()
+	pauseState.portalURL = url
+}
+
+// CaptivePortalStatus returns the last probe result of the current pause.
+func CaptivePortalStatus() captive.Status {
+	pauseState.mu.Lock()
+	defer pauseState.mu.Unlock()
+	return pauseState.portal
+}
+
+func resumeKillSwitch(reason string) {
+	if err := ResumeKillSwitch(); err != nil {
+		shared.LogError("Failed to re-arm kill switch after %s: %v", reason, err)
+		return
+	}
+	shared.LogDebug("Kill switch re-armed after %s", reason)
+}
+
+// stopPauseLocked stops the timer and the portal probe, callers hold pauseState.mu.
+func stopPauseLocked() {
+	if pauseState.timer != nil {
+		pauseState.timer.Stop()
+		pauseState.timer = nil
+	}
+	if pauseState.cancel != nil {
+		pauseState.cancel()
+		pauseState.cancel = nil
+	}
+}
+
+func portalURL() string {
+	if pauseState.portalURL == "" {
+		return captive.DefaultURL
+	}
+	return pauseState.portalURL
+}
+
+// probePortal probes through the bootstrap marked dialer, so the probe leaves the physical interface even while a
+// tunnel holds the default route, until the pause ends.
+func probePortal(ctx context.Context, url string) {
+	dialer, err := dns.GetBypassDialer(false, 0, 0)
+	if err != nil {
+		shared.LogError("Captive portal probe dialer: %v", err)
+		return
+	}
+	dialer.Resolver = dns.CustomResolver(false, 0, 0)
+
+	ticker := time.NewTicker(portalProbeInterval)
+	defer ticker.Stop()
+	for {
+		status, err := captive.Probe(ctx, url, dialer)
+		if err != nil && ctx.Err() == nil {
+			shared.LogDebug("Captive portal probe: %v", err)
+		}
+		pauseState.mu.Lock()
+		// a newer pause owns the status
+		if ctx.Err() != nil {
+			pauseState.mu.Unlock()
+			return
+		}
+		if pauseState.portal != status {
+			shared.LogDebug("Captive portal status: %v", status)
+		}
+		pauseState.portal = status
+		pauseState.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func getPauser() (firewall.Pauser, error) {
+	fw, err := Get()
+	if err != nil {
+		return nil, err
+	}
+	pauser, ok := fw.(firewall.Pauser)
+	if !ok {
+		return nil, errors.New("pausing the kill switch is not supported by this firewall")
+	}
+	return pauser, nil
+}
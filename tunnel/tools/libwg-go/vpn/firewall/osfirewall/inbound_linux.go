@@ -0,0 +1,147 @@
+//go:build linux && !android
+
+package osfirewall
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/wgtunnel/desktop/tunnel/vpn/firewall"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	inboundTable          = "wgtunnel-inbound"
+	chainNameInboundInput = "wgtunnel-inbound-input"
+	inboundSetPrefix      = "allow-"
+)
+
+// inboundOwned holds the inbound policies, its chain runs ahead of the kill switch's input chain
+var inboundOwned = ownedTable{
+	name:  inboundTable,
+	chain: chainNameInboundInput,
+	hook:  nftables.ChainHookInput,
+	prio:  nftables.ChainPriorityRef(*nftables.ChainPriorityFilter - 5),
+}
+
+// inboundState holds the blocking inbound policies by tunnel iface.
+type inboundState struct {
+	policies map[string]firewall.InboundPolicy
+}
+
+// SetInboundPolicy drops new connections arriving from the tunnel unless the policy allows their port or source.
+func (f *LinuxFirewall) SetInboundPolicy(iface string, policy firewall.InboundPolicy) error {
+	for _, p := range policy.Ports {
+		if p.Port == 0 || (p.Proto != "" && p.Proto != "tcp" && p.Proto != "udp") {
+			return fmt.Errorf("invalid inbound port %s/%d", p.Proto, p.Port)
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !policy.BlockNew {
+		if _, ok := f.inbound.policies[iface]; !ok {
+			return nil
+		}
+		delete(f.inbound.policies, iface)
+		return f.syncInbound()
+	}
+	if f.inbound.policies == nil {
+		f.inbound.policies = make(map[string]firewall.InboundPolicy)
+	}
+	f.inbound.policies[iface] = policy
+	return f.syncInbound()
+}
+
+// RemoveInboundPolicy lifts the tunnel's inbound policy, the table is removed with the last one.
+func (f *LinuxFirewall) RemoveInboundPolicy(iface string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.inbound.policies[iface]; !ok {
+		return nil
+	}
+	delete(f.inbound.policies, iface)
+	return f.syncInbound()
+}
+
+// syncInbound rebuilds the inbound tables in one transaction, or removes them when no tunnel blocks inbound.
+func (f *LinuxFirewall) syncInbound() error {
+	if len(f.inbound.policies) == 0 {
+		return f.removeOwnedTables(inboundTable)
+	}
+
+	err := f.syncOwnedTable(inboundOwned, f.tableFamilies(), func(t *nftables.Table, chain *nftables.Chain) error {
+		v6 := t.Family == nftables.TableFamilyIPv6
+		keyType := nftables.TypeIPAddr
+		if v6 {
+			keyType = nftables.TypeIP6Addr
+		}
+
+		for iface, policy := range f.inbound.policies {
+			f.conn.AddRule(createEstablishedIfaceRule(t, chain, iface, ""))
+
+			if elems := blocklistElements(policy.AllowFrom, v6); len(elems) > 0 {
+				set := &nftables.Set{Table: t, Name: inboundSetPrefix + iface, KeyType: keyType, Interval: true}
+				if err := f.conn.AddSet(set, elems); err != nil {
+					return fmt.Errorf("add inbound sources of %s: %w", iface, err)
+				}
+				f.conn.AddRule(&nftables.Rule{
+					Table: t,
+					Chain: chain,
+					Exprs: append(ifaceExprs(iface, ""),
+						newLoadAddrExpr(v6, true, 1),
+						&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+						&expr.Counter{},
+						&expr.Verdict{Kind: expr.VerdictAccept},
+					),
+				})
+			}
+
+			for _, p := range policy.Ports {
+				for _, proto := range inboundProtos(p.Proto) {
+					f.conn.AddRule(createIfaceDportAcceptRule(t, chain, iface, proto, p.Port))
+				}
+			}
+			f.conn.AddRule(createIfaceRule(t, chain, iface, "", expr.VerdictDrop))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	f.logger.Verbosef("Inbound policies active for %d tunnels", len(f.inbound.policies))
+	return nil
+}
+
+// inboundProtos returns the L4 protocols an inbound port applies to.
+func inboundProtos(proto string) []byte {
+	switch proto {
+	case "tcp":
+		return []byte{unix.IPPROTO_TCP}
+	case "udp":
+		return []byte{unix.IPPROTO_UDP}
+	}
+	return []byte{unix.IPPROTO_TCP, unix.IPPROTO_UDP}
+}
+
+// createIfaceDportAcceptRule accepts the protocol's traffic arriving on iif to the destination port.
+func createIfaceDportAcceptRule(table *nftables.Table, chain *nftables.Chain, iif string, proto byte, port uint16) *nftables.Rule {
+	portBytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBytes, port)
+	return &nftables.Rule{
+		Table: table,
+		Chain: chain,
+		Exprs: append(ifaceExprs(iif, ""),
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+			newLoadDportExpr(1),
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: portBytes},
+			&expr.Counter{},
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		),
+	}
+}
@@ -0,0 +1,277 @@
+//go:build linux && !android
+
+package osfirewall
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/wgtunnel/desktop/tunnel/vpn/firewall"
+	"golang.org/x/net/nettest"
+)
+
+// nftProbeTable is installed and deleted again to tell whether nftables is usable
+const nftProbeTable = "wgtunnel-probe"
+
+// IptablesFirewall is the kill switch and IPv6 block as iptables and ip6tables chains, for kernels without
+// nftables. Blocklists, the DNS lock, LAN sharing and inbound policies need nftables and aren't offered.
+type IptablesFirewall struct {
+	*ruleSetFirewall
+	applier *iptablesApplier
+}
+
+// iptablesApplier installs the rule set with iptables-restore, each family in a single transaction.
+type iptablesApplier struct {
+	v6       bool
+	lookPath func(file string) (string, error)
+	// run executes a command with stdin, returning its combined output
+	run func(stdin []byte, name string, args ...string) ([]byte, error)
+}
+
+func newIptablesApplier(v6 bool) *iptablesApplier {
+	return &iptablesApplier{
+		v6:       v6,
+		lookPath: exec.LookPath,
+		run: func(stdin []byte, name string, args ...string) ([]byte, error) {
+			cmd := exec.Command(name, args...)
+			cmd.Stdin = bytes.NewReader(stdin)
+			return cmd.CombinedOutput()
+		},
+	}
+}
+
+// NftablesAvailable reports whether the kernel accepts nftables rules, by installing a probe table with a counter rule
+// in a base chain and deleting it again. Kernels built without some of nftables take a table but refuse the hook or
+// the expression.
+func NftablesAvailable() bool {
+	conn, err := nftables.New()
+	if err != nil {
+		return false
+	}
+	table := conn.AddTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: nftProbeTable})
+	policy := nftables.ChainPolicyAccept
+	chain := conn.AddChain(&nftables.Chain{
+		Name:     baseChainOutput,
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookOutput,
+		Priority: nftables.ChainPriorityFilter,
+		Policy:   &policy,
+	})
+	conn.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: []expr.Any{&expr.Counter{}}})
+	// the batch is applied as a whole, a refused one leaves nothing behind
+	if err := conn.Flush(); err != nil {
+		return false
+	}
+	conn.DelTable(table)
+	return conn.Flush() == nil
+}
+
+// IptablesAvailable reports whether iptables and iptables-restore are installed and can list the filter table.
+func IptablesAvailable() bool {
+	a := newIptablesApplier(false)
+	if _, err := a.lookPath("iptables-restore"); err != nil {
+		return false
+	}
+	_, err := a.run(nil, "iptables", "-w", "-t", "filter", "-S", baseChainOutput)
+	return err == nil
+}
+
+// NewIptables returns the iptables backed firewall, removing chains left by a previous run.
+func NewIptables(logger *device.Logger) (firewall.Firewall, error) {
+	supportsV6 := nettest.SupportsIPv6()
+	applier := newIptablesApplier(supportsV6)
+	if _, err := applier.lookPath("ip6tables-restore"); supportsV6 && err != nil {
+		logger.Verbosef("ip6tables-restore not found, IPv6 is left unfiltered")
+		applier.v6 = false
+	}
+	logger.Verbosef("iptables mode, v6 support: %v", applier.v6)
+
+	applier.remove()
+	return &IptablesFirewall{
+		ruleSetFirewall: newRuleSetFirewall(logger, applier.v6, applier),
+		applier:         applier,
+	}, nil
+}
+
+// ActivateBlocklists does nothing, blocklists can't be loaded without nftables.
+func (f *IptablesFirewall) ActivateBlocklists(string) error { return nil }
+
+func (f *IptablesFirewall) DeactivateBlocklists(string) error { return nil }
+
+// SetDnsLockTunnel does nothing, the DNS lock can't be enabled without nftables.
+func (f *IptablesFirewall) SetDnsLockTunnel(string, []netip.Addr, uint32) error { return nil }
+
+func (f *IptablesFirewall) RemoveDnsLockTunnel(string) error { return nil }
+
+func (f *IptablesFirewall) Drift() []string {
+	if f.ruleSetDrifted() {
+		return []string{"iptables rules"}
+	}
+	return nil
+}
+
+func (f *IptablesFirewall) Reconcile() error {
+	if !f.ruleSetDrifted() {
+		return nil
+	}
+	f.logger.Verbosef("Re-applying drifted iptables rules")
+	return f.resync()
+}
+
+// ForeignMarks returns the packet marks matched or set by iptables rules outside our chains.
+func (f *IptablesFirewall) ForeignMarks() ([]MarkUse, error) {
+	var uses []MarkUse
+	for _, ipv := range f.applier.families() {
+		bin := iptablesBinary(ipv)
+		out, err := f.applier.run(nil, bin+"-save")
+		if err != nil {
+			return nil, fmt.Errorf("%s-save: %w (%s)", bin, err, strings.TrimSpace(string(out)))
+		}
+		uses = append(uses, iptablesMarks(bin, out)...)
+	}
+	return uses, nil
+}
+
+func (a *iptablesApplier) families() []string {
+	if a.v6 {
+		return []string{"ipv4", "ipv6"}
+	}
+	return []string{"ipv4"}
+}
+
+func (a *iptablesApplier) apply(rules []ruleSpec) error {
+	for _, ipv := range a.families() {
+		bin := iptablesBinary(ipv)
+
+		// declaring a chain with --noflush creates or empties it, so the rules are replaced in one commit
+		var buf bytes.Buffer
+		buf.WriteString("*filter\n")
+		for _, custom := range ruleSetJumps {
+			fmt.Fprintf(&buf, ":%s - [0:0]\n", custom)
+		}
+		for _, rule := range rules {
+			if rule.ipv == ipv {
+				fmt.Fprintf(&buf, "-A %s %s\n", rule.chain, strings.Join(rule.args, " "))
+			}
+		}
+		buf.WriteString("COMMIT\n")
+		if out, err := a.run(buf.Bytes(), bin+"-restore", "-w", "--noflush"); err != nil {
+			return fmt.Errorf("%s-restore: %w (%s)", bin, err, strings.TrimSpace(string(out)))
+		}
+
+		for base, custom := range ruleSetJumps {
+			if _, err := a.run(nil, bin, "-w", "-C", base, "-j", custom); err == nil {
+				continue
+			}
+			if out, err := a.run(nil, bin, "-w", "-I", base, "1", "-j", custom); err != nil {
+				return fmt.Errorf("hook %s chain %s: %w (%s)", ipv, custom, err, strings.TrimSpace(string(out)))
+			}
+		}
+	}
+	return nil
+}
+
+func (a *iptablesApplier) remove() {
+	for _, ipv := range a.families() {
+		bin := iptablesBinary(ipv)
+		for base, custom := range ruleSetJumps {
+			// a jump may have been added more than once by an older run
+			for {
+				if _, err := a.run(nil, bin, "-w", "-D", base, "-j", custom); err != nil {
+					break
+				}
+			}
+			_, _ = a.run(nil, bin, "-w", "-F", custom)
+			_, _ = a.run(nil, bin, "-w", "-X", custom)
+		}
+	}
+}
+
+func (a *iptablesApplier) missing(rules []ruleSpec) bool {
+	want := make(map[[2]string]int)
+	for _, rule := range rules {
+		want[[2]string{rule.ipv, rule.chain}]++
+	}
+	for key, count := range want {
+		out, err := a.run(nil, iptablesBinary(key[0]), "-w", "-S", key[1])
+		if err != nil || bytes.Count(out, []byte("\n-A ")) < count {
+			return true
+		}
+	}
+	for _, ipv := range a.families() {
+		for base, custom := range ruleSetJumps {
+			if _, err := a.run(nil, iptablesBinary(ipv), "-w", "-C", base, "-j", custom); err != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// iptablesBinary returns the iptables command of the family.
+func iptablesBinary(ipv string) string {
+	if ipv == "ipv6" {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
+// iptablesMarks extracts the marks of --mark, --set-mark and --set-xmark options from iptables-save output,
+// skipping rules of our chains.
+func iptablesMarks(bin string, save []byte) []MarkUse {
+	var uses []MarkUse
+	table := ""
+	for _, line := range strings.Split(string(save), "\n") {
+		if strings.HasPrefix(line, "*") {
+			table = line[1:]
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "-A" || isOwnChain(fields[1]) {
+			continue
+		}
+		for i := 2; i+1 < len(fields); i++ {
+			switch fields[i] {
+			case "--mark", "--set-mark", "--set-xmark":
+			default:
+				continue
+			}
+			value, mask, err := parseIptablesMark(fields[i+1])
+			if err != nil {
+				continue
+			}
+			uses = append(uses, MarkUse{Mark: value, Mask: mask, Owner: fmt.Sprintf("%s %s/%s", bin, table, fields[1])})
+		}
+	}
+	return uses
+}
+
+// parseIptablesMark parses "value[/mask]", a missing mask covering all bits.
+func parseIptablesMark(s string) (value, mask uint32, err error) {
+	valueStr, maskStr, hasMask := strings.Cut(s, "/")
+	v, err := strconv.ParseUint(valueStr, 0, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	mask = 0xffffffff
+	if hasMask {
+		m, err := strconv.ParseUint(maskStr, 0, 32)
+		if err != nil {
+			return 0, 0, err
+		}
+		mask = uint32(m)
+	}
+	if mask == 0 {
+		return 0, 0, errors.New("empty mark mask")
+	}
+	return uint32(v) & mask, mask, nil
+}
@@ -0,0 +1,196 @@
+//go:build linux && !android
+
+package osfirewall
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// fakeIptables records the iptables invocations instead of running them.
+type fakeIptables struct {
+	// hooked are the "bin base custom" jumps that exist
+	hooked map[string]bool
+	fail   string
+	calls  []string
+	stdin  map[string]string
+}
+
+func (f *fakeIptables) applier(v6 bool) *iptablesApplier {
+	f.stdin = make(map[string]string)
+	return &iptablesApplier{
+		v6:       v6,
+		lookPath: func(file string) (string, error) { return "/usr/sbin/" + file, nil },
+		run: func(stdin []byte, name string, args ...string) ([]byte, error) {
+			call := strings.Join(append([]string{name}, args...), " ")
+			if len(args) == 5 && args[1] == "-C" {
+				if f.hooked[name+" "+args[2]+" "+args[4]] {
+					return nil, nil
+				}
+				return []byte("iptables: No chain/target/match by that name."), errors.New("exit status 1")
+			}
+			f.calls = append(f.calls, call)
+			f.stdin[call] = string(stdin)
+			if call == f.fail {
+				return []byte("iptables-restore: line 3 failed"), errors.New("exit status 1")
+			}
+			return nil, nil
+		},
+	}
+}
+
+func TestIptablesApply(t *testing.T) {
+	rules := []ruleSpec{
+		{"ipv4", chainNameOutput, specPrioAccept, []string{"-o", "wg0", "-j", "ACCEPT"}},
+		{"ipv6", chainNameOutput, specPrioAccept, []string{"-o", "wg0", "-j", "ACCEPT"}},
+		{"ipv4", chainNameOutput, specPrioDrop, []string{"-j", "DROP"}},
+		{"ipv6", chainNameOutput, specPrioDrop, []string{"-j", "DROP"}},
+	}
+	hooks := func(bin string) []string {
+		return []string{
+			bin + " -w -I FORWARD 1 -j wgtunnel-forward",
+			bin + " -w -I INPUT 1 -j wgtunnel-input",
+			bin + " -w -I OUTPUT 1 -j wgtunnel-output",
+		}
+	}
+
+	tests := []struct {
+		name      string
+		v6        bool
+		hooked    map[string]bool
+		wantCalls []string
+		wantRules map[string][]string
+	}{
+		{
+			name:      "IPv4 only",
+			wantCalls: append([]string{"iptables-restore -w --noflush"}, hooks("iptables")...),
+			wantRules: map[string][]string{
+				"iptables-restore -w --noflush": {"-A wgtunnel-output -o wg0 -j ACCEPT", "-A wgtunnel-output -j DROP"},
+			},
+		},
+		{
+			name: "both families",
+			v6:   true,
+			wantCalls: slices.Concat(
+				[]string{"iptables-restore -w --noflush"}, hooks("iptables"),
+				[]string{"ip6tables-restore -w --noflush"}, hooks("ip6tables"),
+			),
+			wantRules: map[string][]string{
+				"iptables-restore -w --noflush":  {"-A wgtunnel-output -o wg0 -j ACCEPT", "-A wgtunnel-output -j DROP"},
+				"ip6tables-restore -w --noflush": {"-A wgtunnel-output -o wg0 -j ACCEPT", "-A wgtunnel-output -j DROP"},
+			},
+		},
+		{
+			name: "existing hooks are kept",
+			hooked: map[string]bool{
+				"iptables INPUT wgtunnel-input":     true,
+				"iptables OUTPUT wgtunnel-output":   true,
+				"iptables FORWARD wgtunnel-forward": true,
+			},
+			wantCalls: []string{"iptables-restore -w --noflush"},
+			wantRules: map[string][]string{
+				"iptables-restore -w --noflush": {"-A wgtunnel-output -o wg0 -j ACCEPT", "-A wgtunnel-output -j DROP"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeIptables{hooked: tt.hooked}
+			if err := f.applier(tt.v6).apply(rules); err != nil {
+				t.Fatalf("apply: %v", err)
+			}
+			// hooks are added in map order, the restore of a family comes before its hooks
+			calls := slices.Clone(f.calls)
+			slices.Sort(calls)
+			want := slices.Clone(tt.wantCalls)
+			slices.Sort(want)
+			if !slices.Equal(calls, want) {
+				t.Fatalf("calls = %q, want %q", f.calls, tt.wantCalls)
+			}
+			v6Restore := slices.Index(f.calls, "ip6tables-restore -w --noflush")
+			if tt.v6 && v6Restore < slices.Index(f.calls, "iptables -w -I OUTPUT 1 -j wgtunnel-output") {
+				t.Errorf("IPv6 applied before IPv4 was hooked: %q", f.calls)
+			}
+
+			for call, wantRules := range tt.wantRules {
+				lines := strings.Split(strings.TrimSpace(f.stdin[call]), "\n")
+				if lines[0] != "*filter" || lines[len(lines)-1] != "COMMIT" {
+					t.Errorf("%s input not a filter transaction: %q", call, lines)
+				}
+				for _, chain := range []string{chainNameInput, chainNameOutput, chainNameForward} {
+					if !slices.Contains(lines, ":"+chain+" - [0:0]") {
+						t.Errorf("%s doesn't declare %s, leaving its old rules", call, chain)
+					}
+				}
+				var got []string
+				for _, line := range lines {
+					if strings.HasPrefix(line, "-A ") {
+						got = append(got, line)
+					}
+				}
+				if !slices.Equal(got, wantRules) {
+					t.Errorf("%s rules = %q, want %q", call, got, wantRules)
+				}
+			}
+		})
+	}
+}
+
+func TestIptablesApplyError(t *testing.T) {
+	f := &fakeIptables{fail: "iptables-restore -w --noflush"}
+	err := f.applier(false).apply([]ruleSpec{{"ipv4", chainNameOutput, specPrioDrop, []string{"-j", "DROP"}}})
+	if err == nil || !strings.Contains(err.Error(), "line 3 failed") {
+		t.Fatalf("apply error = %v, want the command output", err)
+	}
+	// a failed transaction isn't hooked
+	if len(f.calls) != 1 {
+		t.Errorf("calls after the failure: %q", f.calls[1:])
+	}
+}
+
+func TestIptablesMarks(t *testing.T) {
+	tests := []struct {
+		name string
+		save string
+		want []MarkUse
+	}{
+		{
+			name: "match and set",
+			save: "*mangle\n" +
+				":PREROUTING ACCEPT [0:0]\n" +
+				"-A PREROUTING -i eth0 -j MARK --set-xmark 0x10/0xff\n" +
+				"-A OUTPUT -m mark --mark 0xca6c -j ACCEPT\n" +
+				"COMMIT\n",
+			want: []MarkUse{
+				{Mark: 0x10, Mask: 0xff, Owner: "iptables mangle/PREROUTING"},
+				{Mark: 0xca6c, Mask: 0xffffffff, Owner: "iptables mangle/OUTPUT"},
+			},
+		},
+		{
+			name: "value outside the mask is dropped",
+			save: "*filter\n-A FORWARD -j MARK --set-mark 0x1ff/0xf0\nCOMMIT\n",
+			want: []MarkUse{{Mark: 0xf0, Mask: 0xf0, Owner: "iptables filter/FORWARD"}},
+		},
+		{
+			name: "our chains are skipped",
+			save: "*filter\n-A wgtunnel-output -m mark --mark 0x100000/0xff0000 -j ACCEPT\nCOMMIT\n",
+		},
+		{
+			name: "unparsable and empty masks are skipped",
+			save: "*filter\n" +
+				"-A INPUT -m mark --mark bogus -j DROP\n" +
+				"-A INPUT -m mark --mark 0x1/0x0 -j DROP\n" +
+				"-A INPUT -m mark --mark\n" +
+				"COMMIT\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := iptablesMarks("iptables", []byte(tt.save)); !slices.Equal(got, tt.want) {
+				t.Errorf("iptablesMarks() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
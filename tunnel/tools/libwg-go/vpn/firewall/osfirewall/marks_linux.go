@@ -0,0 +1,113 @@
+//go:build linux && !android
+
+package osfirewall
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// MarkUse is a packet mark matched or set by an nftables rule.
+type MarkUse struct {
+	Mark uint32
+	Mask uint32
+	// Owner is the table and chain of the rule, e.g. "ip filter/ts-forward"
+	Owner string
+}
+
+// ForeignMarks returns the packet marks referenced by nftables rules outside our wgtunnel chains, so the router
+// can avoid marks another VPN or firewall manager relies on.
+func (f *LinuxFirewall) ForeignMarks() ([]MarkUse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	chains, err := f.conn.ListChains()
+	if err != nil {
+		return nil, fmt.Errorf("list chains: %w", err)
+	}
+
+	var uses []MarkUse
+	for _, chain := range chains {
+		if isOwnChain(chain.Name) {
+			continue
+		}
+		rules, err := f.conn.GetRules(chain.Table, chain)
+		if err != nil {
+			f.logger.Verbosef("list rules of %s/%s: %v (ignored)", chain.Table.Name, chain.Name, err)
+			continue
+		}
+		owner := fmt.Sprintf("%s %s/%s", familyName(chain.Table.Family), chain.Table.Name, chain.Name)
+		for _, rule := range rules {
+			for _, use := range marksInExprs(rule.Exprs) {
+				use.Owner = owner
+				uses = append(uses, use)
+			}
+		}
+	}
+	return uses, nil
+}
+
+// isOwnChain reports whether the chain is one of ours.
+func isOwnChain(name string) bool {
+	return strings.HasPrefix(name, "wgtunnel-")
+}
+
+// marksInExprs extracts mark comparisons (meta mark [& mask] == value) and mark assignments
+// (meta mark set value) from a rule's expressions.
+func marksInExprs(exprs []expr.Any) []MarkUse {
+	var uses []MarkUse
+	// registers currently holding the packet mark, with the mask applied so far
+	markRegs := make(map[uint32]uint32)
+	// registers holding immediate values
+	immediates := make(map[uint32][]byte)
+
+	for _, e := range exprs {
+		switch v := e.(type) {
+		case *expr.Meta:
+			if v.Key != expr.MetaKeyMARK {
+				continue
+			}
+			if v.SourceRegister {
+				if data, ok := immediates[v.Register]; ok && len(data) == 4 {
+					uses = append(uses, MarkUse{Mark: binary.LittleEndian.Uint32(data), Mask: 0xffffffff})
+				}
+				continue
+			}
+			markRegs[v.Register] = 0xffffffff
+		case *expr.Bitwise:
+			mask, ok := markRegs[v.SourceRegister]
+			if !ok || len(v.Mask) != 4 {
+				delete(markRegs, v.DestRegister)
+				continue
+			}
+			markRegs[v.DestRegister] = mask & binary.LittleEndian.Uint32(v.Mask)
+		case *expr.Cmp:
+			mask, ok := markRegs[v.Register]
+			if !ok || v.Op != expr.CmpOpEq || len(v.Data) != 4 {
+				continue
+			}
+			uses = append(uses, MarkUse{Mark: binary.LittleEndian.Uint32(v.Data), Mask: mask})
+		case *expr.Immediate:
+			immediates[v.Register] = v.Data
+			delete(markRegs, v.Register)
+		}
+	}
+	return uses
+}
+
+func familyName(family nftables.TableFamily) string {
+	switch family {
+	case nftables.TableFamilyIPv4:
+		return "ip"
+	case nftables.TableFamilyIPv6:
+		return "ip6"
+	case nftables.TableFamilyINet:
+		return "inet"
+	default:
+		return fmt.Sprintf("family-%d", family)
+	}
+}
@@ -0,0 +1,68 @@
+//go:build linux && !android
+
+package osfirewall
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+)
+
+// ownedTable is a table of ours for a feature next to the kill switch, like the DNS lock or the inbound policies. It
+// is separate from the kill switch tables, so the feature works with the kill switch off and survives it being
+// disabled. Its one base chain is rebuilt as a whole on every change.
+type ownedTable struct {
+	name  string
+	chain string
+	hook  *nftables.ChainHook
+	prio  *nftables.ChainPriority
+}
+
+// syncOwnedTable replaces the table of each family in one transaction, fill adding the rules of its chain.
+func (f *LinuxFirewall) syncOwnedTable(o ownedTable, families []nftables.TableFamily, fill func(t *nftables.Table, chain *nftables.Chain) error) error {
+	for _, family := range families {
+		if t, err := getTableIfExists(f.conn, family, o.name); err != nil {
+			return fmt.Errorf("get %s table: %w", o.name, err)
+		} else if t != nil {
+			f.conn.DelTable(t)
+		}
+
+		t := f.conn.AddTable(&nftables.Table{Family: family, Name: o.name})
+		polAccept := nftables.ChainPolicyAccept
+		chain := f.conn.AddChain(&nftables.Chain{
+			Name:     o.chain,
+			Table:    t,
+			Type:     nftables.ChainTypeFilter,
+			Hooknum:  o.hook,
+			Priority: o.prio,
+			Policy:   &polAccept,
+		})
+		if err := fill(t, chain); err != nil {
+			return err
+		}
+	}
+
+	if err := f.conn.Flush(); err != nil {
+		return fmt.Errorf("flush %s: %w", o.name, err)
+	}
+	return nil
+}
+
+// removeOwnedTables deletes the named table of both families, including ones left by a previous run.
+func (f *LinuxFirewall) removeOwnedTables(name string) error {
+	for _, family := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+		if err := deleteTableIfExists(f.conn, family, name); err != nil {
+			return fmt.Errorf("delete %s table (%v): %w", name, family, err)
+		}
+	}
+	return nil
+}
+
+// tableFamilies returns the families of the kill switch tables, IPv6 only where it is available.
+func (f *LinuxFirewall) tableFamilies() []nftables.TableFamily {
+	var families []nftables.TableFamily
+	for _, table := range f.getTables() {
+		families = append(families, table.Proto)
+	}
+	return families
+}
@@ -0,0 +1,98 @@
+//go:build linux && !android
+
+package osfirewall
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/wgtunnel/desktop/tunnel/vpn/firewall"
+	"golang.org/x/sys/unix"
+)
+
+// PauseKillSwitch lets web and DNS traffic through the kill switch. Tunnel interfaces are let through already, so
+// this only opens the physical interfaces.
+func (f *LinuxFirewall) PauseKillSwitch() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.pauseKillSwitch()
+}
+
+func (f *LinuxFirewall) pauseKillSwitch() error {
+	if !f.IsEnabled() {
+		return errors.New("kill switch must be enabled to pause it")
+	}
+	if f.pauseRules != nil {
+		return nil
+	}
+
+	var rules []*nftables.Rule
+	for _, table := range f.getTables() {
+		outputChain, err := getChainFromTable(f.conn, table.Filter, chainNameOutput)
+		if err != nil {
+			return fmt.Errorf("get output chain: %w", err)
+		}
+		for _, p := range firewall.PausePorts {
+			rule := createDportAcceptRule(table.Filter, outputChain, protoNum(p.Proto), p.Port)
+			f.conn.InsertRule(rule)
+			rules = append(rules, rule)
+		}
+	}
+	if err := f.conn.Flush(); err != nil {
+		return fmt.Errorf("flush after pausing kill switch: %w", err)
+	}
+	f.pauseRules = rules
+	f.logger.Verbosef("Kill switch paused")
+	return nil
+}
+
+func (f *LinuxFirewall) ResumeKillSwitch() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.pauseRules == nil {
+		return nil
+	}
+	f.delRules(f.pauseRules)
+	f.pauseRules = nil
+	if err := f.conn.Flush(); err != nil {
+		return fmt.Errorf("flush after resuming kill switch: %w", err)
+	}
+	f.logger.Verbosef("Kill switch resumed")
+	return nil
+}
+
+func (f *LinuxFirewall) IsKillSwitchPaused() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.pauseRules != nil
+}
+
+// protoNum returns the IP protocol number of "tcp" or "udp".
+func protoNum(proto string) byte {
+	if proto == "tcp" {
+		return unix.IPPROTO_TCP
+	}
+	return unix.IPPROTO_UDP
+}
+
+// createDportAcceptRule accepts the protocol's traffic to the destination port.
+func createDportAcceptRule(table *nftables.Table, chain *nftables.Chain, proto byte, port uint16) *nftables.Rule {
+	portBytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBytes, port)
+	return &nftables.Rule{
+		Table: table,
+		Chain: chain,
+		Exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+			newLoadDportExpr(1),
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: portBytes},
+			&expr.Counter{},
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		},
+	}
+}
@@ -0,0 +1,67 @@
+//go:build windows
+
+package osfirewall
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/tailscale/wf"
+	"github.com/wgtunnel/desktop/tunnel/vpn/firewall"
+)
+
+// PauseKillSwitch permits outbound web and DNS traffic of any app through the kill switch.
+func (f *WindowsFirewall) PauseKillSwitch() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.killSwitchEnabled.Load() {
+		return errors.New("kill switch must be enabled to pause it")
+	}
+	if f.pauseRules != nil {
+		return nil
+	}
+
+	var rules []*wf.Rule
+	for _, p := range firewall.PausePorts {
+		proto := wf.IPProtoUDP
+		if p.Proto == "tcp" {
+			proto = wf.IPProtoTCP
+		}
+		conditions := []*wf.Match{
+			{Field: wf.FieldIPProtocol, Op: wf.MatchTypeEqual, Value: proto},
+			{Field: wf.FieldIPRemotePort, Op: wf.MatchTypeEqual, Value: p.Port},
+		}
+		added, err := f.addRules(fmt.Sprintf("paused %s/%d", p.Proto, p.Port), weightKnownTraffic, conditions, wf.ActionPermit, protocolAll, directionOutbound)
+		if err != nil {
+			_ = f.removeRules(rules)
+			return fmt.Errorf("permit %s/%d: %w", p.Proto, p.Port, err)
+		}
+		rules = append(rules, added...)
+	}
+	f.pauseRules = rules
+	f.logger.Verbosef("Kill switch paused")
+	return nil
+}
+
+func (f *WindowsFirewall) ResumeKillSwitch() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.pauseRules == nil {
+		return nil
+	}
+	rules := f.pauseRules
+	f.pauseRules = nil
+	if err := f.removeRules(rules); err != nil {
+		return fmt.Errorf("remove pause rules: %w", err)
+	}
+	f.logger.Verbosef("Kill switch resumed")
+	return nil
+}
+
+func (f *WindowsFirewall) IsKillSwitchPaused() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.pauseRules != nil
+}
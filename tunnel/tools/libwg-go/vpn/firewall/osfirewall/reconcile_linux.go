@@ -0,0 +1,281 @@
+//go:build linux && !android
+
+package osfirewall
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/wgtunnel/desktop/tunnel/vpn/firewall/mark"
+)
+
+// driftCheck finds one piece of our firewall state removed by someone else, e.g. a firewalld reload or
+// `nft flush ruleset`, and re-applies it from the state we hold.
+type driftCheck struct {
+	name    string
+	drifted func(f *LinuxFirewall) bool
+	reapply func(f *LinuxFirewall) error
+}
+
+// driftChecks run in order, the kill switch first as re-applying it rebuilds the tables sharing lives in.
+var driftChecks = []driftCheck{
+	{"kill switch", (*LinuxFirewall).killSwitchDrifted, (*LinuxFirewall).reapplyKillSwitch},
+	{"LAN sharing", (*LinuxFirewall).sharingDrifted, (*LinuxFirewall).reapplySharingDrift},
+	{"blocklists", (*LinuxFirewall).blocklistsDrifted, (*LinuxFirewall).reapplyBlocklists},
+	{"DNS lock", (*LinuxFirewall).dnsLockDrifted, (*LinuxFirewall).reapplyDnsLock},
+	{"IPv6 block", (*LinuxFirewall).v6BlockDrifted, (*LinuxFirewall).reapplyV6Block},
+	{"inbound policies", (*LinuxFirewall).inboundDrifted, (*LinuxFirewall).reapplyInbound},
+}
+
+// Drift returns the parts of the firewall state we applied that are missing from the live ruleset.
+func (f *LinuxFirewall) Drift() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var drifted []string
+	for _, check := range driftChecks {
+		if check.drifted(f) {
+			drifted = append(drifted, check.name)
+		}
+	}
+	return drifted
+}
+
+// Reconcile re-applies the drifted parts of the firewall state. Tunnel bypasses are the routers' to re-apply, see
+// TunnelBypassesDrifted.
+func (f *LinuxFirewall) Reconcile() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var errs []error
+	for _, check := range driftChecks {
+		if !check.drifted(f) {
+			continue
+		}
+		f.logger.Verbosef("Re-applying drifted %s", check.name)
+		if err := check.reapply(f); err != nil {
+			errs = append(errs, fmt.Errorf("re-apply %s: %w", check.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// TunnelBypassesDrifted reports whether the kill switch is enabled but the iface's bypasses are gone.
+func (f *LinuxFirewall) TunnelBypassesDrifted(iface string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.IsEnabled() {
+		return false
+	}
+	rules, ok := f.tunnelRules[iface]
+	if !ok {
+		return true
+	}
+	for _, rule := range rules {
+		if existing, _ := findRule(f.conn, rule); existing == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// ResetTunnelBypasses removes what is left of the iface's bypasses and forgets them, so they can be added again after
+// some were removed by someone else.
+func (f *LinuxFirewall) ResetTunnelBypasses(iface string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, rule := range append(f.tunnelRules[iface], f.excludedRules[iface]...) {
+		if existing, _ := findRule(f.conn, rule); existing != nil {
+			f.conn.DelRule(existing)
+		}
+	}
+	delete(f.tunnelRules, iface)
+	delete(f.excludedRules, iface)
+	if err := f.conn.Flush(); err != nil {
+		return fmt.Errorf("flush after resetting tunnel bypasses: %w", err)
+	}
+	return nil
+}
+
+func (f *LinuxFirewall) killSwitchDrifted() bool {
+	if !f.IsEnabled() {
+		return false
+	}
+	for _, table := range f.getTables() {
+		filter, err := getTableIfExists(f.conn, table.Proto, "filter")
+		if err != nil || filter == nil {
+			return true
+		}
+		for base, custom := range map[string]string{
+			baseChainInput:   chainNameInput,
+			baseChainOutput:  chainNameOutput,
+			baseChainForward: chainNameForward,
+		} {
+			baseChain, err := getChainFromTable(f.conn, filter, base)
+			if err != nil {
+				return true
+			}
+			if _, err := getChainFromTable(f.conn, filter, custom); err != nil {
+				return true
+			}
+			if hook, _ := findRule(f.conn, createHookRule(filter, baseChain, custom)); hook == nil {
+				return true
+			}
+		}
+		for _, name := range []string{chainNameInput, chainNameOutput, chainNameForward} {
+			chain, err := getChainFromTable(f.conn, filter, name)
+			if err != nil {
+				return true
+			}
+			if drop, _ := findRule(f.conn, createDropRule(filter, chain)); drop == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// reapplyKillSwitch re-adds the missing tables, chains, hooks and rules of the kill switch and keeps the ones in
+// place, so the rest of it stays closed and other tunnels keep their bypasses. Accepts go on top and drops at the end
+// of a chain, the order they were added in. Tunnel bypasses are the routers' to re-add.
+func (f *LinuxFirewall) reapplyKillSwitch() error {
+	if err := f.createChains(); err != nil {
+		return err
+	}
+
+	var accepts, drops []*nftables.Rule
+	for _, table := range f.getTables() {
+		inputChain, err := getChainFromTable(f.conn, table.Filter, chainNameInput)
+		if err != nil {
+			return fmt.Errorf("get input chain: %w", err)
+		}
+		outputChain, err := getChainFromTable(f.conn, table.Filter, chainNameOutput)
+		if err != nil {
+			return fmt.Errorf("get output chain: %w", err)
+		}
+		forwardChain, err := getChainFromTable(f.conn, table.Filter, chainNameForward)
+		if err != nil {
+			return fmt.Errorf("get forward chain: %w", err)
+		}
+
+		accepts = append(accepts,
+			createLoopbackRule(table.Filter, inputChain),
+			createEstablishedRule(table.Filter, inputChain),
+			createLoopbackRule(table.Filter, outputChain),
+			createFwmarkRule(table.Filter, outputChain, mark.LinuxBypassMarkNum),
+		)
+		if f.tunnelPort != 0 {
+			accepts = append(accepts, createAcceptOnPortRule(table.Filter, inputChain, f.tunnelPort))
+		}
+		drops = append(drops,
+			createDropRule(table.Filter, inputChain),
+			createDropRule(table.Filter, outputChain),
+			createDropRule(table.Filter, forwardChain),
+		)
+
+		// the domain set goes with the table
+		if _, err := f.conn.GetSetByName(table.Filter, domainSetName); err != nil {
+			if err := f.queueDomainAllow(table); err != nil {
+				return err
+			}
+		}
+	}
+	accepts = append(accepts, f.localAddrRules...)
+	accepts = append(accepts, f.pauseRules...)
+	accepts = append(accepts, f.exemptRules...)
+
+	for _, rule := range accepts {
+		if existing, _ := findRule(f.conn, rule); existing == nil {
+			f.conn.InsertRule(rule)
+		}
+	}
+	for _, rule := range drops {
+		if existing, _ := findRule(f.conn, rule); existing == nil {
+			f.conn.AddRule(rule)
+		}
+	}
+	if err := f.conn.Flush(); err != nil {
+		return fmt.Errorf("flush after re-adding kill switch rules: %w", err)
+	}
+	return nil
+}
+
+func (f *LinuxFirewall) sharingDrifted() bool {
+	if f.share.lanIface == "" {
+		return false
+	}
+	filter, err := getTableIfExists(f.conn, nftables.TableFamilyIPv4, "filter")
+	if err != nil || filter == nil {
+		return true
+	}
+	forwardChain, err := getChainFromTable(f.conn, filter, chainNameForward)
+	if err != nil {
+		return true
+	}
+	accept, _ := findRule(f.conn, createIfaceRule(filter, forwardChain, f.share.lanIface, f.share.tunIface, expr.VerdictAccept))
+	return accept == nil
+}
+
+func (f *LinuxFirewall) reapplySharingDrift() error {
+	f.removeSharingRules()
+	return f.addSharingRules()
+}
+
+func (f *LinuxFirewall) blocklistsDrifted() bool {
+	if len(f.blocklists.ifaces) == 0 || len(f.blocklists.lists) == 0 {
+		return false
+	}
+	return f.tablesMissing(blocklistTable)
+}
+
+func (f *LinuxFirewall) reapplyBlocklists() error {
+	return f.syncBlocklists()
+}
+
+func (f *LinuxFirewall) dnsLockDrifted() bool {
+	if !f.dnsLock.enabled || len(f.dnsLock.tunnels) == 0 {
+		return false
+	}
+	return f.tablesMissing(dnsLockTable)
+}
+
+func (f *LinuxFirewall) reapplyDnsLock() error {
+	return f.syncDnsLock()
+}
+
+func (f *LinuxFirewall) v6BlockDrifted() bool {
+	if len(f.v6Block.tunnels) == 0 || !f.v6Available {
+		return false
+	}
+	t, err := getTableIfExists(f.conn, nftables.TableFamilyIPv6, v6BlockTable)
+	return err != nil || t == nil
+}
+
+func (f *LinuxFirewall) reapplyV6Block() error {
+	return f.syncV6Block()
+}
+
+func (f *LinuxFirewall) inboundDrifted() bool {
+	if len(f.inbound.policies) == 0 {
+		return false
+	}
+	return f.tablesMissing(inboundTable)
+}
+
+func (f *LinuxFirewall) reapplyInbound() error {
+	return f.syncInbound()
+}
+
+// tablesMissing reports whether the named table is missing in any family we manage.
+func (f *LinuxFirewall) tablesMissing(name string) bool {
+	for _, table := range f.getTables() {
+		if t, err := getTableIfExists(f.conn, table.Proto, name); err != nil || t == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,467 @@
+//go:build linux && !android
+
+package osfirewall
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+	"github.com/wgtunnel/desktop/tunnel/vpn/firewall"
+	"github.com/wgtunnel/desktop/tunnel/vpn/firewall/mark"
+)
+
+const (
+	// rule set priorities, lower ones are matched first
+	specPrioAccept = 0
+	specPrioDrop   = 100
+)
+
+// ruleSetJumps hooks our chains into the built-in ones
+var ruleSetJumps = map[string]string{
+	baseChainInput:   chainNameInput,
+	baseChainOutput:  chainNameOutput,
+	baseChainForward: chainNameForward,
+}
+
+// ruleSpec is a filter table rule in iptables syntax, for ipv "ipv4" or "ipv6".
+type ruleSpec struct {
+	ipv      string
+	chain    string
+	priority int32
+	args     []string
+}
+
+// ruleApplier installs a rule set in a backend speaking iptables syntax.
+type ruleApplier interface {
+	// apply replaces the rules of our chains with the given ones, creating and hooking the chains as needed
+	apply(rules []ruleSpec) error
+	// remove deletes our chains and their hooks, ignoring ones already gone
+	remove()
+	// missing reports whether any of the rules or hooks is missing from the live ruleset
+	missing(rules []ruleSpec) bool
+}
+
+// ruleSetTunnel is what a tunnel lets through the kill switch or the IPv6 block.
+type ruleSetTunnel struct {
+	bypassMark    uint32
+	bootstrapMark uint32
+	excluded      []netip.Prefix
+	// marksOnly leaves the interface out, for a paused tunnel
+	marksOnly bool
+}
+
+// ruleSetFirewall is the kill switch and IPv6 block kept as state and installed as a whole rule set, so a backend
+// that loses our rules, e.g. on a firewalld reload, can put all of them back.
+type ruleSetFirewall struct {
+	logger      *device.Logger
+	v6Available bool
+	applier     ruleApplier
+	// sharing returns the shared LAN and tunnel interfaces let through the forward drop, nil without sharing
+	sharing func() (lanIface, tunIface string)
+
+	mu         sync.Mutex
+	enabled    bool
+	persist    bool
+	paused     bool
+	localNets  []netip.Prefix
+	exemptions []firewall.Exemption
+	domains    map[string]domainAddrs
+	tunnels    map[string]ruleSetTunnel
+	// tunnelPorts are punched for every tunnel up, as the nftables backend keeps each port's rule
+	tunnelPorts []uint16
+	v6Block     map[string]ruleSetTunnel
+}
+
+func newRuleSetFirewall(logger *device.Logger, v6Available bool, applier ruleApplier) *ruleSetFirewall {
+	return &ruleSetFirewall{
+		logger:      logger,
+		v6Available: v6Available,
+		applier:     applier,
+		tunnels:     make(map[string]ruleSetTunnel),
+		v6Block:     make(map[string]ruleSetTunnel),
+		domains:     make(map[string]domainAddrs),
+	}
+}
+
+func (f *ruleSetFirewall) SetPersist(enabled bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.persist = enabled
+}
+
+func (f *ruleSetFirewall) IsPersistent() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.persist
+}
+
+func (f *ruleSetFirewall) IsEnabled() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.enabled
+}
+
+func (f *ruleSetFirewall) Enable() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.enabled {
+		f.logger.Verbosef("Kill switch already active, skipping activation")
+		return nil
+	}
+	f.enabled = true
+	if err := f.sync(); err != nil {
+		f.enabled = false
+		_ = f.sync()
+		return err
+	}
+	f.logger.Verbosef("Kill switch enabled")
+	return nil
+}
+
+func (f *ruleSetFirewall) Disable() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.enabled {
+		f.logger.Verbosef("Firewall is not enabled, skipping")
+		return nil
+	}
+	f.enabled = false
+	f.paused = false
+	f.localNets = nil
+	f.tunnels = make(map[string]ruleSetTunnel)
+	if err := f.sync(); err != nil {
+		return err
+	}
+	f.logger.Verbosef("Firewall cleaned up and kill switch disabled")
+	return nil
+}
+
+func (f *ruleSetFirewall) AllowLocalNetworks(prefixes []netip.Prefix) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.enabled {
+		return errors.New("kill switch must be enabled to allow local networks")
+	}
+	f.localNets = slices.Clone(prefixes)
+	return f.sync()
+}
+
+func (f *ruleSetFirewall) RemoveLocalNetworks() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.localNets = nil
+	return f.sync()
+}
+
+func (f *ruleSetFirewall) IsAllowLocalNetworksEnabled() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.localNets != nil
+}
+
+func (f *ruleSetFirewall) SetTunnelPort(port uint16) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if slices.Contains(f.tunnelPorts, port) {
+		return nil
+	}
+	f.tunnelPorts = append(f.tunnelPorts, port)
+	return f.sync()
+}
+
+func (f *ruleSetFirewall) AddTunnelBypasses(iface string, bypassMark, bootstrapMark uint32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.enabled {
+		return errors.New("kill switch must be enabled to add tunnel bypasses")
+	}
+	tun := f.tunnels[iface]
+	tun.bypassMark, tun.bootstrapMark, tun.marksOnly = bypassMark, bootstrapMark, false
+	f.tunnels[iface] = tun
+	return f.sync()
+}
+
+func (f *ruleSetFirewall) AddMarkBypasses(iface string, bypassMark, bootstrapMark uint32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.enabled {
+		return errors.New("kill switch must be enabled to add tunnel bypasses")
+	}
+	f.tunnels[iface] = ruleSetTunnel{bypassMark: bypassMark, bootstrapMark: bootstrapMark, marksOnly: true}
+	return f.sync()
+}
+
+func (f *ruleSetFirewall) AllowExcludedRoutes(iface string, prefixes []netip.Prefix) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.enabled {
+		return errors.New("kill switch must be enabled to allow excluded routes")
+	}
+	tun := f.tunnels[iface]
+	tun.excluded = slices.Clone(prefixes)
+	f.tunnels[iface] = tun
+	return f.sync()
+}
+
+func (f *ruleSetFirewall) RemoveTunnelBypasses(iface string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.tunnels[iface]; !ok {
+		return nil
+	}
+	delete(f.tunnels, iface)
+	return f.sync()
+}
+
+// ResetTunnelBypasses is RemoveTunnelBypasses, the rules are always installed from our state.
+func (f *ruleSetFirewall) ResetTunnelBypasses(iface string) error {
+	return f.RemoveTunnelBypasses(iface)
+}
+
+// TunnelBypassesDrifted is covered by the rule set drift, the rules are always installed as a whole.
+func (f *ruleSetFirewall) TunnelBypassesDrifted(string) bool {
+	return false
+}
+
+// BlockIPv6 drops IPv6 leaving outside the tunnel, except local IPv6 and the tunnel's marked traffic, while an
+// IPv4-only full tunnel is up.
+func (f *ruleSetFirewall) BlockIPv6(iface string, bypassMark, bootstrapMark uint32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.v6Block[iface] = ruleSetTunnel{bypassMark: bypassMark, bootstrapMark: bootstrapMark}
+	return f.sync()
+}
+
+func (f *ruleSetFirewall) UnblockIPv6(iface string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.v6Block[iface]; !ok {
+		return nil
+	}
+	delete(f.v6Block, iface)
+	return f.sync()
+}
+
+// SetExemptions replaces the exemptions, applied while the kill switch is enabled.
+func (f *ruleSetFirewall) SetExemptions(exemptions []firewall.Exemption) error {
+	for _, e := range exemptions {
+		if err := e.Validate(); err != nil {
+			return err
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.exemptions = slices.Clone(exemptions)
+	return f.sync()
+}
+
+func (f *ruleSetFirewall) Exemptions() []firewall.Exemption {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.exemptions)
+}
+
+// AllowDomain replaces the domain's allowed addresses. Without kernel timeouts, expired addresses are dropped on the
+// next change of the rule set, the caller's refresh.
+func (f *ruleSetFirewall) AllowDomain(domain string, addrs []netip.Addr, ttl time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.domains[domain] = domainAddrs{addrs: slices.Clone(addrs), expires: time.Now().Add(ttl)}
+	return f.sync()
+}
+
+func (f *ruleSetFirewall) RemoveDomain(domain string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.domains[domain]; !ok {
+		return nil
+	}
+	delete(f.domains, domain)
+	return f.sync()
+}
+
+// PauseKillSwitch lets web and DNS traffic through the kill switch.
+func (f *ruleSetFirewall) PauseKillSwitch() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.enabled {
+		return errors.New("kill switch must be enabled to pause it")
+	}
+	f.paused = true
+	return f.sync()
+}
+
+func (f *ruleSetFirewall) ResumeKillSwitch() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.paused {
+		return nil
+	}
+	f.paused = false
+	return f.sync()
+}
+
+func (f *ruleSetFirewall) IsKillSwitchPaused() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.paused
+}
+
+// ruleSetDrifted reports whether rules of the rule set are missing from the backend.
+func (f *ruleSetFirewall) ruleSetDrifted() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rules := f.rules()
+	return len(rules) > 0 && f.applier.missing(rules)
+}
+
+// resync installs the rule set again.
+func (f *ruleSetFirewall) resync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sync()
+}
+
+// sync installs the rule set of the current state, or removes our chains when it is empty. Callers hold f.mu.
+func (f *ruleSetFirewall) sync() error {
+	rules := f.rules()
+	if len(rules) == 0 {
+		f.applier.remove()
+		return nil
+	}
+	return f.applier.apply(rules)
+}
+
+// rules returns the rule set of the current state in priority order. The kill switch mirrors the nftables one,
+// without it the IPv6 block gets the output chain of its own.
+func (f *ruleSetFirewall) rules() []ruleSpec {
+	var rules []ruleSpec
+	var lan, tun string
+	if f.sharing != nil {
+		lan, tun = f.sharing()
+	}
+
+	ipvs := []string{"ipv4"}
+	if f.v6Available {
+		ipvs = append(ipvs, "ipv6")
+	}
+	for _, ipv := range ipvs {
+		v6 := ipv == "ipv6"
+		accept := func(chain string, args ...string) {
+			rules = append(rules, ruleSpec{ipv, chain, specPrioAccept, append(args, "-j", "ACCEPT")})
+		}
+		drop := func(chain string) {
+			rules = append(rules, ruleSpec{ipv, chain, specPrioDrop, []string{"-j", "DROP"}})
+		}
+		acceptMarks := func(marks ...uint32) {
+			for _, m := range marks {
+				if m != 0 {
+					accept(chainNameOutput, "-m", "mark", "--mark", fmt.Sprintf("%#x/%#x", m, mark.MaskFor(m)))
+				}
+			}
+		}
+		acceptDst := func(prefixes []netip.Prefix) {
+			for _, p := range prefixes {
+				if p.Addr().Is6() == v6 {
+					accept(chainNameOutput, "-d", p.Masked().String())
+				}
+			}
+		}
+
+		if !f.enabled {
+			if !v6 || len(f.v6Block) == 0 {
+				continue
+			}
+			accept(chainNameOutput, "-o", "lo")
+			acceptDst(v6BlockLocal)
+			for _, iface := range slices.Sorted(maps.Keys(f.v6Block)) {
+				t := f.v6Block[iface]
+				accept(chainNameOutput, "-o", iface)
+				acceptMarks(t.bypassMark, t.bootstrapMark)
+			}
+			drop(chainNameOutput)
+			continue
+		}
+
+		accept(chainNameInput, "-i", "lo")
+		accept(chainNameInput, "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED")
+		for _, port := range f.tunnelPorts {
+			accept(chainNameInput, "-p", "udp", "--dport", strconv.Itoa(int(port)))
+		}
+
+		accept(chainNameOutput, "-o", "lo")
+		acceptMarks(mark.LinuxBypassMarkNum)
+		for _, iface := range slices.Sorted(maps.Keys(f.tunnels)) {
+			t := f.tunnels[iface]
+			if !t.marksOnly {
+				accept(chainNameOutput, "-o", iface)
+			}
+			acceptMarks(t.bootstrapMark)
+			if t.bypassMark != mark.LinuxBypassMarkNum {
+				acceptMarks(t.bypassMark)
+			}
+			acceptDst(t.excluded)
+		}
+		acceptDst(f.localNets)
+		for _, domain := range slices.Sorted(maps.Keys(f.domains)) {
+			if d := f.domains[domain]; d.expires.After(time.Now()) {
+				for _, addr := range d.addrs {
+					acceptDst([]netip.Prefix{netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())})
+				}
+			}
+		}
+		for _, e := range f.exemptions {
+			if e.UID != nil {
+				accept(chainNameOutput, "-m", "owner", "--uid-owner", strconv.FormatUint(uint64(*e.UID), 10))
+			} else {
+				accept(chainNameOutput, "-m", "cgroup", "--path", e.CgroupPath())
+			}
+		}
+		if daemon, err := daemonCgroup(); err == nil {
+			accept(chainNameOutput, "-m", "cgroup", "--path", daemon, "-m", "mark", "--mark",
+				fmt.Sprintf("%#x/%#x", mark.LinuxBootstrapMarkNum, mark.MaskFor(mark.LinuxBootstrapMarkNum)))
+		}
+		if f.paused {
+			for _, p := range firewall.PausePorts {
+				accept(chainNameOutput, "-p", p.Proto, "--dport", strconv.Itoa(int(p.Port)))
+			}
+		}
+
+		if lan != "" {
+			accept(chainNameForward, "-i", lan, "-o", tun)
+			accept(chainNameForward, "-i", tun, "-o", lan, "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED")
+		}
+
+		drop(chainNameInput)
+		drop(chainNameOutput)
+		drop(chainNameForward)
+	}
+
+	slices.SortStableFunc(rules, func(a, b ruleSpec) int { return cmp.Compare(a.priority, b.priority) })
+	return rules
+}
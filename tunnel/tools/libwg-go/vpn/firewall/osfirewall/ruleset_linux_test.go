@@ -0,0 +1,202 @@
+//go:build linux && !android
+
+package osfirewall
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+	"github.com/wgtunnel/desktop/tunnel/vpn/firewall"
+)
+
+// ruleLines formats the rule set as "ipv chain priority args", without the daemon's own exemption which depends on
+// the test's cgroup.
+func ruleLines(rules []ruleSpec) []string {
+	var lines []string
+	for _, r := range rules {
+		if slices.Contains(r.args, "--path") && slices.Contains(r.args, "--mark") {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s %s %d %s", r.ipv, r.chain, r.priority, strings.Join(r.args, " ")))
+	}
+	return lines
+}
+
+func TestRuleSetRules(t *testing.T) {
+	uid := uint32(1000)
+	killSwitch := []string{
+		"ipv4 wgtunnel-input 0 -i lo -j ACCEPT",
+		"ipv4 wgtunnel-input 0 -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT",
+		"ipv4 wgtunnel-output 0 -o lo -j ACCEPT",
+		"ipv4 wgtunnel-output 0 -m mark --mark 0x100000/0xff0000 -j ACCEPT",
+	}
+	drops := []string{
+		"ipv4 wgtunnel-input 100 -j DROP",
+		"ipv4 wgtunnel-output 100 -j DROP",
+		"ipv4 wgtunnel-forward 100 -j DROP",
+	}
+
+	tests := []struct {
+		name  string
+		v6    bool
+		setup func(f *ruleSetFirewall)
+		want  []string
+	}{
+		{
+			name:  "nothing enabled",
+			setup: func(*ruleSetFirewall) {},
+		},
+		{
+			name:  "kill switch without tunnels",
+			setup: func(f *ruleSetFirewall) { f.enabled = true },
+			want:  slices.Concat(killSwitch, drops),
+		},
+		{
+			name: "tunnel with excluded routes, port and local networks",
+			setup: func(f *ruleSetFirewall) {
+				f.enabled = true
+				f.tunnelPorts = []uint16{51820}
+				f.localNets = []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24")}
+				f.tunnels["wg0"] = ruleSetTunnel{
+					bypassMark:    0x100000,
+					bootstrapMark: 0x200000,
+					excluded:      []netip.Prefix{netip.MustParsePrefix("203.0.113.7/24"), netip.MustParsePrefix("fd00::/8")},
+				}
+			},
+			want: slices.Concat(killSwitch[:2], []string{
+				"ipv4 wgtunnel-input 0 -p udp --dport 51820 -j ACCEPT",
+			}, killSwitch[2:], []string{
+				"ipv4 wgtunnel-output 0 -o wg0 -j ACCEPT",
+				"ipv4 wgtunnel-output 0 -m mark --mark 0x200000/0xff0000 -j ACCEPT",
+				"ipv4 wgtunnel-output 0 -d 203.0.113.0/24 -j ACCEPT",
+				"ipv4 wgtunnel-output 0 -d 192.168.1.0/24 -j ACCEPT",
+			}, drops),
+		},
+		{
+			name: "custom FwMark is let through",
+			setup: func(f *ruleSetFirewall) {
+				f.enabled = true
+				f.tunnels["wg0"] = ruleSetTunnel{bypassMark: 0xca6c, bootstrapMark: 0x200000}
+			},
+			want: slices.Concat(killSwitch, []string{
+				"ipv4 wgtunnel-output 0 -o wg0 -j ACCEPT",
+				"ipv4 wgtunnel-output 0 -m mark --mark 0x200000/0xff0000 -j ACCEPT",
+				"ipv4 wgtunnel-output 0 -m mark --mark 0xca6c/0xffffffff -j ACCEPT",
+			}, drops),
+		},
+		{
+			name: "paused tunnel keeps its marks only",
+			setup: func(f *ruleSetFirewall) {
+				f.enabled = true
+				f.tunnels["wg0"] = ruleSetTunnel{bypassMark: 0xca6c, bootstrapMark: 0x200000, marksOnly: true}
+			},
+			want: slices.Concat(killSwitch, []string{
+				"ipv4 wgtunnel-output 0 -m mark --mark 0x200000/0xff0000 -j ACCEPT",
+				"ipv4 wgtunnel-output 0 -m mark --mark 0xca6c/0xffffffff -j ACCEPT",
+			}, drops),
+		},
+		{
+			name: "unexpired domains and exemptions",
+			setup: func(f *ruleSetFirewall) {
+				f.enabled = true
+				f.exemptions = []firewall.Exemption{{UID: &uid}}
+				f.domains["portal.example"] = domainAddrs{
+					addrs:   []netip.Addr{netip.MustParseAddr("198.51.100.7")},
+					expires: time.Now().Add(time.Minute),
+				}
+				f.domains["stale.example"] = domainAddrs{
+					addrs:   []netip.Addr{netip.MustParseAddr("198.51.100.8")},
+					expires: time.Now().Add(-time.Minute),
+				}
+			},
+			want: slices.Concat(killSwitch, []string{
+				"ipv4 wgtunnel-output 0 -d 198.51.100.7/32 -j ACCEPT",
+				"ipv4 wgtunnel-output 0 -m owner --uid-owner 1000 -j ACCEPT",
+			}, drops),
+		},
+		{
+			name: "paused with sharing",
+			setup: func(f *ruleSetFirewall) {
+				f.enabled = true
+				f.paused = true
+				f.sharing = func() (string, string) { return "eth1", "wg0" }
+			},
+			want: slices.Concat(killSwitch, []string{
+				"ipv4 wgtunnel-output 0 -p tcp --dport 80 -j ACCEPT",
+				"ipv4 wgtunnel-output 0 -p tcp --dport 443 -j ACCEPT",
+				"ipv4 wgtunnel-output 0 -p udp --dport 53 -j ACCEPT",
+				"ipv4 wgtunnel-output 0 -p tcp --dport 53 -j ACCEPT",
+				"ipv4 wgtunnel-forward 0 -i eth1 -o wg0 -j ACCEPT",
+				"ipv4 wgtunnel-forward 0 -i wg0 -o eth1 -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT",
+			}, drops),
+		},
+		{
+			name: "IPv6 block without the kill switch",
+			v6:   true,
+			setup: func(f *ruleSetFirewall) {
+				f.v6Block["wg0"] = ruleSetTunnel{bypassMark: 0x100000, bootstrapMark: 0x200000}
+			},
+			want: []string{
+				"ipv6 wgtunnel-output 0 -o lo -j ACCEPT",
+				"ipv6 wgtunnel-output 0 -d fe80::/10 -j ACCEPT",
+				"ipv6 wgtunnel-output 0 -d fc00::/7 -j ACCEPT",
+				"ipv6 wgtunnel-output 0 -d ff00::/8 -j ACCEPT",
+				"ipv6 wgtunnel-output 0 -o wg0 -j ACCEPT",
+				"ipv6 wgtunnel-output 0 -m mark --mark 0x100000/0xff0000 -j ACCEPT",
+				"ipv6 wgtunnel-output 0 -m mark --mark 0x200000/0xff0000 -j ACCEPT",
+				"ipv6 wgtunnel-output 100 -j DROP",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newRuleSetFirewall(device.NewLogger(device.LogLevelSilent, ""), tt.v6, nil)
+			tt.setup(f)
+			if got := ruleLines(f.rules()); !slices.Equal(got, tt.want) {
+				t.Errorf("rules() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestRuleSetRulesBothFamilies(t *testing.T) {
+	f := newRuleSetFirewall(device.NewLogger(device.LogLevelSilent, ""), true, nil)
+	f.enabled = true
+	rules := f.rules()
+
+	// drops sort after every accept, across families
+	last := slices.IndexFunc(rules, func(r ruleSpec) bool { return r.priority == specPrioDrop })
+	if last < 0 || slices.ContainsFunc(rules[last:], func(r ruleSpec) bool { return r.priority != specPrioDrop }) {
+		t.Fatalf("accepts after drops: %v", ruleLines(rules))
+	}
+	for _, ipv := range []string{"ipv4", "ipv6"} {
+		drops := 0
+		for _, r := range rules {
+			if r.ipv == ipv && r.priority == specPrioDrop {
+				drops++
+			}
+		}
+		if drops != 3 {
+			t.Errorf("%s has %d drops, want 3", ipv, drops)
+		}
+	}
+}
+
+// fakeApplier keeps the rule set last applied.
+type fakeApplier struct {
+	rules []ruleSpec
+}
+
+func (a *fakeApplier) apply(rules []ruleSpec) error {
+	a.rules = rules
+	return nil
+}
+
+func (a *fakeApplier) remove() { a.rules = nil }
+
+func (a *fakeApplier) missing([]ruleSpec) bool { return false }
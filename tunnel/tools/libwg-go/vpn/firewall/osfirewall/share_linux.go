@@ -0,0 +1,224 @@
+//go:build linux && !android
+
+package osfirewall
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// ipForwardSysctl enables IPv4 forwarding. IPv6 is not shared, forwarding there makes the kernel ignore router
+// advertisements on every interface and would break the host's own IPv6.
+const ipForwardSysctl = "/proc/sys/net/ipv4/ip_forward"
+
+// shareState is the LAN interface shared into a tunnel, and the forwarding sysctl to restore.
+type shareState struct {
+	lanIface   string
+	tunIface   string
+	ipForward  string
+	savedValue bool
+}
+
+// EnableSharing forwards traffic from the LAN interface into the tunnel, masqueraded behind the tunnel address, and
+// drops anything else forwarded from the LAN so shared devices never leave through the physical uplink. It replaces
+// any previous sharing.
+func (f *LinuxFirewall) EnableSharing(lanIface, tunIface string) error {
+	if lanIface == "" || tunIface == "" || lanIface == tunIface {
+		return errors.New("sharing needs distinct LAN and tunnel interfaces")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.share.lanIface != "" {
+		f.removeSharingRules()
+	}
+	if !f.share.savedValue {
+		value, err := os.ReadFile(ipForwardSysctl)
+		if err != nil {
+			return fmt.Errorf("read ip_forward: %w", err)
+		}
+		f.share.ipForward = strings.TrimSpace(string(value))
+		f.share.savedValue = true
+	}
+
+	f.share.lanIface, f.share.tunIface = lanIface, tunIface
+	if err := f.addSharingRules(); err != nil {
+		f.removeSharingRules()
+		f.share.lanIface, f.share.tunIface = "", ""
+		f.restoreIPForward()
+		return err
+	}
+	if err := os.WriteFile(ipForwardSysctl, []byte("1\n"), 0644); err != nil {
+		f.removeSharingRules()
+		f.share.lanIface, f.share.tunIface = "", ""
+		f.restoreIPForward()
+		return fmt.Errorf("enable ip_forward: %w", err)
+	}
+
+	f.logger.Verbosef("Sharing tunnel %s with %s", tunIface, lanIface)
+	return nil
+}
+
+// DisableSharing removes the sharing rules and restores ip_forward.
+func (f *LinuxFirewall) DisableSharing() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.share.lanIface == "" {
+		return nil
+	}
+	f.removeSharingRules()
+	f.logger.Verbosef("Stopped sharing tunnel %s with %s", f.share.tunIface, f.share.lanIface)
+	f.share.lanIface, f.share.tunIface = "", ""
+	return f.restoreIPForward()
+}
+
+// SharingIfaces returns the shared LAN and tunnel interfaces, empty when not sharing.
+func (f *LinuxFirewall) SharingIfaces() (lanIface, tunIface string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.share.lanIface, f.share.tunIface
+}
+
+// reapplySharing restores the sharing rules after the kill switch tables were deleted.
+func (f *LinuxFirewall) reapplySharing() {
+	if f.share.lanIface == "" {
+		return
+	}
+	if err := f.addSharingRules(); err != nil {
+		f.logger.Errorf("Failed to restore sharing rules: %v", err)
+	}
+}
+
+func (f *LinuxFirewall) restoreIPForward() error {
+	if !f.share.savedValue {
+		return nil
+	}
+	f.share.savedValue = false
+	if err := os.WriteFile(ipForwardSysctl, []byte(f.share.ipForward+"\n"), 0644); err != nil {
+		return fmt.Errorf("restore ip_forward: %w", err)
+	}
+	return nil
+}
+
+// addSharingRules installs the forward and masquerade rules, creating our chains if the kill switch is off. The
+// forward rules go on top, ahead of the kill switch's drop.
+func (f *LinuxFirewall) addSharingRules() error {
+	if err := f.createChains(); err != nil {
+		return err
+	}
+
+	lan, tun := f.share.lanIface, f.share.tunIface
+	for _, table := range f.getTables() {
+		forwardChain, err := getChainFromTable(f.conn, table.Filter, chainNameForward)
+		if err != nil {
+			return fmt.Errorf("get forward chain: %w", err)
+		}
+		// inserted in reverse, each goes on top
+		f.conn.InsertRule(createIfaceRule(table.Filter, forwardChain, lan, "", expr.VerdictDrop))
+		f.conn.InsertRule(createEstablishedIfaceRule(table.Filter, forwardChain, tun, lan))
+		f.conn.InsertRule(createIfaceRule(table.Filter, forwardChain, lan, tun, expr.VerdictAccept))
+
+		if table.Proto != nftables.TableFamilyIPv4 {
+			continue
+		}
+		postroutingChain, err := getChainFromTable(f.conn, table.Nat, chainNamePostrouting)
+		if err != nil {
+			return fmt.Errorf("get postrouting chain: %w", err)
+		}
+		f.conn.AddRule(createMasqueradeRule(table.Nat, postroutingChain, lan, tun))
+	}
+	if err := f.conn.Flush(); err != nil {
+		return fmt.Errorf("flush after adding sharing rules: %w", err)
+	}
+	return nil
+}
+
+// removeSharingRules deletes the rules of the current sharing, ignoring ones already gone with the tables.
+func (f *LinuxFirewall) removeSharingRules() {
+	lan, tun := f.share.lanIface, f.share.tunIface
+	for _, table := range f.getTables() {
+		if table.Filter == nil {
+			continue
+		}
+		forwardChain, err := getChainFromTable(f.conn, table.Filter, chainNameForward)
+		if err != nil {
+			continue
+		}
+		templates := []*nftables.Rule{
+			createIfaceRule(table.Filter, forwardChain, lan, tun, expr.VerdictAccept),
+			createEstablishedIfaceRule(table.Filter, forwardChain, tun, lan),
+			createIfaceRule(table.Filter, forwardChain, lan, "", expr.VerdictDrop),
+		}
+		if table.Nat != nil {
+			if postroutingChain, err := getChainFromTable(f.conn, table.Nat, chainNamePostrouting); err == nil {
+				templates = append(templates, createMasqueradeRule(table.Nat, postroutingChain, lan, tun))
+			}
+		}
+		for _, rule := range templates {
+			if existing, _ := findRule(f.conn, rule); existing != nil {
+				f.conn.DelRule(existing)
+			}
+		}
+	}
+	if err := f.conn.Flush(); err != nil {
+		f.logger.Errorf("Failed to remove sharing rules: %v", err)
+	}
+}
+
+// ifaceExprs matches the input and, if set, the output interface.
+func ifaceExprs(iif, oif string) []expr.Any {
+	exprs := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte(iif + "\x00")},
+	}
+	if oif != "" {
+		exprs = append(exprs,
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte(oif + "\x00")},
+		)
+	}
+	return exprs
+}
+
+// createIfaceRule applies the verdict to traffic forwarded from iif, to oif if set.
+func createIfaceRule(table *nftables.Table, chain *nftables.Chain, iif, oif string, verdict expr.VerdictKind) *nftables.Rule {
+	return &nftables.Rule{
+		Table: table,
+		Chain: chain,
+		Exprs: append(ifaceExprs(iif, oif), &expr.Counter{}, &expr.Verdict{Kind: verdict}),
+	}
+}
+
+// createEstablishedIfaceRule accepts replies forwarded from iif to oif.
+func createEstablishedIfaceRule(table *nftables.Table, chain *nftables.Chain, iif, oif string) *nftables.Rule {
+	exprs := append(ifaceExprs(iif, oif),
+		&expr.Ct{Key: expr.CtKeySTATE, Register: 1},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           []byte{0x06, 0x00, 0x00, 0x00}, // ESTABLISHED (2) | RELATED (4)
+			Xor:            []byte{0x00, 0x00, 0x00, 0x00},
+		},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{0x00, 0x00, 0x00, 0x00}},
+		&expr.Counter{},
+		&expr.Verdict{Kind: expr.VerdictAccept},
+	)
+	return &nftables.Rule{Table: table, Chain: chain, Exprs: exprs}
+}
+
+// createMasqueradeRule masquerades traffic forwarded from iif out of oif.
+func createMasqueradeRule(table *nftables.Table, chain *nftables.Chain, iif, oif string) *nftables.Rule {
+	return &nftables.Rule{
+		Table: table,
+		Chain: chain,
+		Exprs: append(ifaceExprs(iif, oif), &expr.Counter{}, &expr.Masq{}),
+	}
+}
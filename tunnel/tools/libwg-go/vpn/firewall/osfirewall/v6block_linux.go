@@ -0,0 +1,108 @@
+//go:build linux && !android
+
+package osfirewall
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+const (
+	v6BlockTable        = "wgtunnel-v6block"
+	chainNameV6BlockOut = "wgtunnel-v6block-output"
+)
+
+// v6BlockOwned holds the IPv6 block, in the IPv6 family only
+var v6BlockOwned = ownedTable{
+	name:  v6BlockTable,
+	chain: chainNameV6BlockOut,
+	hook:  nftables.ChainHookOutput,
+	prio:  nftables.ChainPriorityFilter,
+}
+
+// v6BlockLocal is IPv6 that stays on the link and is never tunneled: link-local, unique local and multicast
+var v6BlockLocal = []netip.Prefix{
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// v6BlockTunnel is what an IPv4-only full tunnel lets through the IPv6 block.
+type v6BlockTunnel struct {
+	bypassMark    uint32
+	bootstrapMark uint32
+}
+
+// v6BlockState holds the IPv4-only full tunnels blocking IPv6.
+type v6BlockState struct {
+	tunnels map[string]v6BlockTunnel
+}
+
+// BlockIPv6 drops IPv6 leaving outside the tunnel, except local IPv6 and the tunnel's marked traffic, while an
+// IPv4-only full tunnel is up.
+func (f *LinuxFirewall) BlockIPv6(iface string, bypassMark, bootstrapMark uint32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.v6Block.tunnels == nil {
+		f.v6Block.tunnels = make(map[string]v6BlockTunnel)
+	}
+	tun := v6BlockTunnel{bypassMark: bypassMark, bootstrapMark: bootstrapMark}
+	if prev, ok := f.v6Block.tunnels[iface]; ok && prev == tun {
+		return nil
+	}
+	f.v6Block.tunnels[iface] = tun
+	return f.syncV6Block()
+}
+
+// UnblockIPv6 removes the tunnel's IPv6 block, the drops are removed with the last tunnel.
+func (f *LinuxFirewall) UnblockIPv6(iface string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.v6Block.tunnels[iface]; !ok {
+		return nil
+	}
+	delete(f.v6Block.tunnels, iface)
+	return f.syncV6Block()
+}
+
+// syncV6Block rebuilds the IPv6 block table in one transaction, or removes it when no tunnel blocks IPv6.
+func (f *LinuxFirewall) syncV6Block() error {
+	if len(f.v6Block.tunnels) == 0 || !f.v6Available {
+		return f.removeOwnedTables(v6BlockTable)
+	}
+
+	families := []nftables.TableFamily{nftables.TableFamilyIPv6}
+	err := f.syncOwnedTable(v6BlockOwned, families, func(t *nftables.Table, chain *nftables.Chain) error {
+		f.conn.AddRule(createOifnameAcceptRule(t, chain, "lo"))
+		for _, prefix := range v6BlockLocal {
+			rule, err := createRangeRule(t, chain, prefix, expr.VerdictAccept)
+			if err != nil {
+				return fmt.Errorf("create local IPv6 rule for %v: %w", prefix, err)
+			}
+			f.conn.AddRule(rule)
+		}
+
+		marks := make(map[uint32]bool)
+		for iface, tun := range f.v6Block.tunnels {
+			f.conn.AddRule(createOifnameAcceptRule(t, chain, iface))
+			for _, m := range []uint32{tun.bypassMark, tun.bootstrapMark} {
+				if m != 0 && !marks[m] {
+					marks[m] = true
+					f.conn.AddRule(createFwmarkRule(t, chain, m))
+				}
+			}
+		}
+		f.conn.AddRule(createDropRule(t, chain))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	f.logger.Verbosef("Blocking IPv6 outside %d tunnels", len(f.v6Block.tunnels))
+	return nil
+}
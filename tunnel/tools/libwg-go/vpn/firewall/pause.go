@@ -0,0 +1,19 @@
+package firewall
+
+// PausePorts is the traffic a paused kill switch lets out, enough to complete a captive portal.
+var PausePorts = []InboundPort{
+	{Proto: "tcp", Port: 80},
+	{Proto: "tcp", Port: 443},
+	{Proto: "udp", Port: 53},
+	{Proto: "tcp", Port: 53},
+}
+
+// Pauser is implemented by firewalls whose kill switch can be paused, letting only PausePorts out of the physical
+// interfaces until it's resumed.
+type Pauser interface {
+	PauseKillSwitch() error
+
+	ResumeKillSwitch() error
+
+	IsKillSwitchPaused() bool
+}
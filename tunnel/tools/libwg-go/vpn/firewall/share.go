@@ -0,0 +1,12 @@
+package firewall
+
+// Sharer is implemented by firewalls that can share a tunnel with a LAN interface.
+type Sharer interface {
+	// EnableSharing forwards the LAN interface's traffic into the tunnel with masquerade, replacing any previous sharing
+	EnableSharing(lanIface, tunIface string) error
+
+	DisableSharing() error
+
+	// SharingIfaces returns the shared LAN and tunnel interfaces, empty when not sharing
+	SharingIfaces() (lanIface, tunIface string)
+}
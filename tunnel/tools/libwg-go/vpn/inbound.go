@@ -0,0 +1,104 @@
+//go:build !android
+
+package vpn
+
+import "C"
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	wireproxyawg "github.com/artem-russkikh/wireproxy-awg"
+	"github.com/wgtunnel/desktop/tunnel/shared"
+	"github.com/wgtunnel/desktop/tunnel/vpn/firewall"
+	"github.com/wgtunnel/desktop/tunnel/vpn/firewall/osfirewall/firewallmgr"
+)
+
+// configInboundPolicy returns the config's inbound policy with InboundPeers, given by comment name or base64 public
+// key, resolved to their AllowedIPs.
+func configInboundPolicy(conf *wireproxyawg.Configuration, ifOpts interfaceOptions, names []string) firewall.InboundPolicy {
+	policy := ifOpts.inbound
+	for _, want := range ifOpts.inboundPeers {
+		wantKey := ""
+		if key, err := base64.StdEncoding.DecodeString(want); err == nil {
+			wantKey = hex.EncodeToString(key)
+		}
+		found := false
+		for i, peer := range conf.Device.Peers {
+			isName := i < len(names) && names[i] != "" && names[i] == strings.ToLower(want)
+			if !isName && (wantKey == "" || !strings.EqualFold(peer.PublicKey, wantKey)) {
+				continue
+			}
+			found = true
+			policy.AllowFrom = append(policy.AllowFrom, peer.AllowedIPs...)
+		}
+		if !found {
+			shared.LogWarn("InboundPeers: no peer %q", want)
+		}
+	}
+	return policy
+}
+
+// syncInboundPolicy applies the handle's inbound policy, one set through awgSetInboundPolicy overrides the config's.
+func (h *TunnelHandle) syncInboundPolicy() error {
+	policy := h.configInbound
+	if h.apiInbound != nil {
+		policy = *h.apiInbound
+	}
+	fw, err := firewallmgr.Get()
+	if err != nil {
+		return err
+	}
+	guard, ok := fw.(firewall.InboundGuard)
+	if !ok {
+		if policy.BlockNew {
+			return errors.New("inbound policies are not supported by this firewall")
+		}
+		return nil
+	}
+	return guard.SetInboundPolicy(h.ifName, policy)
+}
+
+// removeInboundPolicy lifts the handle's inbound policy.
+func (h *TunnelHandle) removeInboundPolicy() {
+	if h.ifName == "" {
+		return
+	}
+	fw, err := firewallmgr.Get()
+	if err != nil {
+		return
+	}
+	if guard, ok := fw.(firewall.InboundGuard); ok {
+		if err := guard.RemoveInboundPolicy(h.ifName); err != nil {
+			logger.Errorf("Remove inbound policy: %v", err)
+		}
+	}
+}
+
+//export awgSetInboundPolicy
+func awgSetInboundPolicy(tunnelHandle C.int, policy *C.char) C.int {
+	handle, ok := getHandle(int32(tunnelHandle))
+	if !ok {
+		shared.LogError("Tunnel is not up")
+		return C.int(-1)
+	}
+	// an empty policy goes back to the config's
+	var apiInbound *firewall.InboundPolicy
+	if raw := C.GoString(policy); raw != "" {
+		apiInbound = &firewall.InboundPolicy{}
+		if err := json.Unmarshal([]byte(raw), apiInbound); err != nil {
+			shared.LogError("Invalid inbound policy: %v", err)
+			return C.int(-1)
+		}
+	}
+	prev := handle.apiInbound
+	handle.apiInbound = apiInbound
+	if err := handle.syncInboundPolicy(); err != nil {
+		handle.apiInbound = prev
+		shared.LogError("Failed to set inbound policy: %v", err)
+		return C.int(-1)
+	}
+	return C.int(0)
+}
@@ -0,0 +1,271 @@
+//go:build !android
+
+package vpn
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/wgtunnel/desktop/tunnel/allowedips"
+	"github.com/wgtunnel/desktop/tunnel/vpn/firewall"
+	"github.com/wgtunnel/desktop/tunnel/vpn/router"
+)
+
+// rtTableMain is the kernel's main routing table, spelled out as wg-quick accepts Table = main
+const rtTableMain = 254
+
+// interfaceOptions holds the wg-quick [Interface] keys that wireproxy-awg does not model.
+type interfaceOptions struct {
+	table       int
+	fwMark      uint32
+	excludedIPs []netip.Prefix
+
+	// dnsForwarder serves the tunnel's DNS from an in-process forwarder on loopback
+	dnsForwarder bool
+	// dnsUpstreams replace the DNS servers as the forwarder's upstreams, e.g. https:// or tls:// resolvers
+	dnsUpstreams []string
+	// dnsCacheSize is the forwarder's cache size in bytes, -1 when unset
+	dnsCacheSize int
+
+	// inbound restricts new connections arriving from the tunnel
+	inbound firewall.InboundPolicy
+	// inboundPeers are names or public keys of peers whose AllowedIPs may connect in
+	inboundPeers []string
+
+	// driftAction is what the router does when its routing or firewall state is removed by someone else
+	driftAction router.DriftAction
+
+	// precedence orders the tunnel among the others up, see router.Config.Precedence
+	precedence int
+
+	// pauseBlock keeps the kill switch up while the tunnel is paused, even one only the tunnel enabled
+	pauseBlock bool
+
+	// resolved by router preflight, not wg-quick keys
+	bootstrapMark uint32
+	rulePriority  int
+}
+
+// withResolved returns the options with the values the router's preflight resolved.
+func (o interfaceOptions) withResolved(c *router.Config) interfaceOptions {
+	if c == nil {
+		return o
+	}
+	o.table = c.Table
+	o.fwMark = c.FwMark
+	o.bootstrapMark = c.BootstrapMark
+	o.rulePriority = c.RulePriority
+	return o
+}
+
+// parseInterfaceOptions reads Table, FwMark, ExcludedIPs, OnDrift, Precedence, PauseKillSwitch, the DNS forwarder and
+// the inbound policy keys from the [Interface] section of a wg-quick config.
+func parseInterfaceOptions(settings string) (interfaceOptions, error) {
+	opts := interfaceOptions{dnsCacheSize: -1}
+	inInterface := false
+
+	scanner := bufio.NewScanner(strings.NewReader(settings))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			inInterface = strings.EqualFold(line, "[Interface]")
+			continue
+		}
+		if !inInterface {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+
+		var err error
+		switch strings.ToLower(key) {
+		case "table":
+			opts.table, err = parseTable(value)
+		case "fwmark":
+			opts.fwMark, err = parseFwMark(value)
+		case "excludedips":
+			var excluded []netip.Prefix
+			excluded, err = parsePrefixList(value)
+			opts.excludedIPs = append(opts.excludedIPs, excluded...)
+		case "dnsforwarder":
+			opts.dnsForwarder, err = parseBool(key, value)
+		case "dnsupstreams":
+			opts.dnsUpstreams = append(opts.dnsUpstreams, parseList(value)...)
+		case "dnscachesize":
+			opts.dnsCacheSize, err = parseSize(key, value)
+		case "blockinbound":
+			opts.inbound.BlockNew, err = parseBool(key, value)
+		case "inboundports":
+			var ports []firewall.InboundPort
+			ports, err = firewall.ParseInboundPorts(value)
+			opts.inbound.Ports = append(opts.inbound.Ports, ports...)
+		case "inboundpeers":
+			opts.inboundPeers = append(opts.inboundPeers, parseList(value)...)
+		case "ondrift":
+			opts.driftAction, err = router.ParseDriftAction(value)
+		case "precedence":
+			opts.precedence, err = parsePrecedence(value)
+		case "pausekillswitch":
+			opts.pauseBlock, err = parsePauseKillSwitch(value)
+		}
+		if err != nil {
+			return opts, err
+		}
+	}
+	return opts, scanner.Err()
+}
+
+// parseTable parses a wg-quick Table value: off, auto, main or a table number.
+func parseTable(value string) (int, error) {
+	switch strings.ToLower(value) {
+	case "", "auto":
+		return router.TableAuto, nil
+	case "off":
+		return router.TableOff, nil
+	case "main":
+		return rtTableMain, nil
+	}
+	table, err := strconv.ParseUint(value, 10, 31)
+	if err != nil || table == 0 {
+		return 0, fmt.Errorf("invalid Table %q", value)
+	}
+	return int(table), nil
+}
+
+// parsePrecedence parses a tunnel precedence from 0, the default, to router.MaxPrecedence.
+func parsePrecedence(value string) (int, error) {
+	precedence, err := strconv.ParseUint(value, 10, 31)
+	if err != nil || precedence > router.MaxPrecedence {
+		return 0, fmt.Errorf("invalid Precedence %q, want 0 to %d", value, router.MaxPrecedence)
+	}
+	return int(precedence), nil
+}
+
+// parsePauseKillSwitch parses allow, the default which lifts a kill switch only the tunnel enabled while paused, or
+// block which keeps it up.
+func parsePauseKillSwitch(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "", "allow":
+		return false, nil
+	case "block":
+		return true, nil
+	}
+	return false, fmt.Errorf("invalid PauseKillSwitch %q, want allow or block", value)
+}
+
+// parseFwMark parses a wg-quick FwMark value: off, auto, or a decimal or 0x prefixed hex mark.
+func parseFwMark(value string) (uint32, error) {
+	if value == "" || strings.EqualFold(value, "off") || strings.EqualFold(value, "auto") {
+		return 0, nil
+	}
+	fwMark, err := strconv.ParseUint(value, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid FwMark %q", value)
+	}
+	return uint32(fwMark), nil
+}
+
+// parseBool parses on/off style switches.
+func parseBool(key, value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "on", "true", "yes", "1":
+		return true, nil
+	case "", "off", "false", "no", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid %s %q", key, value)
+}
+
+// parseSize parses a non-negative byte count.
+func parseSize(key, value string) (int, error) {
+	size, err := strconv.ParseUint(value, 10, 31)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", key, value)
+	}
+	return int(size), nil
+}
+
+// parseList splits a comma separated list, dropping empty fields.
+func parseList(value string) []string {
+	var out []string
+	for _, field := range strings.Split(value, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			out = append(out, field)
+		}
+	}
+	return out
+}
+
+// parsePrefixList parses a comma separated list of CIDRs, bare addresses are taken as single host prefixes.
+func parsePrefixList(value string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, field := range strings.Split(value, ",") {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+		prefix, err := allowedips.ParsePrefix(field)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// splitDomains separates ~ prefixed routing domains from the search domains of the DNS list.
+func splitDomains(domains []string) (search, routing []string) {
+	for _, d := range domains {
+		if r, ok := strings.CutPrefix(d, "~"); ok {
+			if r != "" {
+				routing = append(routing, r)
+			}
+			continue
+		}
+		search = append(search, d)
+	}
+	return search, routing
+}
+
+// parsePeerNames returns the comment name of each [Peer] section in order, "" for peers without one. Names are
+// given as a "# Name = build-box" comment in the section.
+func parsePeerNames(settings string) []string {
+	var names []string
+	inPeer := false
+
+	scanner := bufio.NewScanner(strings.NewReader(settings))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			inPeer = strings.EqualFold(line, "[Peer]")
+			if inPeer {
+				names = append(names, "")
+			}
+			continue
+		}
+		comment, ok := strings.CutPrefix(line, "#")
+		if !inPeer || !ok {
+			continue
+		}
+		key, value, ok := strings.Cut(comment, "=")
+		if !ok {
+			key, value, ok = strings.Cut(comment, ":")
+		}
+		if ok && strings.EqualFold(strings.TrimSpace(key), "name") {
+			names[len(names)-1] = strings.ToLower(strings.TrimSpace(value))
+		}
+	}
+	return names
+}
@@ -0,0 +1,88 @@
+//go:build !android
+
+package vpn
+
+import "C"
+import (
+	"github.com/wgtunnel/desktop/tunnel/shared"
+	"github.com/wgtunnel/desktop/tunnel/vpn/router"
+)
+
+// pause removes the tunnel's routes, DNS and kill switch bypasses while the device and its sessions stay up. The
+// kill switch is held per PauseKillSwitch.
+func (h *TunnelHandle) pause() error {
+	if h.paused.Load() {
+		return nil
+	}
+	if err := h.router.Set(h.pausedConfig()); err != nil {
+		return err
+	}
+	h.paused.Store(true)
+	return nil
+}
+
+// resume sets the tunnel's last config again.
+func (h *TunnelHandle) resume() error {
+	if !h.paused.Load() {
+		return nil
+	}
+	if err := h.router.Set(h.routerCfg); err != nil {
+		return err
+	}
+	h.paused.Store(false)
+	return nil
+}
+
+// pausedConfig is the router config of the paused tunnel, keeping the marks its device still sends with.
+func (h *TunnelHandle) pausedConfig() *router.Config {
+	return &router.Config{
+		FwMark:         h.routerCfg.FwMark,
+		BootstrapMark:  h.routerCfg.BootstrapMark,
+		HoldKillSwitch: h.pauseBlock,
+	}
+}
+
+// reapply sets the handle's router state again, e.g. after a failed switch's tunnel removed state they shared.
+func (h *TunnelHandle) reapply() error {
+	if h.paused.Load() {
+		return h.router.Set(h.pausedConfig())
+	}
+	return h.router.Set(h.routerCfg)
+}
+
+//export awgPause
+func awgPause(tunnelHandle C.int) C.int {
+	handle, ok := getHandle(int32(tunnelHandle))
+	if !ok {
+		shared.LogError("Tunnel is not up")
+		return C.int(-1)
+	}
+	if err := handle.pause(); err != nil {
+		shared.LogError("Failed to pause tunnel: %v", err)
+		return C.int(-1)
+	}
+	return C.int(0)
+}
+
+//export awgResume
+func awgResume(tunnelHandle C.int) C.int {
+	handle, ok := getHandle(int32(tunnelHandle))
+	if !ok {
+		shared.LogError("Tunnel is not up")
+		return C.int(-1)
+	}
+	if err := handle.resume(); err != nil {
+		shared.LogError("Failed to resume tunnel: %v", err)
+		return C.int(-1)
+	}
+	return C.int(0)
+}
+
+//export awgIsPaused
+func awgIsPaused(tunnelHandle C.int) C.int {
+	handle, ok := getHandle(int32(tunnelHandle))
+	if !ok || !handle.paused.Load() {
+		return C.int(0)
+	}
+	return C.int(1)
+}
@@ -0,0 +1,75 @@
+//go:build !android
+
+package vpn
+
+import "C"
+import (
+	"encoding/json"
+	"maps"
+	"net/netip"
+
+	wireproxyawg "github.com/artem-russkikh/wireproxy-awg"
+	"github.com/wgtunnel/desktop/tunnel/shared"
+	vpndns "github.com/wgtunnel/desktop/tunnel/vpn/dns"
+)
+
+// configPeerNames maps the comment names of the peers to their single host AllowedIPs, the addresses the peers have
+// inside the tunnel.
+func configPeerNames(conf *wireproxyawg.Configuration, names []string) map[string][]netip.Addr {
+	out := make(map[string][]netip.Addr)
+	for i, name := range names {
+		if name == "" || i >= len(conf.Device.Peers) {
+			continue
+		}
+		if !vpndns.ValidHostName(name) {
+			shared.LogWarn("Ignoring invalid peer name %q", name)
+			continue
+		}
+		for _, p := range conf.Device.Peers[i].AllowedIPs {
+			if p.IsSingleIP() {
+				out[name] = append(out[name], p.Addr())
+			}
+		}
+		if len(out[name]) == 0 {
+			logger.Verbosef("Peer %q has no single host AllowedIPs to name", name)
+		}
+	}
+	return out
+}
+
+// syncPeerNames writes the handle's peer names to its hosts file block, names set through awgSetPeerNames override
+// the ones from the config.
+func (h *TunnelHandle) syncPeerNames() error {
+	names := maps.Clone(h.configNames)
+	if names == nil {
+		names = make(map[string][]netip.Addr)
+	}
+	maps.Copy(names, h.apiNames)
+	return vpndns.SetHosts(h.ifName, names)
+}
+
+//export awgSetPeerNames
+func awgSetPeerNames(tunnelHandle C.int, names *C.char) C.int {
+	handle, ok := getHandle(int32(tunnelHandle))
+	if !ok {
+		shared.LogError("Tunnel is not up")
+		return C.int(-1)
+	}
+	var apiNames map[string][]netip.Addr
+	if err := json.Unmarshal([]byte(C.GoString(names)), &apiNames); err != nil {
+		shared.LogError("Invalid peer names: %v", err)
+		return C.int(-1)
+	}
+	for name := range apiNames {
+		if !vpndns.ValidHostName(name) {
+			shared.LogError("Invalid peer name %q", name)
+			return C.int(-1)
+		}
+	}
+	handle.apiNames = apiNames
+	if err := handle.syncPeerNames(); err != nil {
+		shared.LogError("Failed to set peer names: %v", err)
+		return C.int(-1)
+	}
+	return C.int(0)
+}
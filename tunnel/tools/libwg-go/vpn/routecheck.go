@@ -0,0 +1,57 @@
+//go:build !android
+
+package vpn
+
+import "C"
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/wgtunnel/desktop/tunnel/shared"
+	"github.com/wgtunnel/desktop/tunnel/vpn/router"
+)
+
+// strictRouteCheck refuses to start tunnels whose routes collide with the live routing table
+var strictRouteCheck atomic.Bool
+
+// checkRoutes logs and records the route warnings for the handle, failing in strict mode.
+func checkRoutes(h *TunnelHandle, cfg *router.Config) error {
+	warnings, err := h.router.CheckRoutes(cfg)
+	if err != nil {
+		// the check is advisory, don't block the tunnel on a failed table read
+		logger.Errorf("Route check failed: %v", err)
+		return nil
+	}
+	for _, w := range warnings {
+		shared.LogWarn("Route collision: %s", w)
+	}
+	h.routeWarnings = warnings
+	if strictRouteCheck.Load() && len(warnings) > 0 {
+		return fmt.Errorf("strict route check: %d route collisions", len(warnings))
+	}
+	return nil
+}
+
+//export awgSetStrictRouteCheck
+func awgSetStrictRouteCheck(enabled C.int) {
+	strictRouteCheck.Store(enabled == 1)
+}
+
+//export awgGetRouteWarnings
+func awgGetRouteWarnings(tunnelHandle C.int) *C.char {
+	handle, ok := getHandle(int32(tunnelHandle))
+	if !ok {
+		return nil
+	}
+	warnings := handle.routeWarnings
+	if warnings == nil {
+		warnings = []router.RouteWarning{}
+	}
+	out, err := json.Marshal(warnings)
+	if err != nil {
+		logger.Errorf("Marshal route warnings: %v", err)
+		return nil
+	}
+	return C.CString(string(out))
+}
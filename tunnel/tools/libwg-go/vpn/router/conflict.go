@@ -0,0 +1,74 @@
+package router
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Severity is how serious a pre-flight finding is.
+type Severity int
+
+const (
+	// SeverityWarning findings are logged, the tunnel still starts.
+	SeverityWarning Severity = iota
+	// SeverityError findings refuse to start the tunnel.
+	SeverityError
+)
+
+func (s Severity) String() string {
+	if s == SeverityError {
+		return "error"
+	}
+	return "warning"
+}
+
+// ConflictKind is the resource another owner is already using.
+type ConflictKind string
+
+const (
+	ConflictTable    ConflictKind = "table"
+	ConflictFwMark   ConflictKind = "fwmark"
+	ConflictPriority ConflictKind = "priority"
+)
+
+// Conflict describes a routing table, fwmark or rule priority the tunnel wants that is already in use
+// by something other than this tunnel, e.g. another VPN.
+type Conflict struct {
+	Kind     ConflictKind
+	Severity Severity
+	// Value is the table id, mark or rule priority in conflict
+	Value uint32
+	// Detail names what else is using the value
+	Detail string
+}
+
+func (c Conflict) String() string {
+	return fmt.Sprintf("%s: %s %d (%#x) %s", c.Severity, c.Kind, c.Value, c.Value, c.Detail)
+}
+
+// ConflictError is returned when pre-flight finds conflicts of error severity.
+type ConflictError struct {
+	Conflicts []Conflict
+}
+
+func (e *ConflictError) Error() string {
+	parts := make([]string, 0, len(e.Conflicts))
+	for _, c := range e.Conflicts {
+		parts = append(parts, c.String())
+	}
+	return "routing conflicts: " + strings.Join(parts, "; ")
+}
+
+// ErrorsOf returns a ConflictError for the conflicts of error severity, or nil if there are none.
+func ErrorsOf(conflicts []Conflict) error {
+	var errs []Conflict
+	for _, c := range conflicts {
+		if c.Severity == SeverityError {
+			errs = append(errs, c)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return &ConflictError{Conflicts: errs}
+}
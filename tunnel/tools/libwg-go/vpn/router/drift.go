@@ -0,0 +1,55 @@
+package router
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DriftAction is what a router does when the routing or firewall state it applied is changed by someone else.
+type DriftAction int
+
+const (
+	// DriftReapply re-applies the intended state.
+	DriftReapply DriftAction = iota
+	// DriftAlert only reports the drift.
+	DriftAlert
+	// DriftFailClosed engages a persistent kill switch without the tunnel's bypasses, blocking all traffic until the
+	// tunnel is restarted.
+	DriftFailClosed
+)
+
+// ParseDriftAction parses reapply, alert or failclosed.
+func ParseDriftAction(value string) (DriftAction, error) {
+	switch strings.ToLower(strings.ReplaceAll(value, "-", "")) {
+	case "", "reapply":
+		return DriftReapply, nil
+	case "alert":
+		return DriftAlert, nil
+	case "failclosed":
+		return DriftFailClosed, nil
+	}
+	return 0, fmt.Errorf("invalid drift action %q", value)
+}
+
+func (a DriftAction) String() string {
+	switch a {
+	case DriftAlert:
+		return "alert"
+	case DriftFailClosed:
+		return "failclosed"
+	}
+	return "reapply"
+}
+
+// Drift reports state found missing and the action taken, Err is set if the action failed.
+type Drift struct {
+	Missing []string
+	Action  DriftAction
+	Err     error
+}
+
+// DriftWatcher is implemented by routers that watch the system for drift from the state they applied.
+type DriftWatcher interface {
+	// WatchDrift starts watching after the first Set, until Close. notify is called for every drift found.
+	WatchDrift(action DriftAction, notify func(Drift)) error
+}
@@ -0,0 +1,278 @@
+//go:build linux
+
+package osrouter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"github.com/wgtunnel/desktop/tunnel/vpn/router"
+	"golang.org/x/sys/unix"
+)
+
+// driftDebounce coalesces the burst of events of a firewall reload or a ruleset flush into one check
+const driftDebounce = 500 * time.Millisecond
+
+// driftWatch is a running drift watcher, stopped on Close.
+type driftWatch struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// WatchDrift watches nftables and the routing rules and routes for deletions, and checks our state against the
+// intended one held by the router and firewall after each burst.
+func (r *linuxRouter) WatchDrift(action router.DriftAction, notify func(router.Drift)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.drift != nil {
+		return errors.New("already watching for drift")
+	}
+
+	conn, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("nftables conn: %w", err)
+	}
+	monitor := nftables.NewMonitor(
+		nftables.WithMonitorAction(nftables.MonitorActionDel),
+		nftables.WithMonitorObject(nftables.MonitorObjectTables|nftables.MonitorObjectChains|nftables.MonitorObjectRules),
+	)
+	nftEvents, err := conn.AddMonitor(monitor)
+	if err != nil {
+		return fmt.Errorf("nftables monitor: %w", err)
+	}
+	sock, err := nl.Subscribe(unix.NETLINK_ROUTE,
+		unix.RTNLGRP_IPV4_ROUTE, unix.RTNLGRP_IPV6_ROUTE, unix.RTNLGRP_IPV4_RULE, unix.RTNLGRP_IPV6_RULE)
+	if err != nil {
+		_ = monitor.Close()
+		return fmt.Errorf("subscribe to route and rule changes: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	watch := &driftWatch{cancel: cancel, done: make(chan struct{})}
+	r.drift = watch
+
+	kick := make(chan struct{}, 1)
+	go func() {
+		for {
+			msgs, _, err := sock.Receive()
+			if err != nil {
+				if ctx.Err() == nil {
+					r.logger.Errorf("Route watch stopped: %v", err)
+				}
+				return
+			}
+			for _, m := range msgs {
+				if m.Header.Type == unix.RTM_DELROUTE || m.Header.Type == unix.RTM_DELRULE {
+					select {
+					case kick <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}
+	}()
+
+	go func() {
+		defer close(watch.done)
+		defer sock.Close()
+		defer monitor.Close()
+
+		timer := time.NewTimer(driftDebounce)
+		timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case _, ok := <-nftEvents:
+				if !ok {
+					nftEvents = nil
+					r.logger.Errorf("nftables watch stopped")
+					continue
+				}
+				timer.Reset(driftDebounce)
+			case <-kick:
+				timer.Reset(driftDebounce)
+			case <-timer.C:
+				r.checkDrift(action, notify)
+			}
+		}
+	}()
+
+	r.logger.Verbosef("Watching for drift, action %v", action)
+	return nil
+}
+
+// stopDriftWatch stops the watcher and waits for a running check to finish. Must be called without r.mu held.
+func (r *linuxRouter) stopDriftWatch() {
+	r.mu.Lock()
+	watch := r.drift
+	r.drift = nil
+	r.mu.Unlock()
+
+	if watch != nil {
+		watch.cancel()
+		<-watch.done
+	}
+}
+
+// checkDrift compares the live state against the intended one and acts on any drift.
+func (r *linuxRouter) checkDrift(action router.DriftAction, notify func(router.Drift)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.prevConfig == nil || r.failedClosed {
+		return
+	}
+	missing := r.fw.Drift()
+	// an idle router removed its bypasses on purpose
+	if !r.prevConfig.IsIdle() && r.fw.TunnelBypassesDrifted(r.iface) {
+		missing = append(missing, "tunnel bypasses")
+	}
+	missing = append(missing, r.routingDrift(r.prevConfig)...)
+	if len(missing) == 0 {
+		return
+	}
+
+	d := router.Drift{Missing: missing, Action: action}
+	switch action {
+	case router.DriftReapply:
+		d.Err = r.reapply()
+	case router.DriftFailClosed:
+		d.Err = r.failClosed()
+	}
+	r.logger.Errorf("State drift on %s, missing %v, action %v: %v", r.iface, missing, action, d.Err)
+	notify(d)
+}
+
+// reapply restores the firewall and then the routing state of the last config.
+func (r *linuxRouter) reapply() error {
+	c := r.prevConfig
+	if err := r.fw.Reconcile(); err != nil {
+		return err
+	}
+	if r.fw.TunnelBypassesDrifted(r.iface) {
+		if err := r.fw.ResetTunnelBypasses(r.iface); err != nil {
+			return err
+		}
+	}
+	if err := r.syncFirewallState(c); err != nil {
+		return err
+	}
+	link, err := netlink.LinkByName(r.iface)
+	if err != nil {
+		return fmt.Errorf("get link %s: %w", r.iface, err)
+	}
+	return r.syncRoutingAndRules(link, c)
+}
+
+// failClosed engages a persistent kill switch and removes the tunnel's bypasses, so nothing leaves until the tunnel
+// is restarted. Close restores the previous persistence.
+func (r *linuxRouter) failClosed() error {
+	r.failedClosed = true
+	r.persistBeforeFail = r.fw.IsPersistent()
+	r.fw.SetPersist(true)
+	if r.fw.IsEnabled() {
+		if err := r.fw.Reconcile(); err != nil {
+			return err
+		}
+	} else if err := r.fw.Enable(); err != nil {
+		return fmt.Errorf("enable firewall: %w", err)
+	}
+	return r.fw.ResetTunnelBypasses(r.iface)
+}
+
+// routingDrift returns the policy rules and routes of the config missing from the live system.
+func (r *linuxRouter) routingDrift(c *router.Config) []string {
+	if c.RoutesDisabled() || c.IsIdle() {
+		return nil
+	}
+	link, err := netlink.LinkByName(r.iface)
+	if err != nil {
+		return []string{"tunnel interface"}
+	}
+	policy := policyFor(c)
+
+	var missing []string
+	families := []int{netlink.FAMILY_V4}
+	if r.v6Available {
+		families = append(families, netlink.FAMILY_V6)
+	}
+	for _, fam := range families {
+		v4 := fam == netlink.FAMILY_V4
+		isFull := hasDefault(c, v4)
+		blockV6 := !v4 && blocksV6(c)
+
+		rules, err := netlink.RuleList(fam)
+		if err != nil {
+			continue
+		}
+		if isFull || blockV6 {
+			if !hasRule(rules, policy.prioMark, policy.bypassMark, unix.RT_TABLE_MAIN) ||
+				!hasRule(rules, policy.prioDefault, 0, policy.table) ||
+				!hasRule(rules, policy.prioBootstrap, policy.bootstrapMark, unix.RT_TABLE_MAIN) {
+				missing = append(missing, fmt.Sprintf("policy rules (family %d)", fam))
+			}
+		}
+		if blockV6 && !hasSuppressRule(rules, policy.prioSuppress) {
+			missing = append(missing, "IPv6 suppress rule")
+		}
+		routes := tunnelRoutes(c, v4)
+		if !isFull && len(routes) > 0 && policy.table != unix.RT_TABLE_MAIN &&
+			!hasRule(rules, policy.prioSplit, 0, policy.table) {
+			missing = append(missing, fmt.Sprintf("split tunnel rule (family %d)", fam))
+		}
+
+		live, err := netlink.RouteListFiltered(fam, &netlink.Route{Table: policy.table, LinkIndex: link.Attrs().Index},
+			netlink.RT_FILTER_TABLE|netlink.RT_FILTER_OIF)
+		if err != nil {
+			continue
+		}
+		dsts := make([]netip.Prefix, 0, len(live))
+		for _, rt := range live {
+			dsts = append(dsts, routeDst(rt, v4))
+		}
+		for _, want := range routes {
+			if !slices.Contains(dsts, want.Masked()) {
+				missing = append(missing, fmt.Sprintf("routes in table %d", policy.table))
+				break
+			}
+		}
+	}
+	return missing
+}
+
+// hasRule reports whether a rule with the priority, mark and table exists.
+func hasRule(rules []netlink.Rule, priority int, mark uint32, table int) bool {
+	return slices.ContainsFunc(rules, func(rule netlink.Rule) bool {
+		return rule.Priority == priority && rule.Mark == mark && rule.Table == table && rule.Dst == nil
+	})
+}
+
+// hasSuppressRule reports whether the main table rule suppressing default routes exists.
+func hasSuppressRule(rules []netlink.Rule, priority int) bool {
+	return slices.ContainsFunc(rules, func(rule netlink.Rule) bool {
+		return rule.Priority == priority && rule.Table == unix.RT_TABLE_MAIN && rule.SuppressPrefixlen == 0
+	})
+}
+
+// routeDst returns the route's destination, the default route of the family if it has none.
+func routeDst(rt netlink.Route, v4 bool) netip.Prefix {
+	if rt.Dst == nil {
+		if v4 {
+			return netip.PrefixFrom(netip.IPv4Unspecified(), 0)
+		}
+		return netip.PrefixFrom(netip.IPv6Unspecified(), 0)
+	}
+	addr, _ := netip.AddrFromSlice(rt.Dst.IP)
+	ones, _ := rt.Dst.Mask.Size()
+	return netip.PrefixFrom(addr.Unmap(), ones)
+}
@@ -0,0 +1,384 @@
+//go:build linux
+
+package osrouter
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"github.com/wgtunnel/desktop/tunnel/vpn/firewall/mark"
+	"github.com/wgtunnel/desktop/tunnel/vpn/router"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// markStep walks the free mark candidates one bit pattern at a time inside mark.LinuxFwmarkMaskNum
+	markStep = 0x010000
+	// maxRulePriority keeps picked priorities clear of the kernel's main (32766) and default (32767) rules
+	maxRulePriority = 32000
+	// rulePrioSpan is the distance from the bootstrap rule to the default tunnel rule
+	rulePrioSpan = rulePrioDefault - rulePrioBootstrap
+)
+
+// markUse is a mark matched or set by a rule we don't own.
+type markUse struct {
+	mark  uint32
+	mask  uint32
+	owner string
+}
+
+// systemPolicy is a snapshot of the policy routing state owned by others.
+type systemPolicy struct {
+	tables     map[int]string
+	priorities map[int]string
+	marks      []markUse
+}
+
+// Preflight inspects existing ip rules, route tables and nftables marks for values the config would clash with,
+// and resolves automatic table, mark and priority values to free ones.
+func (r *linuxRouter) Preflight(c *router.Config) (*router.Config, []router.Conflict, error) {
+	resolved := c.Clone()
+	if resolved == nil || resolved.RoutesDisabled() {
+		return resolved, nil, nil
+	}
+	if resolved.Table == unix.RT_TABLE_MAIN && (hasDefault(resolved, true) || hasDefault(resolved, false)) {
+		conflicts := []router.Conflict{mainTableConflict()}
+		return resolved, conflicts, router.ErrorsOf(conflicts)
+	}
+
+	sys, err := r.loadSystemPolicy()
+	if err != nil {
+		return nil, nil, fmt.Errorf("load system policy: %w", err)
+	}
+
+	var conflicts []router.Conflict
+	conflicts = append(conflicts, resolveTable(resolved, sys)...)
+	conflicts = append(conflicts, resolveMarks(resolved, sys)...)
+	conflicts = append(conflicts, resolvePriority(resolved, sys)...)
+	return resolved, conflicts, router.ErrorsOf(conflicts)
+}
+
+// loadSystemPolicy collects tables, rule priorities and marks in use, skipping rules that match our own default
+// or currently applied policy so a restart or re-Set does not conflict with itself. The tables and marks of the other
+// tunnels up are in use even where they match our default policy, their priorities are not: bands follow precedence
+// only, and tunnels of the same precedence share one.
+func (r *linuxRouter) loadSystemPolicy() (*systemPolicy, error) {
+	sys := &systemPolicy{
+		tables:     make(map[int]string),
+		priorities: make(map[int]string),
+	}
+	own := []routingPolicy{policyFor(nil)}
+	if r.prevConfig != nil {
+		own = append(own, policyFor(r.prevConfig))
+	}
+
+	families := []int{netlink.FAMILY_V4}
+	if r.v6Available {
+		families = append(families, netlink.FAMILY_V6)
+	}
+
+	others := otherTunnels(r.iface)
+	for _, fam := range families {
+		rules, err := netlink.RuleList(fam)
+		if err != nil {
+			return nil, fmt.Errorf("list rules fam %d: %w", fam, err)
+		}
+		for _, rule := range rules {
+			owner := fmt.Sprintf("used by ip rule priority %d", rule.Priority)
+			if tunnel := ruleTunnel(rule, others); tunnel != "" {
+				owner = "used by tunnel " + tunnel
+			} else if isOwnRule(rule, own) {
+				continue
+			} else if _, ok := sys.priorities[rule.Priority]; !ok {
+				sys.priorities[rule.Priority] = fmt.Sprintf("used by ip rule to table %d", rule.Table)
+			}
+			if !isReservedTable(rule.Table) {
+				sys.tables[rule.Table] = owner
+			}
+			if rule.Mark != 0 {
+				mask := uint32(0xffffffff)
+				if rule.Mask != nil {
+					mask = *rule.Mask
+				}
+				sys.marks = append(sys.marks, markUse{mark: rule.Mark, mask: mask, owner: owner})
+			}
+		}
+
+		routes, err := netlink.RouteListFiltered(fam, &netlink.Route{Table: unix.RT_TABLE_UNSPEC}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return nil, fmt.Errorf("list routes fam %d: %w", fam, err)
+		}
+		ownIndex := r.linkIndex()
+		for _, route := range routes {
+			if isReservedTable(route.Table) || route.LinkIndex == ownIndex {
+				continue
+			}
+			if _, ok := sys.tables[route.Table]; !ok {
+				sys.tables[route.Table] = "used by routes via " + linkName(route.LinkIndex)
+			}
+		}
+	}
+
+	marks, err := r.fw.ForeignMarks()
+	if err != nil {
+		// nftables may be unavailable, the ip rule marks are still checked
+		r.logger.Verbosef("list nftables marks: %v (ignored)", err)
+	}
+	for _, m := range marks {
+		sys.marks = append(sys.marks, markUse{mark: m.Mark, mask: m.Mask, owner: "used by nftables " + m.Owner})
+	}
+	return sys, nil
+}
+
+func (r *linuxRouter) linkIndex() int {
+	link, err := netlink.LinkByName(r.iface)
+	if err != nil {
+		return -1
+	}
+	return link.Attrs().Index
+}
+
+func linkName(index int) string {
+	link, err := netlink.LinkByIndex(index)
+	if err != nil {
+		return fmt.Sprintf("ifindex %d", index)
+	}
+	return link.Attrs().Name
+}
+
+// isReservedTable reports whether the table is one of the kernel's own, which are shared by design.
+func isReservedTable(table int) bool {
+	switch table {
+	case unix.RT_TABLE_UNSPEC, unix.RT_TABLE_DEFAULT, unix.RT_TABLE_MAIN, unix.RT_TABLE_LOCAL:
+		return true
+	}
+	return false
+}
+
+// isOwnRule reports whether the rule is one we install for any of the given policies.
+func isOwnRule(rule netlink.Rule, policies []routingPolicy) bool {
+	for _, p := range policies {
+		switch {
+		case rule.Priority == p.prioBootstrap && rule.Mark == p.bootstrapMark && rule.Table == unix.RT_TABLE_MAIN:
+			return true
+		case rule.Priority == p.prioMark && rule.Mark == p.bypassMark && rule.Table == unix.RT_TABLE_MAIN:
+			return true
+		case rule.Priority == p.prioExclude && rule.Dst != nil && rule.Table == unix.RT_TABLE_MAIN:
+			return true
+		case rule.Priority == p.prioSplit && rule.Mark == 0 && rule.Dst == nil && rule.Table == p.table:
+			return true
+		case rule.Priority == p.prioSuppress && rule.SuppressPrefixlen == 0 && rule.Table == unix.RT_TABLE_MAIN:
+			return true
+		case rule.Priority == p.prioDefault && rule.Mark == 0 && rule.Dst == nil && rule.Table == p.table:
+			return true
+		}
+	}
+	return false
+}
+
+// mainTableConflict is the error for a full tunnel with Table = main, whose default route would replace the main
+// table's one, so the marked encrypted traffic would loop back into the tunnel.
+func mainTableConflict() router.Conflict {
+	return router.Conflict{
+		Kind:     router.ConflictTable,
+		Severity: router.SeverityError,
+		Value:    unix.RT_TABLE_MAIN,
+		Detail:   "the main table can't take a default route through the tunnel, use Table = auto or a table number",
+	}
+}
+
+// resolveTable picks a free table for TableAuto, and reports an explicit table that is already in use.
+func resolveTable(c *router.Config, sys *systemPolicy) []router.Conflict {
+	if c.Table > 0 {
+		if owner, ok := sys.tables[c.Table]; ok {
+			return []router.Conflict{{
+				Kind:     router.ConflictTable,
+				Severity: router.SeverityError,
+				Value:    uint32(c.Table),
+				Detail:   owner,
+			}}
+		}
+		return nil
+	}
+
+	owner, taken := sys.tables[tunnelTableID]
+	if !taken {
+		c.Table = tunnelTableID
+		return nil
+	}
+	for table := tunnelTableID + 1; table < unix.RT_TABLE_DEFAULT; table++ {
+		if _, ok := sys.tables[table]; !ok {
+			c.Table = table
+			return []router.Conflict{{
+				Kind:     router.ConflictTable,
+				Severity: router.SeverityWarning,
+				Value:    tunnelTableID,
+				Detail:   fmt.Sprintf("%s, using table %d instead", owner, table),
+			}}
+		}
+	}
+	return []router.Conflict{{
+		Kind:     router.ConflictTable,
+		Severity: router.SeverityError,
+		Value:    tunnelTableID,
+		Detail:   owner + ", no free table found",
+	}}
+}
+
+// resolveMarks picks free bypass and bootstrap marks when unset, and reports explicit marks that overlap
+// marks in use by others or each other.
+func resolveMarks(c *router.Config, sys *systemPolicy) []router.Conflict {
+	var conflicts []router.Conflict
+
+	if c.FwMark != 0 {
+		conflicts = append(conflicts, explicitMarkConflicts(c.FwMark, sys)...)
+	} else {
+		var conflict *router.Conflict
+		c.FwMark, conflict = pickMark(mark.LinuxBypassMarkNum, 0, sys)
+		if conflict != nil {
+			conflicts = append(conflicts, *conflict)
+		}
+	}
+
+	if c.BootstrapMark != 0 {
+		conflicts = append(conflicts, explicitMarkConflicts(c.BootstrapMark, sys)...)
+		if c.BootstrapMark == c.FwMark {
+			conflicts = append(conflicts, router.Conflict{
+				Kind:     router.ConflictFwMark,
+				Severity: router.SeverityError,
+				Value:    c.FwMark,
+				Detail:   "used as both the bypass and bootstrap mark",
+			})
+		}
+	} else {
+		var conflict *router.Conflict
+		c.BootstrapMark, conflict = pickMark(mark.LinuxBootstrapMarkNum, c.FwMark, sys)
+		if conflict != nil {
+			conflicts = append(conflicts, *conflict)
+		}
+	}
+	return conflicts
+}
+
+func explicitMarkConflicts(m uint32, sys *systemPolicy) []router.Conflict {
+	var conflicts []router.Conflict
+	for _, use := range sys.marks {
+		if marksOverlap(m, use) {
+			conflicts = append(conflicts, router.Conflict{
+				Kind:     router.ConflictFwMark,
+				Severity: router.SeverityError,
+				Value:    m,
+				Detail:   fmt.Sprintf("overlaps mark %#x/%#x %s", use.mark, use.mask, use.owner),
+			})
+		}
+	}
+	return conflicts
+}
+
+// pickMark returns def if it is free, otherwise the first free mark under mark.LinuxFwmarkMaskNum other than avoid.
+// A warning is returned when def was taken.
+func pickMark(def, avoid uint32, sys *systemPolicy) (uint32, *router.Conflict) {
+	used := firstOverlap(def, sys)
+	if used == nil && def != avoid {
+		return def, nil
+	}
+	detail := "used as the bypass mark"
+	if used != nil {
+		detail = fmt.Sprintf("overlaps mark %#x/%#x %s", used.mark, used.mask, used.owner)
+	}
+
+	for m := uint32(markStep); m <= mark.LinuxFwmarkMaskNum; m += markStep {
+		if m == def || m == avoid || firstOverlap(m, sys) != nil {
+			continue
+		}
+		return m, &router.Conflict{
+			Kind:     router.ConflictFwMark,
+			Severity: router.SeverityWarning,
+			Value:    def,
+			Detail:   fmt.Sprintf("%s, using mark %#x instead", detail, m),
+		}
+	}
+	return def, &router.Conflict{
+		Kind:     router.ConflictFwMark,
+		Severity: router.SeverityError,
+		Value:    def,
+		Detail:   detail + ", no free mark found",
+	}
+}
+
+func firstOverlap(m uint32, sys *systemPolicy) *markUse {
+	for i := range sys.marks {
+		if marksOverlap(m, sys.marks[i]) {
+			return &sys.marks[i]
+		}
+	}
+	return nil
+}
+
+// marksOverlap reports whether packets carrying our mark would match the other owner's mark, or packets carrying
+// theirs would match our rule.
+func marksOverlap(m uint32, use markUse) bool {
+	if use.mark == 0 {
+		// matches unmarked packets, which never carry our mark
+		return false
+	}
+	ourMask := mark.MaskFor(m)
+	return use.mark&ourMask == m || m&use.mask == use.mark&use.mask
+}
+
+// resolvePriority picks a free base priority when unset, starting at the band of the precedence and moving to lower
+// precedence bands while it is taken. Rules sharing a priority with another owner's are evaluated in insertion
+// order, so explicit priorities in use are reported as warnings.
+func resolvePriority(c *router.Config, sys *systemPolicy) []router.Conflict {
+	if c.RulePriority > 0 {
+		var conflicts []router.Conflict
+		p := policyFor(c)
+		for _, prio := range []int{p.prioBootstrap, p.prioMark, p.prioExclude, p.prioSplit, p.prioSuppress, p.prioDefault} {
+			if owner, ok := sys.priorities[prio]; ok {
+				conflicts = append(conflicts, router.Conflict{
+					Kind:     router.ConflictPriority,
+					Severity: router.SeverityWarning,
+					Value:    uint32(prio),
+					Detail:   owner,
+				})
+			}
+		}
+		return conflicts
+	}
+
+	band := rulePrioBootstrap + c.Precedence*rulePrioBand
+	taken := firstTakenPriority(band, sys)
+	if taken < 0 {
+		c.RulePriority = band
+		return nil
+	}
+	for base := band + rulePrioBand; base+rulePrioSpan < maxRulePriority; base += rulePrioBand {
+		if firstTakenPriority(base, sys) < 0 {
+			c.RulePriority = base
+			return []router.Conflict{{
+				Kind:     router.ConflictPriority,
+				Severity: router.SeverityWarning,
+				Value:    uint32(taken),
+				Detail:   fmt.Sprintf("%s, using base priority %d instead", sys.priorities[taken], base),
+			}}
+		}
+	}
+	c.RulePriority = band
+	return []router.Conflict{{
+		Kind:     router.ConflictPriority,
+		Severity: router.SeverityWarning,
+		Value:    uint32(taken),
+		Detail:   sys.priorities[taken] + ", no free priority found",
+	}}
+}
+
+// firstTakenPriority returns the first of our rule priorities for base that is in use, or -1.
+func firstTakenPriority(base int, sys *systemPolicy) int {
+	offset := base - rulePrioBootstrap
+	for _, prio := range []int{rulePrioBootstrap, rulePrioMark, rulePrioExclude, rulePrioSplit, rulePrioSuppress, rulePrioDefault} {
+		if _, ok := sys.priorities[prio+offset]; ok {
+			return prio + offset
+		}
+	}
+	return -1
+}
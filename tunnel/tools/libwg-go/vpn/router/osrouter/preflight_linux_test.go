@@ -0,0 +1,91 @@
+//go:build linux
+
+package osrouter
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/wgtunnel/desktop/tunnel/vpn/router"
+	"golang.org/x/sys/unix"
+)
+
+func TestResolvePriority(t *testing.T) {
+	tests := []struct {
+		name       string
+		precedence int
+		explicit   int
+		taken      []int
+		want       int
+		conflicts  int
+	}{
+		{name: "free band", want: 50},
+		{name: "band of the precedence", precedence: 2, want: 450},
+		{name: "split priority taken", taken: []int{160}, want: 250, conflicts: 1},
+		{name: "every rule priority taken", taken: []int{50, 100, 150, 160, 190, 200}, want: 250, conflicts: 1},
+		{name: "next band taken too", taken: []int{100, 360}, want: 450, conflicts: 1},
+		{name: "explicit priority is kept", explicit: 1000, taken: []int{1110}, want: 1000, conflicts: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sys := &systemPolicy{priorities: make(map[int]string)}
+			for _, prio := range tt.taken {
+				sys.priorities[prio] = "used by ip rule to table 7"
+			}
+			c := &router.Config{Precedence: tt.precedence, RulePriority: tt.explicit}
+			conflicts := resolvePriority(c, sys)
+			if c.RulePriority != tt.want {
+				t.Errorf("RulePriority = %d, want %d", c.RulePriority, tt.want)
+			}
+			if len(conflicts) != tt.conflicts {
+				t.Errorf("conflicts = %v, want %d", conflicts, tt.conflicts)
+			}
+			for _, conflict := range conflicts {
+				if conflict.Severity != router.SeverityWarning {
+					t.Errorf("conflict %v is not a warning", conflict)
+				}
+			}
+		})
+	}
+}
+
+func TestIsOwnRule(t *testing.T) {
+	p := policyFor(&router.Config{Table: 60, Precedence: 1})
+	_, dst, _ := net.ParseCIDR("192.0.2.0/24")
+
+	tests := []struct {
+		name string
+		rule netlink.Rule
+		want bool
+	}{
+		{"split rule", netlink.Rule{Priority: p.prioSplit, Table: 60}, true},
+		{"split rule of another table", netlink.Rule{Priority: p.prioSplit, Table: 61}, false},
+		{"marked rule at the split priority", netlink.Rule{Priority: p.prioSplit, Table: 60, Mark: 0x10}, false},
+		{"exclude rule", netlink.Rule{Priority: p.prioExclude, Table: unix.RT_TABLE_MAIN, Dst: dst}, true},
+		{"main rule at the split priority", netlink.Rule{Priority: p.prioSplit, Table: unix.RT_TABLE_MAIN, Dst: dst}, false},
+		{"default rule", netlink.Rule{Priority: p.prioDefault, Table: 60}, true},
+		{"default rule of another band", netlink.Rule{Priority: rulePrioDefault, Table: 60}, false},
+	}
+	for _, tt := range tests {
+		if got := isOwnRule(tt.rule, []routingPolicy{p}); got != tt.want {
+			t.Errorf("%s: isOwnRule() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPreflightSkipsDisabledAndRefusesMainTable(t *testing.T) {
+	r := &linuxRouter{iface: "wgtest0"}
+
+	off := &router.Config{Table: router.TableOff, Routes: []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")}}
+	resolved, conflicts, err := r.Preflight(off)
+	if err != nil || len(conflicts) != 0 || resolved.Table != router.TableOff {
+		t.Errorf("Table = off resolved to %+v, %v, %v", resolved, conflicts, err)
+	}
+
+	full := &router.Config{Table: unix.RT_TABLE_MAIN, Routes: []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")}}
+	if _, _, err := r.Preflight(full); err == nil {
+		t.Error("full tunnel with Table = main accepted")
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"net"
 	"net/netip"
 	"slices"
+	"sync"
 
 	"github.com/amnezia-vpn/amneziawg-go/device"
 	"github.com/amnezia-vpn/amneziawg-go/tun"
@@ -29,12 +30,66 @@ const (
 	tunnelTableID     = 52
 	rulePrioMark      = 100
 	rulePrioExclude   = 150
+	rulePrioSplit     = 160
+	rulePrioSuppress  = 190
 	rulePrioDefault   = 200
+
+	// rulePrioBand is the distance between the rule priorities of tunnels one precedence apart, so the rules of
+	// tunnels of different precedence never interleave
+	rulePrioBand = 200
 )
 
+// routingPolicy is the table, marks and rule priorities resolved for a single tunnel config.
+type routingPolicy struct {
+	table         int
+	bypassMark    uint32
+	bootstrapMark uint32
+	prioBootstrap int
+	prioMark      int
+	prioExclude   int
+	prioSplit     int
+	prioSuppress  int
+	prioDefault   int
+}
+
+// policyFor resolves the routing policy for a config, falling back to our defaults for unset values.
+// A custom RulePriority keeps the default spacing between the rules, without one the Precedence picks the band.
+func policyFor(c *router.Config) routingPolicy {
+	p := routingPolicy{
+		table:         tunnelTableID,
+		bypassMark:    mark.LinuxBypassMarkNum,
+		bootstrapMark: mark.LinuxBootstrapMarkNum,
+		prioBootstrap: rulePrioBootstrap,
+		prioMark:      rulePrioMark,
+		prioExclude:   rulePrioExclude,
+		prioSplit:     rulePrioSplit,
+		prioSuppress:  rulePrioSuppress,
+		prioDefault:   rulePrioDefault,
+	}
+	if c == nil {
+		return p
+	}
+	if c.Table > 0 {
+		p.table = c.Table
+	}
+	p.bypassMark = mark.OrDefault(c.FwMark, p.bypassMark)
+	p.bootstrapMark = mark.OrDefault(c.BootstrapMark, p.bootstrapMark)
+	offset := c.Precedence * rulePrioBand
+	if c.RulePriority > 0 {
+		offset = c.RulePriority - rulePrioBootstrap
+	}
+	p.prioBootstrap += offset
+	p.prioMark += offset
+	p.prioExclude += offset
+	p.prioSplit += offset
+	p.prioSuppress += offset
+	p.prioDefault += offset
+	return p
+}
+
 type linuxRouter struct {
 	iface       string
-	fw          *osfirewall.LinuxFirewall
+	fw          osfirewall.Backend
 	logger      *device.Logger
 	prevConfig  *router.Config
 	v4Full      bool
@@ -42,6 +97,15 @@ type linuxRouter struct {
 	v6Available bool
 
 	policyRules map[int][]*netlink.Rule
+
+	// mu serializes Set and Close with the drift watcher's checks
+	mu           sync.Mutex
+	drift        *driftWatch
+	failedClosed bool
+	// persistBeforeFail is the kill switch's persistence before failing closed, restored on Close
+	persistBeforeFail bool
+	// dnsSet is set once DNS was applied for the iface, until it is reverted
+	dnsSet bool
 }
 
 // GetPhysicalInterfaceIndex stub
@@ -52,7 +116,7 @@ func (r *linuxRouter) GetPhysicalInterfaceIndex() uint32 {
 func New(iface string, fw firewall.Firewall, _ tun.Device, logger *device.Logger) (router.Router, error) {
 	return &linuxRouter{
 		iface:       iface,
-		fw:          fw.(*osfirewall.LinuxFirewall),
+		fw:          fw.(osfirewall.Backend),
 		logger:      logger,
 		v6Available: nettest.SupportsIPv6(),
 		policyRules: make(map[int][]*netlink.Rule),
@@ -60,6 +124,12 @@ func New(iface string, fw firewall.Firewall, _ tun.Device, logger *device.Logger
 }
 
 func (r *linuxRouter) Set(c *router.Config) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.set(c)
+}
+
+func (r *linuxRouter) set(c *router.Config) error {
 	newC := r.normalizeConfig(c)
 	prevC := r.normalizeConfig(r.prevConfig)
 
@@ -80,6 +150,13 @@ func (r *linuxRouter) Set(c *router.Config) error {
 	if err := r.syncFirewallState(newC); err != nil {
 		return err
 	}
+	r.syncBlocklists(newC)
+	if err := r.syncDnsLock(newC); err != nil {
+		return err
+	}
+	if err := r.syncV6BlockFirewall(newC); err != nil {
+		return err
+	}
 
 	r.syncDeviceParams(link, newC, prevC)
 
@@ -102,20 +179,33 @@ func (r *linuxRouter) Set(c *router.Config) error {
 
 // Close closes the router.
 func (r *linuxRouter) Close() error {
-	// revert DNS before cleanup
-	if r.prevConfig != nil {
+	r.stopDriftWatch()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// revert DNS before cleanup, another tunnel's DNS takes over if it is next in precedence
+	if r.dnsSet {
 		if err := dns.RevertDns(r.iface, r.logger); err != nil {
 			r.logger.Errorf("revert DNS on close: %v", err)
 		}
+		r.dnsSet = false
+	}
+
+	// the kill switch engaged on failing closed is released with the tunnel, like before it failed
+	if r.failedClosed {
+		r.fw.SetPersist(r.persistBeforeFail)
+		r.failedClosed = false
 	}
 
 	// cleanup routes and firewall
-	if err := r.Set(nil); err != nil {
+	if err := r.set(nil); err != nil {
 		r.logger.Errorf("cleanup set nil: %v", err)
 	}
 
 	r.deletePolicyRules(netlink.FAMILY_V4)
 	r.deletePolicyRules(netlink.FAMILY_V6)
+	registerTunnel(r.iface, nil)
 
 	r.logger.Verbosef("Router closed")
 	return nil
@@ -141,27 +231,56 @@ func (r *linuxRouter) cleanupPreviousState(link netlink.Link, newC, prevC *route
 	prevV6Full := hasDefault(prevC, false)
 	newV4Full := hasDefault(newC, true)
 	newV6Full := hasDefault(newC, false)
+	prevPolicy := policyFor(prevC)
+	policyChanged := prevPolicy != policyFor(newC)
+
+	for _, v4 := range []bool{true, false} {
+		prevFull := hasDefault(prevC, v4)
+		fullChanged := prevFull != hasDefault(newC, v4)
+		prevRoutes := tunnelRoutes(prevC, v4)
+		if prevC.RoutesDisabled() {
+			// nothing was installed, and the table may be another tunnel's
+			prevRoutes = nil
+		}
+		newRoutes := tunnelRoutes(newC, v4)
+		for _, rt := range prevRoutes {
+			if policyChanged || fullChanged || newC.RoutesDisabled() || !slices.Contains(newRoutes, rt) {
+				dst := prefixToIPNet(rt)
+				route := &netlink.Route{LinkIndex: link.Attrs().Index, Dst: dst, Table: prevPolicy.table}
+				_ = netlink.RouteDel(route)
+			}
+		}
+
+		if !prevFull {
+			if len(prevRoutes) > 0 && (policyChanged || fullChanged || newC.RoutesDisabled() || len(newRoutes) == 0) {
+				r.deleteSplitRule(v4, prevPolicy)
+			}
+			continue
+		}
 
-	for _, rt := range prevC.Routes {
-		if !slices.Contains(newC.Routes, rt) {
-			table := unix.RT_TABLE_MAIN
-			if (rt.Addr().Is4() && prevV4Full) || (rt.Addr().Is6() && prevV6Full) {
-				table = tunnelTableID
+		// remove old exclude rules
+		for _, lr := range filterRoutes(prevC.ExcludedRoutes, v4) {
+			if policyChanged || fullChanged || !slices.Contains(newC.ExcludedRoutes, lr) {
+				if sharedExcludeRule(r.iface, lr, prevPolicy.prioExclude) {
+					continue
+				}
+				r.deleteMainRule(lr, prevPolicy.prioExclude)
 			}
-			dst := prefixToIPNet(rt)
-			route := &netlink.Route{LinkIndex: link.Attrs().Index, Dst: dst, Table: table}
-			_ = netlink.RouteDel(route)
 		}
 	}
 
 	// clean up marks
-	if prevV4Full && !newV4Full {
+	if prevV4Full && (!newV4Full || policyChanged) {
 		r.deletePolicyRules(netlink.FAMILY_V4)
-		r.deleteBootstrapPolicyRules(netlink.FAMILY_V4)
+		r.deleteBootstrapPolicyRules(netlink.FAMILY_V4, prevPolicy)
 	}
-	if prevV6Full && !newV6Full {
+	prevV6Block, newV6Block := blocksV6(prevC), blocksV6(newC)
+	if prevV6Block && (!newV6Block || policyChanged) {
+		r.deleteV6Block(prevPolicy)
+	}
+	if (prevV6Full || prevV6Block) && (!(newV6Full || newV6Block) || policyChanged) {
 		r.deletePolicyRules(netlink.FAMILY_V6)
-		r.deleteBootstrapPolicyRules(netlink.FAMILY_V6)
+		r.deleteBootstrapPolicyRules(netlink.FAMILY_V6, prevPolicy)
 	}
 }
 
@@ -181,22 +300,87 @@ func addrExists(existing []netlink.Addr, target *net.IPNet) bool {
 	return false
 }
 
-func (r *linuxRouter) deleteExcludeRule(lr netip.Prefix) {
+// addMainRule adds a rule at prio sending traffic for lr to the main table, ahead of the tunnel table. Full tunnels
+// exclude routes with it.
+func (r *linuxRouter) addMainRule(lr netip.Prefix, prio int) error {
 	fam := netlink.FAMILY_V4
 	if lr.Addr().Is6() {
 		fam = netlink.FAMILY_V6
 	}
 
-	dst := prefixToIPNet(lr)
+	rules, err := netlink.RuleList(fam)
+	if err != nil {
+		return fmt.Errorf("list rules fam %d: %w", fam, err)
+	}
+	dst := prefixToIPNet(lr.Masked())
+	for _, existing := range rules {
+		if existing.Priority == prio && existing.Table == unix.RT_TABLE_MAIN &&
+			existing.Dst != nil && existing.Dst.String() == dst.String() {
+			return nil
+		}
+	}
+
 	rule := netlink.NewRule()
 	rule.Family = fam
-	rule.Priority = rulePrioExclude
+	rule.Priority = prio
 	rule.Dst = dst
 	rule.Table = unix.RT_TABLE_MAIN
+	if err := netlink.RuleAdd(rule); err != nil {
+		return fmt.Errorf("add main table rule %v: %w", lr, err)
+	}
+	return nil
+}
+
+func (r *linuxRouter) deleteMainRule(lr netip.Prefix, prio int) {
+	fam := netlink.FAMILY_V4
+	if lr.Addr().Is6() {
+		fam = netlink.FAMILY_V6
+	}
+
+	dst := prefixToIPNet(lr.Masked())
+	rule := netlink.NewRule()
+	rule.Family = fam
+	rule.Priority = prio
+	rule.Dst = dst
+	rule.Table = unix.RT_TABLE_MAIN
+
+	// ignore the error if rule is already gone
+	if err := netlink.RuleDel(rule); err != nil {
+		r.logger.Verbosef("del main table rule %v: %v (ignored)", lr, err)
+	}
+}
+
+// addSplitRule looks up the split tunnel's table at its split priority, ahead of the default rules of full tunnels
+// with a higher precedence. Routes not in the table fall through to the next rules. The main table needs no rule.
+func (r *linuxRouter) addSplitRule(fam int, policy routingPolicy) error {
+	if policy.table == unix.RT_TABLE_MAIN {
+		return nil
+	}
+	rule := netlink.NewRule()
+	rule.Family = fam
+	rule.Priority = policy.prioSplit
+	rule.Table = policy.table
+	if err := r.addRuleIdempotent(rule); err != nil {
+		return fmt.Errorf("add split tunnel rule fam %d: %w", fam, err)
+	}
+	return nil
+}
+
+func (r *linuxRouter) deleteSplitRule(v4 bool, policy routingPolicy) {
+	if policy.table == unix.RT_TABLE_MAIN {
+		return
+	}
+	rule := netlink.NewRule()
+	rule.Family = netlink.FAMILY_V6
+	if v4 {
+		rule.Family = netlink.FAMILY_V4
+	}
+	rule.Priority = policy.prioSplit
+	rule.Table = policy.table
 
 	// ignore the error if rule is already gone
 	if err := netlink.RuleDel(rule); err != nil {
-		r.logger.Verbosef("del exclude rule %v: %v (ignored)", lr, err)
+		r.logger.Verbosef("del split tunnel rule table %d: %v (ignored)", policy.table, err)
 	}
 }
 
@@ -211,19 +395,33 @@ func (r *linuxRouter) updatePrevState(newC *router.Config) {
 	r.v4Full = hasDefault(newC, true)
 	r.v6Full = hasDefault(newC, false)
 	r.prevConfig = newC.Clone()
+	registerTunnel(r.iface, newC)
 	r.logger.Verbosef("Router state updated: full v4=%v v6=%v", r.v4Full, r.v6Full)
 }
 
 func (r *linuxRouter) syncFirewallState(newC *router.Config) error {
-	requiresKS := newC.HasAnyDefaultRoute()
+	// failed closed, the bypasses stay removed until the tunnel is restarted
+	if r.failedClosed && !newC.IsIdle() {
+		return nil
+	}
+
+	requiresKS := hasDefault(newC, true) || hasDefault(newC, false)
 
 	if !requiresKS && !r.fw.IsEnabled() {
 		// not full tun and independent ks is not enabled, do nothing
 		return nil
 		// handle cleanup
-	} else if newC.Equal(&router.Config{}) && r.fw.IsEnabled() {
-		// independent fw, just remove the rules
-		if r.fw.IsPersistent() {
+	} else if newC.IsIdle() && r.fw.IsEnabled() {
+		// independent fw, held or still needed by another full tunnel, just remove our rules
+		if r.fw.IsPersistent() || newC.HoldKillSwitch || otherFullTunnel(r.iface) {
+			// a paused tunnel's device still sends keepalives and handshakes with its marks
+			if !newC.Equal(&router.Config{}) {
+				policy := policyFor(newC)
+				if err := r.fw.AddMarkBypasses(r.iface, policy.bypassMark, policy.bootstrapMark); err != nil {
+					return fmt.Errorf("add firewall mark bypasses: %w", err)
+				}
+				return nil
+			}
 			if err := r.fw.RemoveTunnelBypasses(r.iface); err != nil {
 				return fmt.Errorf("remove tunnel bypasses: %w", err)
 			}
@@ -246,11 +444,42 @@ func (r *linuxRouter) syncFirewallState(newC *router.Config) error {
 
 	// kill switch is active, set our bypass rules for tun
 	if r.fw.IsEnabled() {
-		if err := r.fw.AddTunnelBypasses(r.iface); err != nil {
+		policy := policyFor(newC)
+		if err := r.fw.AddTunnelBypasses(r.iface, policy.bypassMark, policy.bootstrapMark); err != nil {
 			return fmt.Errorf("add firewall bypasses: %w", err)
 		}
+		if err := r.fw.AllowExcludedRoutes(r.iface, newC.ExcludedRoutes); err != nil {
+			return fmt.Errorf("allow excluded routes: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// syncBlocklists enforces the firewall's blocklists while the tunnel is up.
+func (r *linuxRouter) syncBlocklists(newC *router.Config) {
+	if newC.IsIdle() {
+		if err := r.fw.DeactivateBlocklists(r.iface); err != nil {
+			r.logger.Errorf("deactivate blocklists: %v", err)
+		}
+		return
 	}
+	if err := r.fw.ActivateBlocklists(r.iface); err != nil {
+		r.logger.Errorf("activate blocklists: %v", err)
+	}
+}
 
+// syncDnsLock lets the tunnel's DNS through the firewall's DNS lock while the tunnel is up.
+func (r *linuxRouter) syncDnsLock(newC *router.Config) error {
+	if newC.IsIdle() {
+		if err := r.fw.RemoveDnsLockTunnel(r.iface); err != nil {
+			return fmt.Errorf("remove DNS lock tunnel: %w", err)
+		}
+		return nil
+	}
+	if err := r.fw.SetDnsLockTunnel(r.iface, newC.DNS, policyFor(newC).bootstrapMark); err != nil {
+		return fmt.Errorf("set DNS lock tunnel: %w", err)
+	}
 	return nil
 }
 
@@ -274,11 +503,22 @@ func (r *linuxRouter) syncDNS(newC, prevC *router.Config) error {
 
 	// handle if DNS settings or tunnel state changed
 	dnsChanged := !slices.Equal(newC.DNS, prevC.DNS) ||
-		!slices.Equal(newC.SearchDomains, prevC.SearchDomains)
+		!slices.Equal(newC.SearchDomains, prevC.SearchDomains) ||
+		!slices.Equal(newC.RoutingDomains, prevC.RoutingDomains) ||
+		newC.Precedence != prevC.Precedence
 	stateChanged := (v4Full != prevV4Full) || (v6Full != prevV6Full)
 
+	if (dnsChanged || stateChanged) && len(newC.DNS) == 0 && len(newC.SearchDomains) == 0 {
+		// e.g. a paused tunnel, the next one in precedence takes over
+		if !r.dnsSet {
+			return nil
+		}
+		r.dnsSet = false
+		return dns.RevertDns(r.iface, r.logger)
+	}
 	if dnsChanged || stateChanged {
-		return dns.SetDns(r.iface, newC.DNS, newC.SearchDomains, v4Full || v6Full, r.logger)
+		r.dnsSet = true
+		return dns.SetDns(r.iface, newC.DNS, newC.SearchDomains, newC.RoutingDomains, v4Full || v6Full, newC.Precedence, r.logger)
 	}
 	return nil
 }
@@ -303,8 +543,17 @@ func (r *linuxRouter) applyNewAddresses(link netlink.Link, newC *router.Config)
 }
 
 func (r *linuxRouter) syncRoutingAndRules(link netlink.Link, newC *router.Config) error {
+	if newC.RoutesDisabled() {
+		r.logger.Verbosef("Table = off, skipping routes and policy rules")
+		return nil
+	}
+
 	v4Full := hasDefault(newC, true)
 	v6Full := hasDefault(newC, false)
+	policy := policyFor(newC)
+	if (v4Full || v6Full) && policy.table == unix.RT_TABLE_MAIN {
+		return &router.ConflictError{Conflicts: []router.Conflict{mainTableConflict()}}
+	}
 
 	families := []int{netlink.FAMILY_V4}
 	if r.v6Available {
@@ -313,26 +562,41 @@ func (r *linuxRouter) syncRoutingAndRules(link netlink.Link, newC *router.Config
 
 	for _, fam := range families {
 		isFull := (fam == netlink.FAMILY_V4 && v4Full) || (fam == netlink.FAMILY_V6 && v6Full)
+		blockV6 := fam == netlink.FAMILY_V6 && blocksV6(newC)
 
-		if isFull {
+		if isFull || blockV6 {
 			// add unnel rules
-			if err := r.addPolicyRules(fam); err != nil {
+			if err := r.addPolicyRules(fam, policy); err != nil {
 				return err
 			}
 			// add bootstrap mark rule for DNS bootstrap
-			if err := r.addBootstrapPolicyRules(fam); err != nil {
+			if err := r.addBootstrapPolicyRules(fam, policy); err != nil {
+				return err
+			}
+		}
+		if blockV6 {
+			if err := r.addV6Block(link, policy); err != nil {
 				return err
 			}
 		}
 
-		routes := filterRoutes(newC.Routes, fam == netlink.FAMILY_V4)
-		table := unix.RT_TABLE_MAIN
+		routes := tunnelRoutes(newC, fam == netlink.FAMILY_V4)
 		if isFull {
-			table = tunnelTableID
+			// send excluded routes to the main table ahead of the tunnel table
+			for _, lr := range filterRoutes(newC.ExcludedRoutes, fam == netlink.FAMILY_V4) {
+				if err := r.addMainRule(lr, policy.prioExclude); err != nil {
+					return err
+				}
+			}
+		} else if len(routes) > 0 {
+			if err := r.addSplitRule(fam, policy); err != nil {
+				return err
+			}
 		}
 
+		// each tunnel has a table of its own, so tunnels routing the same prefix don't replace each other's route
 		for _, rt := range routes {
-			if err := r.replaceRouteIdempotent(link, rt, table); err != nil {
+			if err := r.replaceRouteIdempotent(link, rt, policy.table); err != nil {
 				return err
 			}
 		}
@@ -340,23 +604,23 @@ func (r *linuxRouter) syncRoutingAndRules(link netlink.Link, newC *router.Config
 	return nil
 }
 
-func (r *linuxRouter) addBootstrapPolicyRules(family int) error {
-	mask := uint32(mark.LinuxFwmarkMaskNum)
+func (r *linuxRouter) addBootstrapPolicyRules(family int, policy routingPolicy) error {
+	mask := mark.MaskFor(policy.bootstrapMark)
 	rule := netlink.NewRule()
 	rule.Family = family
-	rule.Mark = mark.LinuxBootstrapMarkNum
+	rule.Mark = policy.bootstrapMark
 	rule.Mask = &mask
-	rule.Priority = 50              // set as high priority, above main tunnel rules
-	rule.Table = unix.RT_TABLE_MAIN // force bypass to ISP table
+	rule.Priority = policy.prioBootstrap // set as high priority, above main tunnel rules
+	rule.Table = unix.RT_TABLE_MAIN      // force bypass to ISP table
 
 	return r.addRuleIdempotent(rule)
 }
 
-func (r *linuxRouter) deleteBootstrapPolicyRules(family int) error {
+func (r *linuxRouter) deleteBootstrapPolicyRules(family int, policy routingPolicy) error {
 	rule := netlink.NewRule()
 	rule.Family = family
-	rule.Mark = mark.LinuxBootstrapMarkNum
-	rule.Priority = rulePrioBootstrap
+	rule.Mark = policy.bootstrapMark
+	rule.Priority = policy.prioBootstrap
 	return netlink.RuleDel(rule)
 }
 
@@ -385,9 +649,9 @@ func (r *linuxRouter) replaceRouteIdempotent(link netlink.Link, rt netip.Prefix,
 	return netlink.RouteReplace(route)
 }
 
-// hasDefault returns true if config has default route for v4 (true) or v6 (false).
+// hasDefault returns true if config has default route for v4 (true) or v6 (false) and routes are enabled.
 func hasDefault(c *router.Config, v4 bool) bool {
-	if c == nil {
+	if c == nil || c.RoutesDisabled() {
 		return false
 	}
 	for _, rt := range c.Routes {
@@ -398,6 +662,16 @@ func hasDefault(c *router.Config, v4 bool) bool {
 	return false
 }
 
+// tunnelRoutes returns the routes installed for v4 (true) or v6 (false). A full tunnel installs every route in the
+// tunnel table and carves out ExcludedRoutes with exclude rules, otherwise ExcludedRoutes are cut from the routes.
+func tunnelRoutes(c *router.Config, v4 bool) []netip.Prefix {
+	routes := filterRoutes(c.Routes, v4)
+	if hasDefault(c, v4) {
+		return routes
+	}
+	return router.ExcludePrefixes(routes, filterRoutes(c.ExcludedRoutes, v4))
+}
+
 // filterRoutes returns routes for v4 (true) or v6 (false).
 func filterRoutes(routes []netip.Prefix, v4 bool) []netip.Prefix {
 	var filtered []netip.Prefix
@@ -422,7 +696,7 @@ func prefixToIPNet(p netip.Prefix) *net.IPNet {
 }
 
 // addPolicyRules adds mark-based and default tunnel table rules for the family.
-func (r *linuxRouter) addPolicyRules(fam int) error {
+func (r *linuxRouter) addPolicyRules(fam int, policy routingPolicy) error {
 	rules, err := netlink.RuleList(fam)
 	if err != nil {
 		return fmt.Errorf("list rules fam %d: %w", fam, err)
@@ -431,8 +705,8 @@ func (r *linuxRouter) addPolicyRules(fam int) error {
 	// Mark rule: fwmark bypass -> main
 	markRule := netlink.NewRule()
 	markRule.Family = fam
-	markRule.Priority = rulePrioMark
-	markRule.Mark = mark.LinuxBypassMarkNum
+	markRule.Priority = policy.prioMark
+	markRule.Mark = policy.bypassMark
 	markRule.Table = unix.RT_TABLE_MAIN
 
 	markExists := false
@@ -453,8 +727,8 @@ func (r *linuxRouter) addPolicyRules(fam int) error {
 
 	defaultRule := netlink.NewRule()
 	defaultRule.Family = fam
-	defaultRule.Priority = rulePrioDefault
-	defaultRule.Table = tunnelTableID
+	defaultRule.Priority = policy.prioDefault
+	defaultRule.Table = policy.table
 
 	defaultExists := false
 	for _, existing := range rules {
@@ -117,9 +117,9 @@ func (r *windowsRouter) syncFirewallState(newC *router.Config, requiresKS bool)
 	if !requiresKS && !r.fw.IsEnabled() {
 		// not full tun and independent ks is not enabled, do nothing
 		return nil
-	} else if newC.Equal(&router.Config{}) && r.fw.IsEnabled() {
-		// tunnel down: cleanup
-		if r.fw.IsPersistent() {
+	} else if newC.IsIdle() && r.fw.IsEnabled() {
+		// tunnel down or paused: cleanup, a held kill switch stays
+		if r.fw.IsPersistent() || newC.HoldKillSwitch {
 			if err := r.fw.RemoveTunnelRules(); err != nil {
 				return fmt.Errorf("remove tunnel bypasses: %w", err)
 			}
@@ -146,6 +146,9 @@ func (r *windowsRouter) syncFirewallState(newC *router.Config, requiresKS bool)
 		if err := r.fw.BypassTunnel(r.rawLuid, newC.ListenPort); err != nil {
 			return fmt.Errorf("add firewall bypasses: %w", err)
 		}
+		if err := r.fw.UpdatePermittedRoutes(newC.ExcludedRoutes); err != nil {
+			return fmt.Errorf("permit excluded routes: %w", err)
+		}
 	}
 
 	return nil
@@ -204,6 +207,11 @@ func setBit(addr netip.Addr, i int, value bool) netip.Addr {
 	return netip.AddrFrom16(b)
 }
 
+// Preflight has nothing to resolve on Windows, tables, marks and rule priorities are Linux only.
+func (r *windowsRouter) Preflight(c *router.Config) (*router.Config, []router.Conflict, error) {
+	return c.Clone(), nil, nil
+}
+
 func (r *windowsRouter) Close() error {
 	// Unregister network change callback
 	if r.notifyHandle != nil {
@@ -335,7 +343,8 @@ func (r *windowsRouter) configureInterface(cfg *router.Config) error {
 				foundDefault6 = true
 			}
 
-			for _, p := range splits {
+			// excluded routes fall through to the physical default route
+			for _, p := range router.ExcludePrefixes(splits, cfg.ExcludedRoutes) {
 				routes = append(routes, &routeData{
 					RouteData: winipcfg.RouteData{
 						Destination: p,
@@ -355,13 +364,15 @@ func (r *windowsRouter) configureInterface(cfg *router.Config) error {
 			gateway = localAddr
 		}
 
-		routes = append(routes, &routeData{
-			RouteData: winipcfg.RouteData{
-				Destination: route,
-				NextHop:     gateway,
-				Metric:      0,
-			},
-		})
+		for _, p := range router.ExcludePrefixes([]netip.Prefix{route}, cfg.ExcludedRoutes) {
+			routes = append(routes, &routeData{
+				RouteData: winipcfg.RouteData{
+					Destination: p,
+					NextHop:     gateway,
+					Metric:      0,
+				},
+			})
+		}
 	}
 
 	err = syncAddresses(iface, addresses)
@@ -0,0 +1,61 @@
+//go:build linux
+
+package osrouter
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/vishvananda/netlink"
+	"github.com/wgtunnel/desktop/tunnel/vpn/router"
+	"golang.org/x/sys/unix"
+)
+
+// CheckRoutes compares the config's routes against the main routing table. A full tunnel family routes through
+// the tunnel table ahead of main, so only its LAN and gateway overlaps are reported.
+func (r *linuxRouter) CheckRoutes(c *router.Config) ([]router.RouteWarning, error) {
+	if c == nil || c.RoutesDisabled() {
+		return nil, nil
+	}
+
+	ownIndex := r.linkIndex()
+	var system []router.SystemRoute
+	for _, fam := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		if fam == netlink.FAMILY_V6 && !r.v6Available {
+			continue
+		}
+		full := hasDefault(c, fam == netlink.FAMILY_V4)
+
+		routes, err := netlink.RouteListFiltered(fam, &netlink.Route{Table: unix.RT_TABLE_MAIN}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return nil, fmt.Errorf("list routes fam %d: %w", fam, err)
+		}
+		for _, rt := range routes {
+			if rt.LinkIndex == ownIndex {
+				continue
+			}
+			sr := router.SystemRoute{
+				Iface:     linkName(rt.LinkIndex),
+				Connected: rt.Scope == netlink.SCOPE_LINK && rt.Gw == nil,
+			}
+			if rt.Dst != nil {
+				addr, _ := netip.AddrFromSlice(rt.Dst.IP)
+				ones, _ := rt.Dst.Mask.Size()
+				sr.Prefix = netip.PrefixFrom(addr.Unmap(), ones)
+			} else if fam == netlink.FAMILY_V4 {
+				sr.Prefix = netip.PrefixFrom(netip.IPv4Unspecified(), 0)
+			} else {
+				sr.Prefix = netip.PrefixFrom(netip.IPv6Unspecified(), 0)
+			}
+			if rt.Gw != nil {
+				gw, _ := netip.AddrFromSlice(rt.Gw)
+				sr.Gateway = gw.Unmap()
+			}
+			if full && sr.Prefix.Bits() > 0 && !sr.Connected {
+				continue
+			}
+			system = append(system, sr)
+		}
+	}
+	return router.CheckRoutes(c, system), nil
+}
@@ -0,0 +1,52 @@
+//go:build windows
+
+package osrouter
+
+import (
+	"fmt"
+
+	"github.com/wgtunnel/desktop/tunnel/vpn/router"
+	"golang.org/x/sys/windows"
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+)
+
+// CheckRoutes compares the config's routes against the forwarding table of the other interfaces.
+func (r *windowsRouter) CheckRoutes(c *router.Config) ([]router.RouteWarning, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	rows, err := winipcfg.GetIPForwardTable2(windows.AF_UNSPEC)
+	if err != nil {
+		return nil, fmt.Errorf("get forward table: %w", err)
+	}
+
+	names := make(map[winipcfg.LUID]string)
+	var system []router.SystemRoute
+	for _, row := range rows {
+		if row.InterfaceLUID == r.luid {
+			continue
+		}
+		prefix := row.DestinationPrefix.Prefix()
+		// skip host, multicast and broadcast routes the stack adds for every interface
+		if prefix.IsSingleIP() || prefix.Addr().IsMulticast() || prefix.Addr().IsLoopback() {
+			continue
+		}
+		name, ok := names[row.InterfaceLUID]
+		if !ok {
+			name = fmt.Sprintf("LUID %d", row.InterfaceLUID)
+			if ifRow, err := row.InterfaceLUID.Interface(); err == nil {
+				name = ifRow.Alias()
+			}
+			names[row.InterfaceLUID] = name
+		}
+		gw := row.NextHop.Addr()
+		system = append(system, router.SystemRoute{
+			Prefix:    prefix,
+			Gateway:   gw,
+			Iface:     name,
+			Connected: !gw.IsValid() || gw.IsUnspecified(),
+		})
+	}
+	return router.CheckRoutes(c, system), nil
+}
@@ -0,0 +1,103 @@
+//go:build linux
+
+package osrouter
+
+import (
+	"maps"
+	"net/netip"
+	"slices"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+	"github.com/wgtunnel/desktop/tunnel/vpn/router"
+)
+
+// liveTunnel is the routing policy of a tunnel that is up, as the other tunnels' routers see it.
+type liveTunnel struct {
+	policy routingPolicy
+	// full is also set on an idle tunnel holding the kill switch
+	full bool
+	idle bool
+	// excluded are the prefixes of the tunnel's exclude rules, and blockV6 is set while it has the IPv6 suppress rule
+	excluded []netip.Prefix
+	blockV6  bool
+}
+
+var (
+	liveMu sync.Mutex
+	// liveTunnels are the tunnels of this process with a config applied, by interface
+	liveTunnels = map[string]liveTunnel{}
+)
+
+// registerTunnel records the iface's applied config, an empty one removes it.
+func registerTunnel(iface string, c *router.Config) {
+	liveMu.Lock()
+	defer liveMu.Unlock()
+	if c == nil || c.Equal(&router.Config{}) {
+		delete(liveTunnels, iface)
+		return
+	}
+	t := liveTunnel{
+		policy:  policyFor(c),
+		full:    hasDefault(c, true) || hasDefault(c, false) || c.HoldKillSwitch,
+		idle:    c.IsIdle(),
+		blockV6: blocksV6(c),
+	}
+	for _, v4 := range []bool{true, false} {
+		if hasDefault(c, v4) {
+			t.excluded = append(t.excluded, filterRoutes(c.ExcludedRoutes, v4)...)
+		}
+	}
+	liveTunnels[iface] = t
+}
+
+// otherTunnels returns the live tunnels other than iface.
+func otherTunnels(iface string) map[string]liveTunnel {
+	liveMu.Lock()
+	defer liveMu.Unlock()
+	others := maps.Clone(liveTunnels)
+	delete(others, iface)
+	return others
+}
+
+// otherFullTunnel reports whether a full tunnel other than iface is up, which needs the kill switch to stay enabled.
+func otherFullTunnel(iface string) bool {
+	for _, t := range otherTunnels(iface) {
+		if t.full {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleTunnel returns the live tunnel the rule belongs to, or "" for none.
+func ruleTunnel(rule netlink.Rule, others map[string]liveTunnel) string {
+	for iface, t := range others {
+		// an idle tunnel has no rules, its policy is our default one
+		if !t.idle && isOwnRule(rule, []routingPolicy{t.policy}) {
+			return iface
+		}
+	}
+	return ""
+}
+
+// sharedExcludeRule reports whether a live tunnel other than iface has the exclude rule for lr at prio. Tunnels of the
+// same precedence share a band, so they install the same rule for a prefix they both exclude.
+func sharedExcludeRule(iface string, lr netip.Prefix, prio int) bool {
+	for _, t := range otherTunnels(iface) {
+		if !t.idle && t.policy.prioExclude == prio && slices.Contains(t.excluded, lr) {
+			return true
+		}
+	}
+	return false
+}
+
+// sharedSuppressRule reports whether a live tunnel other than iface has the IPv6 suppress rule at prio.
+func sharedSuppressRule(iface string, prio int) bool {
+	for _, t := range otherTunnels(iface) {
+		if !t.idle && t.blockV6 && t.policy.prioSuppress == prio {
+			return true
+		}
+	}
+	return false
+}
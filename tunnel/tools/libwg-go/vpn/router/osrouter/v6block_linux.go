@@ -0,0 +1,84 @@
+//go:build linux
+
+package osrouter
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/vishvananda/netlink"
+	"github.com/wgtunnel/desktop/tunnel/vpn/router"
+	"golang.org/x/sys/unix"
+)
+
+var v6Default = netip.MustParsePrefix("::/0")
+
+// blocksV6 reports whether the config tunnels all IPv4 but no IPv6 default, so IPv6 that would take the default route
+// is blocked instead of leaking past the tunnel.
+func blocksV6(c *router.Config) bool {
+	return hasDefault(c, true) && !hasDefault(c, false)
+}
+
+// addV6Block makes the tunnel table answer IPv6 default route traffic with unreachable. The main table is looked up
+// first without its default route, so on-link and split tunnel IPv6 routes keep working.
+func (r *linuxRouter) addV6Block(link netlink.Link, policy routingPolicy) error {
+	suppress := netlink.NewRule()
+	suppress.Family = netlink.FAMILY_V6
+	suppress.Priority = policy.prioSuppress
+	suppress.Table = unix.RT_TABLE_MAIN
+	suppress.SuppressPrefixlen = 0
+	if err := r.addRuleIdempotent(suppress); err != nil {
+		return fmt.Errorf("add v6 suppress rule: %w", err)
+	}
+
+	route := &netlink.Route{
+		Dst:   prefixToIPNet(v6Default),
+		Table: policy.table,
+		Type:  unix.RTN_UNREACHABLE,
+	}
+	if err := netlink.RouteReplace(route); err != nil {
+		return fmt.Errorf("add v6 unreachable route: %w", err)
+	}
+	r.logger.Verbosef("Blocking IPv6 outside the tunnel on %s", link.Attrs().Name)
+	return nil
+}
+
+// deleteV6Block removes the rule and route added by addV6Block, ignoring ones already gone. The rule stays while a
+// tunnel in the same band still blocks IPv6.
+func (r *linuxRouter) deleteV6Block(policy routingPolicy) {
+	if !sharedSuppressRule(r.iface, policy.prioSuppress) {
+		suppress := netlink.NewRule()
+		suppress.Family = netlink.FAMILY_V6
+		suppress.Priority = policy.prioSuppress
+		suppress.Table = unix.RT_TABLE_MAIN
+		suppress.SuppressPrefixlen = 0
+		if err := netlink.RuleDel(suppress); err != nil {
+			r.logger.Verbosef("del v6 suppress rule: %v (ignored)", err)
+		}
+	}
+
+	route := &netlink.Route{
+		Dst:   prefixToIPNet(v6Default),
+		Table: policy.table,
+		Type:  unix.RTN_UNREACHABLE,
+	}
+	if err := netlink.RouteDel(route); err != nil {
+		r.logger.Verbosef("del v6 unreachable route: %v (ignored)", err)
+	}
+}
+
+// syncV6BlockFirewall drops IPv6 leaving outside the tunnel while it blocks IPv6, for sockets bound to an interface
+// that skip the policy rules.
+func (r *linuxRouter) syncV6BlockFirewall(newC *router.Config) error {
+	if !r.v6Available || !blocksV6(newC) {
+		if err := r.fw.UnblockIPv6(r.iface); err != nil {
+			return fmt.Errorf("unblock IPv6: %w", err)
+		}
+		return nil
+	}
+	policy := policyFor(newC)
+	if err := r.fw.BlockIPv6(r.iface, policy.bypassMark, policy.bootstrapMark); err != nil {
+		return fmt.Errorf("block IPv6: %w", err)
+	}
+	return nil
+}
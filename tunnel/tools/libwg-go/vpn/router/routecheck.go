@@ -0,0 +1,85 @@
+package router
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+)
+
+// RouteWarningKind is how a tunnel route collides with the system routing table.
+type RouteWarningKind string
+
+const (
+	// RouteWarningLAN a tunnel route overlaps a subnet attached to another interface, e.g. the LAN
+	RouteWarningLAN RouteWarningKind = "lan"
+	// RouteWarningGateway a tunnel route covers the default gateway
+	RouteWarningGateway RouteWarningKind = "gateway"
+	// RouteWarningShadowed a more specific existing route keeps part of a tunnel route out of the tunnel
+	RouteWarningShadowed RouteWarningKind = "shadowed"
+)
+
+// RouteWarning is a tunnel route that overlaps the live routing table.
+type RouteWarning struct {
+	Kind RouteWarningKind `json:"kind"`
+	// Route is the tunnel route
+	Route netip.Prefix `json:"route"`
+	// Existing is the system route or subnet it collides with
+	Existing netip.Prefix `json:"existing"`
+	Iface    string       `json:"iface,omitempty"`
+}
+
+func (w RouteWarning) String() string {
+	switch w.Kind {
+	case RouteWarningLAN:
+		return fmt.Sprintf("tunnel route %v overlaps subnet %v on %s", w.Route, w.Existing, w.Iface)
+	case RouteWarningGateway:
+		return fmt.Sprintf("tunnel route %v covers the default gateway %v on %s", w.Route, w.Existing.Addr(), w.Iface)
+	default:
+		return fmt.Sprintf("tunnel route %v is shadowed by the more specific route %v on %s", w.Route, w.Existing, w.Iface)
+	}
+}
+
+// SystemRoute is a route of another interface in the live routing table.
+type SystemRoute struct {
+	Prefix  netip.Prefix
+	Gateway netip.Addr
+	Iface   string
+	// Connected is set for subnets attached to the interface, which have no gateway
+	Connected bool
+}
+
+// CheckRoutes compares the config's routes, less its excluded routes, against the system routes. Default routes in
+// the config are a deliberate full tunnel and are not reported.
+func CheckRoutes(c *Config, system []SystemRoute) []RouteWarning {
+	if c == nil {
+		return nil
+	}
+	var warnings []RouteWarning
+	for _, rt := range ExcludePrefixes(c.Routes, c.ExcludedRoutes) {
+		if rt.Bits() == 0 {
+			continue
+		}
+		for _, sr := range system {
+			switch {
+			case sr.Prefix.Bits() == 0:
+				if sr.Gateway.IsValid() && rt.Contains(sr.Gateway) {
+					warnings = append(warnings, RouteWarning{
+						Kind:     RouteWarningGateway,
+						Route:    rt,
+						Existing: netip.PrefixFrom(sr.Gateway, sr.Gateway.BitLen()),
+						Iface:    sr.Iface,
+					})
+				}
+			case slices.Contains(c.PeerEndpoints, sr.Prefix):
+				// peer endpoint protection routes are expected to be more specific
+			case sr.Connected:
+				if rt.Overlaps(sr.Prefix) {
+					warnings = append(warnings, RouteWarning{Kind: RouteWarningLAN, Route: rt, Existing: sr.Prefix, Iface: sr.Iface})
+				}
+			case sr.Prefix.Bits() > rt.Bits() && rt.Contains(sr.Prefix.Addr()):
+				warnings = append(warnings, RouteWarning{Kind: RouteWarningShadowed, Route: rt, Existing: sr.Prefix, Iface: sr.Iface})
+			}
+		}
+	}
+	return warnings
+}
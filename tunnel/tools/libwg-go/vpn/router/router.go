@@ -8,6 +8,8 @@ import (
 	"net/netip"
 	"reflect"
 	"slices"
+
+	"go4.org/netipx"
 )
 
 // Router is responsible for managing the system network stack.
@@ -23,8 +25,27 @@ type Router interface {
 
 	// GetPhysicalInterfaceIndex only relevant for windows, returns the index of the default physical interface
 	GetPhysicalInterfaceIndex() uint32
+
+	// Preflight checks the config against the live system for routing tables, marks and rule priorities
+	// already owned by others. It returns a copy of the config with automatic values resolved, which should be
+	// passed to Set, along with any conflicts found. The error is a *ConflictError if a conflict is fatal.
+	Preflight(*Config) (*Config, []Conflict, error)
+
+	// CheckRoutes compares the config's routes against the live routing table and attached subnets of other
+	// interfaces, returning routes that would take over the LAN or default gateway or that are shadowed.
+	CheckRoutes(*Config) ([]RouteWarning, error)
 }
 
+const (
+	// TableAuto selects the router's default policy routing table.
+	TableAuto = 0
+	// TableOff mirrors wg-quick's Table = off, no routes or policy rules are installed.
+	TableOff = -1
+
+	// MaxPrecedence keeps the priority bands of every precedence clear of the kernel's main and default rules.
+	MaxPrecedence = 100
+)
+
 // Config is the subset of configuration that is relevant to our Router
 type Config struct {
 	// TunnelAddrs are the addresses for the tunnel interface
@@ -35,10 +56,17 @@ type Config struct {
 
 	SearchDomains []string
 
+	// RoutingDomains are resolved only by the tunnel DNS, along with their subdomains, without being searched.
+	// Written with a leading ~ in the config's DNS list, as resolvectl does. Linux only.
+	RoutingDomains []string
+
 	// Routes are the routes that point into the tunnel
 	// interface.  These are the /32 and /128 routes to peers, (AllowedIps).
 	Routes []netip.Prefix
 
+	// ExcludedRoutes always go via the physical network, even when Routes contains a default route.
+	ExcludedRoutes []netip.Prefix
+
 	// Falls back to WG default if not set
 	MTU int
 
@@ -47,6 +75,34 @@ type Config struct {
 
 	// Generated by system if not set
 	ListenPort uint16
+
+	// Table is the policy routing table of the tunnel's routes, TableAuto or TableOff. Linux only.
+	// TableAuto picks the default table, or the next free one if another owner or tunnel already uses it. The main
+	// table is refused for a full tunnel, its default route would replace the system's one, a split tunnel's routes
+	// go to it without a rule.
+	Table int
+
+	// FwMark is applied to the tunnel's encrypted traffic so it bypasses the tunnel table.
+	// Zero picks the default mark, or a free one if another owner already uses it.
+	FwMark uint32
+
+	// BootstrapMark is applied to DNS bootstrap traffic so it always leaves via the physical interface.
+	// Zero picks the default mark, or a free one if another owner already uses it.
+	BootstrapMark uint32
+
+	// RulePriority is the base priority of the tunnel's policy rules.
+	// Zero picks the priority band of Precedence, or the next free one if another owner already uses it. Other
+	// tunnels don't move a tunnel out of its band.
+	RulePriority int
+
+	// Precedence orders tunnels that are up at the same time, lower first. Of several full tunnels, the lowest
+	// carries default traffic and takes the default DNS route, the others' rules are evaluated after it. Tunnels of
+	// the same precedence share a band, the first up comes first. Linux only.
+	Precedence int
+
+	// HoldKillSwitch keeps a kill switch the tunnel enabled in place while nothing else is set, e.g. while the tunnel
+	// is paused. A kill switch that stays up lets the paused tunnel's FwMark and BootstrapMark traffic through.
+	HoldKillSwitch bool
 }
 
 func (c *Config) Equal(b *Config) bool {
@@ -66,7 +122,10 @@ func (c *Config) Clone() *Config {
 	c2 := *c
 	c2.TunnelAddrs = slices.Clone(c.TunnelAddrs)
 	c2.DNS = slices.Clone(c.DNS)
+	c2.SearchDomains = slices.Clone(c.SearchDomains)
+	c2.RoutingDomains = slices.Clone(c.RoutingDomains)
 	c2.Routes = slices.Clone(c.Routes)
+	c2.ExcludedRoutes = slices.Clone(c.ExcludedRoutes)
 	return &c2
 }
 
@@ -83,6 +142,35 @@ func (c *Config) hasDefaultRoute(v4 bool) bool {
 	return false
 }
 
+// IsIdle reports whether the config sets nothing up but possibly holds the kill switch for a paused tunnel's marks.
+func (c *Config) IsIdle() bool {
+	return c == nil || c.Equal(&Config{FwMark: c.FwMark, BootstrapMark: c.BootstrapMark, HoldKillSwitch: c.HoldKillSwitch})
+}
+
+// RoutesDisabled reports whether the config asks for no routes to be installed (Table = off).
+func (c *Config) RoutesDisabled() bool {
+	return c != nil && c.Table == TableOff
+}
+
 func (c *Config) HasAnyDefaultRoute() bool {
 	return c.hasDefaultRoute(true) || c.hasDefaultRoute(false)
 }
+
+// ExcludePrefixes returns the minimal set of prefixes covering routes but none of excluded.
+func ExcludePrefixes(routes, excluded []netip.Prefix) []netip.Prefix {
+	if len(excluded) == 0 {
+		return routes
+	}
+	var b netipx.IPSetBuilder
+	for _, rt := range routes {
+		b.AddPrefix(rt.Masked())
+	}
+	for _, ex := range excluded {
+		b.RemovePrefix(ex.Masked())
+	}
+	set, err := b.IPSet()
+	if err != nil {
+		return routes
+	}
+	return set.Prefixes()
+}
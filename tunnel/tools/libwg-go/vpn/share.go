@@ -0,0 +1,62 @@
+//go:build !android
+
+package vpn
+
+import "C"
+import (
+	"github.com/wgtunnel/desktop/tunnel/shared"
+	"github.com/wgtunnel/desktop/tunnel/vpn/firewall"
+	"github.com/wgtunnel/desktop/tunnel/vpn/firewall/osfirewall/firewallmgr"
+)
+
+// getSharer returns the firewall if it supports sharing.
+func getSharer() (firewall.Sharer, bool) {
+	fw, err := firewallmgr.Get()
+	if err != nil {
+		return nil, false
+	}
+	sharer, ok := fw.(firewall.Sharer)
+	return sharer, ok
+}
+
+// stopSharing disables sharing if it goes through the handle's tunnel.
+func (h *TunnelHandle) stopSharing() {
+	if h.ifName == "" {
+		return
+	}
+	sharer, ok := getSharer()
+	if !ok {
+		return
+	}
+	if _, tunIface := sharer.SharingIfaces(); tunIface != h.ifName {
+		return
+	}
+	if err := sharer.DisableSharing(); err != nil {
+		logger.Errorf("Stop sharing: %v", err)
+	}
+}
+
+//export awgSetLanSharing
+func awgSetLanSharing(tunnelHandle C.int, lanIface *C.char) C.int {
+	handle, ok := getHandle(int32(tunnelHandle))
+	if !ok {
+		shared.LogError("Tunnel is not up")
+		return C.int(-1)
+	}
+	sharer, ok := getSharer()
+	if !ok {
+		shared.LogError("LAN sharing is not supported by this firewall")
+		return C.int(-1)
+	}
+
+	lan := C.GoString(lanIface)
+	if lan == "" {
+		handle.stopSharing()
+		return C.int(0)
+	}
+	if err := sharer.EnableSharing(lan, handle.ifName); err != nil {
+		shared.LogError("Failed to share tunnel with %s: %v", lan, err)
+		return C.int(-1)
+	}
+	return C.int(0)
+}
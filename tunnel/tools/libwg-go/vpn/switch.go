@@ -0,0 +1,179 @@
+//go:build !android
+
+package vpn
+
+import "C"
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+	"github.com/wgtunnel/desktop/tunnel/shared"
+	"github.com/wgtunnel/desktop/tunnel/vpn/router"
+)
+
+const (
+	// switchHandshakeTimeout is how long a switch waits for the new tunnel's first handshake before rolling back
+	switchHandshakeTimeout = 15 * time.Second
+	handshakePollInterval  = 250 * time.Millisecond
+)
+
+// switchTunnel brings the settings up next to the handle's tunnel and moves the handle over once the new tunnel has
+// handshaken. The old tunnel keeps carrying traffic and DNS until then, and is kept if the new one fails. Turning the
+// handle off meanwhile cancels the switch.
+func switchTunnel(handleID int32, old *TunnelHandle, settings string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handlesMu.Lock()
+	if tunnelHandles[handleID] != old {
+		handlesMu.Unlock()
+		return errors.New("tunnel is not up")
+	}
+	if old.cancelSwitch != nil {
+		handlesMu.Unlock()
+		return errors.New("a switch is already in progress")
+	}
+	old.cancelSwitch = cancel
+	handlesMu.Unlock()
+
+	h, err := startTunnel(handleID, settings, old)
+	if err != nil {
+		// the partial tunnel was closed, which may have removed state the old one shares
+		endSwitch(handleID, old)
+		return err
+	}
+
+	ctx, cancelWait := context.WithTimeout(ctx, switchHandshakeTimeout)
+	defer cancelWait()
+	return completeSwitch(handleID, old, h, func() error { return waitHandshake(ctx, h.device) })
+}
+
+// completeSwitch moves the handle from old to the staged tunnel h once wait returns, setting h's DNS. On failure h is
+// closed and old's router state set again, unless the handle was turned off meanwhile.
+func completeSwitch(handleID int32, old, h *TunnelHandle, wait func() error) error {
+	err := wait()
+	if err == nil {
+		h.staged.Store(false)
+		err = h.router.Set(h.routerCfg)
+	}
+	if err != nil {
+		shared.LogWarn("Switch of handle %d failed, keeping the old tunnel: %v", handleID, err)
+		h.close()
+		endSwitch(handleID, old)
+		return err
+	}
+
+	// held until the old tunnel is gone, so turning the handle off closes the new one only once it's in place
+	handlesMu.Lock()
+	defer handlesMu.Unlock()
+	old.cancelSwitch = nil
+	if tunnelHandles[handleID] != old {
+		h.close()
+		return errors.New("tunnel was turned off during the switch")
+	}
+
+	// sharing moves to the new tunnel before the old one stops it
+	if sharer, ok := getSharer(); ok {
+		if lan, tunIface := sharer.SharingIfaces(); tunIface == old.ifName && lan != "" {
+			if err := sharer.EnableSharing(lan, h.ifName); err != nil {
+				logger.Errorf("Move sharing to %s: %v", h.ifName, err)
+			}
+		}
+	}
+
+	// closing the old router removes its rules, leaving the new tunnel's in place for its traffic and DNS
+	tunnelHandles[handleID] = h
+	old.close()
+
+	if err := h.restoreRulePriority(); err != nil {
+		logger.Errorf("Move %s rules back to priority %d: %v", h.ifName, h.rulePriority, err)
+	}
+	shared.LogDebug("Handle %d switched from %s to %s", handleID, old.ifName, h.ifName)
+	return nil
+}
+
+// endSwitch ends a failed switch, setting old's router state again unless the handle was turned off meanwhile.
+func endSwitch(handleID int32, old *TunnelHandle) {
+	handlesMu.Lock()
+	defer handlesMu.Unlock()
+	old.cancelSwitch = nil
+	if tunnelHandles[handleID] != old {
+		return
+	}
+	if err := old.reapply(); err != nil {
+		logger.Errorf("Restore %s after the failed switch: %v", old.ifName, err)
+	}
+}
+
+// restoreRulePriority moves the rules to the priority the old tunnel's had once it's closed, so they don't creep into
+// the next precedence band switch by switch.
+func (h *TunnelHandle) restoreRulePriority() error {
+	if h.routerCfg.RulePriority == h.rulePriority {
+		return nil
+	}
+	cfg := h.routerCfg.Clone()
+	cfg.RulePriority = h.rulePriority
+	if err := h.router.Set(cfg); err != nil {
+		return err
+	}
+	h.routerCfg = cfg
+	return nil
+}
+
+// withoutDNS returns a copy of the config leaving DNS to the other tunnels.
+func withoutDNS(c *router.Config) *router.Config {
+	c = c.Clone()
+	c.DNS, c.SearchDomains, c.RoutingDomains = nil, nil, nil
+	return c
+}
+
+// waitHandshake polls the device until any peer has completed a handshake.
+func waitHandshake(ctx context.Context, d *device.Device) error {
+	ticker := time.NewTicker(handshakePollInterval)
+	defer ticker.Stop()
+	for {
+		settings, err := d.IpcGet()
+		if err != nil {
+			return err
+		}
+		if hasHandshake(settings) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.Canceled) {
+				return errors.New("switch cancelled")
+			}
+			return errors.New("no handshake before the timeout")
+		case <-ticker.C:
+		}
+	}
+}
+
+// hasHandshake reports whether the UAPI settings show a peer with a completed handshake.
+func hasHandshake(settings string) bool {
+	for _, line := range strings.Split(settings, "\n") {
+		value, ok := strings.CutPrefix(line, "last_handshake_time_sec=")
+		if ok && value != "0" {
+			return true
+		}
+	}
+	return false
+}
+
+//export awgSwitch
+func awgSwitch(tunnelHandle C.int, settings *C.char) C.int {
+	id := int32(tunnelHandle)
+	old, ok := getHandle(id)
+	if !ok {
+		shared.LogError("Tunnel is not up")
+		return C.int(-1)
+	}
+	if err := switchTunnel(id, old, C.GoString(settings)); err != nil {
+		shared.LogError("Failed to switch tunnel: %v", err)
+		return C.int(-1)
+	}
+	return C.int(0)
+}
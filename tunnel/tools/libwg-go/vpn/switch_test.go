@@ -0,0 +1,203 @@
+//go:build !android
+
+package vpn
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/wgtunnel/desktop/tunnel/vpn/router"
+)
+
+// callLog is the log of router calls shared between fake routers, which a switch and a turn-off call concurrently.
+type callLog struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (l *callLog) add(call string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.calls = append(l.calls, call)
+}
+
+func (l *callLog) get() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Clone(l.calls)
+}
+
+// fakeRouter records the calls made to it into a log shared between routers.
+type fakeRouter struct {
+	name   string
+	log    *callLog
+	setCfg *router.Config
+	setErr error
+}
+
+func (r *fakeRouter) Set(c *router.Config) error {
+	r.log.add(r.name + " set")
+	r.setCfg = c
+	return r.setErr
+}
+
+func (r *fakeRouter) Close() error {
+	r.log.add(r.name + " close")
+	return nil
+}
+
+func (r *fakeRouter) GetPhysicalInterfaceIndex() uint32 { return 0 }
+
+func (r *fakeRouter) Preflight(c *router.Config) (*router.Config, []router.Conflict, error) {
+	return c, nil, nil
+}
+
+func (r *fakeRouter) CheckRoutes(*router.Config) ([]router.RouteWarning, error) { return nil, nil }
+
+func TestCompleteSwitchRollback(t *testing.T) {
+	oldCfg := &router.Config{
+		Routes: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		DNS:    []netip.Addr{netip.MustParseAddr("10.0.0.1")},
+	}
+	newCfg := &router.Config{
+		Routes: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		DNS:    []netip.Addr{netip.MustParseAddr("10.1.0.1")},
+	}
+
+	tests := []struct {
+		name      string
+		waitErr   error
+		setErr    error
+		paused    bool
+		wantLog   []string
+		wantOldTo *router.Config
+	}{
+		{
+			name:      "no handshake",
+			waitErr:   errors.New("no handshake before the timeout"),
+			wantLog:   []string{"new close", "old set"},
+			wantOldTo: oldCfg,
+		},
+		{
+			name:      "setting the DNS fails",
+			setErr:    errors.New("set DNS"),
+			wantLog:   []string{"new set", "new close", "old set"},
+			wantOldTo: oldCfg,
+		},
+		{
+			name:      "old tunnel paused",
+			waitErr:   errors.New("no handshake before the timeout"),
+			paused:    true,
+			wantLog:   []string{"new close", "old set"},
+			wantOldTo: &router.Config{HoldKillSwitch: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := &callLog{}
+			oldRouter := &fakeRouter{name: "old", log: log}
+			old := &TunnelHandle{router: oldRouter, routerCfg: oldCfg, pauseBlock: true}
+			old.paused.Store(tt.paused)
+			h := &TunnelHandle{router: &fakeRouter{name: "new", log: log, setErr: tt.setErr}, routerCfg: newCfg}
+			h.staged.Store(true)
+
+			tunnelHandles[7] = old
+			t.Cleanup(func() { delete(tunnelHandles, 7) })
+			if err := completeSwitch(7, old, h, func() error { return tt.waitErr }); err == nil {
+				t.Fatal("completeSwitch() succeeded")
+			}
+			if tunnelHandles[7] != old {
+				t.Error("handle moved to the failed tunnel")
+			}
+			if got := log.get(); !slices.Equal(got, tt.wantLog) {
+				t.Fatalf("calls = %q, want %q", got, tt.wantLog)
+			}
+			if !oldRouter.setCfg.Equal(tt.wantOldTo) {
+				t.Errorf("old router set to %+v, want %+v", oldRouter.setCfg, tt.wantOldTo)
+			}
+		})
+	}
+}
+
+func TestTurnOffCancelsSwitch(t *testing.T) {
+	log := &callLog{}
+	old := &TunnelHandle{router: &fakeRouter{name: "old", log: log}, routerCfg: &router.Config{}}
+	h := &TunnelHandle{router: &fakeRouter{name: "new", log: log}, routerCfg: &router.Config{}}
+	h.staged.Store(true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	old.cancelSwitch = cancel
+	tunnelHandles[7] = old
+	t.Cleanup(func() { delete(tunnelHandles, 7) })
+
+	waiting := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- completeSwitch(7, old, h, func() error {
+			close(waiting)
+			<-ctx.Done()
+			return ctx.Err()
+		})
+	}()
+	<-waiting
+	turnOff(7)
+	if err := <-done; err == nil {
+		t.Fatal("completeSwitch() succeeded")
+	}
+
+	if _, ok := getHandle(7); ok {
+		t.Error("handle still up after the turn-off")
+	}
+	got := log.get()
+	slices.Sort(got)
+	if want := []string{"new close", "old close"}; !slices.Equal(got, want) {
+		t.Errorf("calls = %q, want %q", got, want)
+	}
+}
+
+func TestRestoreRulePriority(t *testing.T) {
+	log := &callLog{}
+	r := &fakeRouter{name: "new", log: log}
+	h := &TunnelHandle{router: r, routerCfg: &router.Config{RulePriority: 101}, rulePriority: 100}
+
+	if err := h.restoreRulePriority(); err != nil {
+		t.Fatal(err)
+	}
+	if r.setCfg == nil || r.setCfg.RulePriority != 100 || h.routerCfg.RulePriority != 100 {
+		t.Fatalf("router set to %+v, handle config %+v, want priority 100", r.setCfg, h.routerCfg)
+	}
+	if err := h.restoreRulePriority(); err != nil {
+		t.Fatal(err)
+	}
+	if got := log.get(); !slices.Equal(got, []string{"new set"}) {
+		t.Errorf("calls = %q, want one set", got)
+	}
+}
+
+func TestStagedConfig(t *testing.T) {
+	cfg := &router.Config{
+		DNS:            []netip.Addr{netip.MustParseAddr("10.1.0.1")},
+		SearchDomains:  []string{"corp.example"},
+		RoutingDomains: []string{"internal.example"},
+		Routes:         []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")},
+	}
+	h := &TunnelHandle{}
+	if got := h.stagedConfig(cfg); got != cfg {
+		t.Errorf("unstaged tunnel got %+v, want the config itself", got)
+	}
+
+	h.staged.Store(true)
+	got := h.stagedConfig(cfg)
+	want := &router.Config{Routes: cfg.Routes}
+	if !got.Equal(want) {
+		t.Errorf("staged tunnel got %+v, want %+v", got, want)
+	}
+	if len(cfg.DNS) != 1 {
+		t.Error("staging changed the tunnel's config")
+	}
+}
@@ -11,11 +11,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"maps"
 	"net"
 	"net/netip"
 	"os"
 	"os/signal"
 	"runtime"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -30,7 +32,9 @@ import (
 	"github.com/wgtunnel/desktop/tunnel/shared"
 	"github.com/wgtunnel/desktop/tunnel/util"
 	bind2 "github.com/wgtunnel/desktop/tunnel/vpn/bind"
+	vpndns "github.com/wgtunnel/desktop/tunnel/vpn/dns"
 	"github.com/wgtunnel/desktop/tunnel/vpn/firewall"
+	"github.com/wgtunnel/desktop/tunnel/vpn/firewall/mark"
 	"github.com/wgtunnel/desktop/tunnel/vpn/firewall/osfirewall/firewallmgr"
 	"github.com/wgtunnel/desktop/tunnel/vpn/router"
 	"github.com/wgtunnel/desktop/tunnel/vpn/router/osrouter"
@@ -42,11 +46,34 @@ type TunnelHandle struct {
 	router         router.Router
 	cancel         context.CancelFunc
 	needsResolving atomic.Bool
+	routeWarnings  []router.RouteWarning
+	dnsForwarder   *vpndns.Forwarder
+	ifName         string
+	configNames    map[string][]netip.Addr
+	apiNames       map[string][]netip.Addr
+	configInbound  firewall.InboundPolicy
+	apiInbound     *firewall.InboundPolicy
+	// routerCfg is the config last applied to the router, which has it without DNS while the tunnel is staged
+	routerCfg *router.Config
+	// slot picks the interface name, a switch alternates it between the old and the new tunnel
+	slot int
+	// staged is set while a switch waits for the tunnel's handshake, the router has its config without DNS until then
+	staged atomic.Bool
+	// paused is set while the router holds nothing but possibly the kill switch, see awgPause
+	paused     atomic.Bool
+	pauseBlock bool
+	// rulePriority is the priority the rules move back to once a switch's old tunnel is closed, the switch puts them
+	// one after the old tunnel's
+	rulePriority int
+	// cancelSwitch cancels a switch away from the tunnel while it's in progress, guarded by handlesMu
+	cancelSwitch context.CancelFunc
 }
 
 var (
-	tag              = "AwgVPN"
-	tunnelHandles    = make(map[int32]*TunnelHandle)
+	tag           = "AwgVPN"
+	tunnelHandles = make(map[int32]*TunnelHandle)
+	// handlesMu guards tunnelHandles, which the exports and a switch waiting for its handshake access concurrently
+	handlesMu        sync.Mutex
 	resolvingHandles = sync.Map{}
 	logger           = shared.NewLogger(tag)
 )
@@ -66,7 +93,9 @@ func handleSignals() {
 
 //export awgTurnOn
 func awgTurnOn(settings *C.char, callback C.StatusCodeCallback) C.int {
+	handlesMu.Lock()
 	handleID, err := util.GenerateHandle(tunnelHandles)
+	handlesMu.Unlock()
 	if err != nil {
 		shared.LogError(tag, "Unable to find empty handle", err)
 		return C.int(-1)
@@ -74,24 +103,53 @@ func awgTurnOn(settings *C.char, callback C.StatusCodeCallback) C.int {
 
 	shared.StoreTunnelCallback(handleID, shared.StatusCodeCallback(callback))
 
-	h := &TunnelHandle{}
-	var success bool
+	h, err := startTunnel(handleID, C.GoString(settings), nil)
+	if err != nil {
+		logger.Errorf("Start tunnel: %v", err)
+		return C.int(-1)
+	}
+	handlesMu.Lock()
+	tunnelHandles[handleID] = h
+	handlesMu.Unlock()
+	shared.LogDebug(tag, "Device started successfully; DNS bypasses active for handle %d", handleID)
+
+	return C.int(handleID)
+}
+
+// tunnelIfName names the handle's interface, a switch brings the new tunnel up on the other slot.
+func tunnelIfName(handleID int32, slot int) string {
+	if slot == 0 {
+		return fmt.Sprintf("wgtun%d", handleID)
+	}
+	return fmt.Sprintf("wgtun%db", handleID)
+}
+
+// startTunnel creates the device, router and firewall state for the settings. With prev, the tunnel is staged on
+// the other interface slot next to prev's, inheriting its API overrides. The partial state is closed on failure.
+func startTunnel(handleID int32, goSettings string, prev *TunnelHandle) (h *TunnelHandle, err error) {
+	h = &TunnelHandle{}
+	if prev != nil {
+		h.slot = 1 - prev.slot
+		h.apiNames = prev.apiNames
+		h.apiInbound = prev.apiInbound
+	}
 
 	defer func() {
-		if !success {
+		if err != nil {
 			shared.LogDebug(tag, "Startup failed, cleaning up partial resources for handle %d", handleID)
 			h.close()
 			resolvingHandles.Delete(handleID)
 		}
 	}()
 
-	goSettings := C.GoString(settings)
 	conf, err := wireproxyawg.ParseConfigString(goSettings)
 	if err != nil {
-		shared.LogError(tag, "Invalid config file", err)
-		return C.int(-1)
+		return nil, fmt.Errorf("invalid config file: %w", err)
+	}
+	ifOpts, err := parseInterfaceOptions(goSettings)
+	if err != nil {
+		return nil, fmt.Errorf("invalid interface options: %w", err)
 	}
-
 	tunnelCtx, tunnelCancel := context.WithCancel(context.Background())
 	h.cancel = tunnelCancel
 
@@ -117,20 +175,63 @@ func awgTurnOn(settings *C.char, callback C.StatusCodeCallback) C.int {
 		}
 	}
 
-	ifName := fmt.Sprintf("wgtun%d", handleID)
+	ifName := tunnelIfName(handleID, h.slot)
+	h.ifName = ifName
 	tunnel, err := tun.CreateTUN(ifName, conf.Device.MTU)
 	if err != nil {
-		shared.LogError(tag, "Create TUN failed", err)
-		return C.int(-1)
+		return nil, fmt.Errorf("create TUN: %w", err)
+	}
+
+	fw, err := newFirewall()
+	if err != nil {
+		tunnel.Close()
+		return nil, err
+	}
+
+	r, err := newRouter(ifName, fw, tunnel)
+	if err != nil {
+		tunnel.Close()
+		return nil, err
+	}
+	h.router = r
+
+	// resolve the routing table, marks and rule priorities before the bind takes its mark
+	preflightCfg, err := parseToRouterConfig(conf, 0, ifOpts)
+	if err != nil {
+		tunnel.Close()
+		return nil, err
+	}
+	following := prev != nil && ifOpts.rulePriority == 0 && prev.routerCfg != nil && prev.routerCfg.RulePriority > 0
+	if following {
+		// one ahead of prev's rules, its bypass rules come before prev's default rule while prev's comes first
+		preflightCfg.RulePriority = prev.routerCfg.RulePriority + 1
+	}
+	resolvedCfg, conflicts, err := h.router.Preflight(preflightCfg)
+	for _, c := range conflicts {
+		shared.LogWarn("Routing conflict: %s", c)
+	}
+	if err != nil {
+		tunnel.Close()
+		return nil, fmt.Errorf("routing preflight: %w", err)
+	}
+	ifOpts = ifOpts.withResolved(resolvedCfg)
+	h.pauseBlock = ifOpts.pauseBlock
+	h.rulePriority = resolvedCfg.RulePriority
+	if following {
+		h.rulePriority = prev.rulePriority
 	}
 
 	bind := conn.NewDefaultBind()
-	if err := bind2.SetupBind(logger, bind); err != nil {
+	if err := bind2.SetupBind(logger, bind, mark.OrDefault(ifOpts.fwMark, mark.LinuxBypassMarkNum)); err != nil {
 		tunnel.Close()
-		return C.int(-1)
+		return nil, fmt.Errorf("setup bind: %w", err)
 	}
 
 	statusCB := func(code device.StatusCode) {
+		if code == shared.StatusHealthy {
+			// the tunnel is through any captive portal, re-arm a paused kill switch
+			go firewallmgr.TunnelHandshake()
+		}
 		go shared.NotifyStatusCode(handleID, int32(code))
 	}
 
@@ -143,15 +244,13 @@ func awgTurnOn(settings *C.char, callback C.StatusCodeCallback) C.int {
 
 	_, port, err := h.device.Bind().Open(listenPort)
 	if err != nil {
-		shared.LogError(tag, "Failed to open bind", err)
-		return C.int(-1)
+		return nil, fmt.Errorf("open bind: %w", err)
 	}
 
 	ifaceName, _ := tunnel.Name()
 	uapi, err := ipc.SetupIPC(ifaceName)
 	if err != nil {
-		shared.LogError(tag, "Setup IPC failed", err)
-		return C.int(-1)
+		return nil, fmt.Errorf("setup IPC: %w", err)
 	}
 	h.uapi = uapi
 
@@ -167,50 +266,65 @@ func awgTurnOn(settings *C.char, callback C.StatusCodeCallback) C.int {
 
 	ipcRequest, err := wireproxyawg.CreateIPCRequest(conf.Device, false)
 	if err != nil {
-		return C.int(-1)
+		return nil, err
 	}
 	if err := h.device.IpcSet(ipcRequest.IpcRequest); err != nil {
-		return C.int(-1)
+		return nil, err
 	}
 
-	fw, err := newFirewall()
-	if err != nil {
-		return C.int(-1)
+	if err := h.device.Up(); err != nil {
+		return nil, err
 	}
 
-	r, err := newRouter(ifaceName, fw, tunnel)
+	// parse config to router config for router/fw
+	routerCfg, err := parseToRouterConfig(conf, port, ifOpts)
 	if err != nil {
-		return C.int(-1)
+		return nil, err
 	}
-	h.router = r
-
-	if err := h.device.Up(); err != nil {
-		return C.int(-1)
+	if ifOpts.dnsForwarder {
+		h.dnsForwarder, err = startDnsForwarder(forwarderAddr(handleID, h.slot), routerCfg.DNS, ifOpts)
+		if err != nil {
+			return nil, fmt.Errorf("start DNS forwarder: %w", err)
+		}
+		h.useDnsForwarder(routerCfg)
+	}
+	if err := checkRoutes(h, routerCfg); err != nil {
+		return nil, fmt.Errorf("refusing to start: %w", err)
+	}
+	// a switch leaves DNS with the old tunnel until this one has handshaken, see completeSwitch
+	h.staged.Store(prev != nil)
+	if err := h.router.Set(h.stagedConfig(routerCfg)); err != nil {
+		return nil, err
+	}
+	h.routerCfg = routerCfg
+	if watcher, ok := h.router.(router.DriftWatcher); ok {
+		if err := watcher.WatchDrift(ifOpts.driftAction, driftNotifier(handleID)); err != nil {
+			logger.Errorf("Failed to watch for state drift: %v", err)
+		}
 	}
 
-	// parse config to router config for router/fw
-	routerCfg, err := parseToRouterConfig(conf, port)
-	if err != nil {
-		return C.int(-1)
+	// refuse to run unprotected when the config asks to block inbound
+	peerNames := parsePeerNames(goSettings)
+	h.configInbound = configInboundPolicy(conf, ifOpts, peerNames)
+	if err := h.syncInboundPolicy(); err != nil {
+		return nil, fmt.Errorf("set inbound policy: %w", err)
 	}
-	if err := h.router.Set(routerCfg); err != nil {
-		return C.int(-1)
+
+	// name the peers in the hosts file, a failure only costs the names
+	h.configNames = configPeerNames(conf, peerNames)
+	if err := h.syncPeerNames(); err != nil {
+		logger.Errorf("Failed to set peer names: %v", err)
 	}
 
 	// try to resolve DNS to replace our dummy endpoints
 	for _, p := range resolutionQueue {
-		go resolveAndUpdatePeer(tunnelCtx, handleID, conf, p.index, p.host, r, listenPort)
+		go resolveAndUpdatePeer(tunnelCtx, h, handleID, conf, ifOpts, p.index, p.host, listenPort)
 	}
-
-	success = true
-	tunnelHandles[handleID] = h
-	shared.LogDebug(tag, "Device started successfully; DNS bypasses active for handle %d", handleID)
-
-	return C.int(handleID)
+	return h, nil
 }
 
-// resolveAndUpdatePeer resolves the host and updates the peer's endpoint if successful.
-func resolveAndUpdatePeer(ctx context.Context, tunnelHandle int32, conf *wireproxyawg.Configuration, peerIndex int, host string, router router.Router, listenPort uint16) {
+// resolveAndUpdatePeer resolves the host and updates the peer's endpoint on the handle's device if successful.
+func resolveAndUpdatePeer(ctx context.Context, h *TunnelHandle, tunnelHandle int32, conf *wireproxyawg.Configuration, ifOpts interfaceOptions, peerIndex int, host string, listenPort uint16) {
 
 	resolvingHandles.Store(tunnelHandle, true)
 	shared.NotifyStatusCode(tunnelHandle, shared.StatusResolvingDNS)
@@ -224,13 +338,14 @@ func resolveAndUpdatePeer(ctx context.Context, tunnelHandle int32, conf *wirepro
 	}
 
 	opts := dns.DefaultOptions()
+	opts.BootstrapMark = ifOpts.bootstrapMark
 	// TODO make configurable by user
 	preferIPv6 := false
 
 	// windows only to bind bootstrap DNS queries directly to the physical interface
 	var physicalIfIndex uint32
 	if runtime.GOOS == "windows" {
-		if pr, ok := router.(interface{ GetPhysicalInterfaceIndex() uint32 }); ok {
+		if pr, ok := h.router.(interface{ GetPhysicalInterfaceIndex() uint32 }); ok {
 			physicalIfIndex = pr.GetPhysicalInterfaceIndex()
 		}
 	}
@@ -268,34 +383,47 @@ func resolveAndUpdatePeer(ctx context.Context, tunnelHandle int32, conf *wirepro
 		return
 	}
 
-	handle, ok := tunnelHandles[tunnelHandle]
-	if !ok || handle.cancel == nil {
+	// the handle may be a tunnel being switched to, which isn't in tunnelHandles yet
+	if ctx.Err() != nil {
 		shared.LogDebug(tag, "Tunnel down, skipping update for %s", host)
 		return
 	}
-	if err := handle.device.IpcSet(ipcRequest.IpcRequest); err != nil {
+	if err := h.device.IpcSet(ipcRequest.IpcRequest); err != nil {
 		shared.LogError(tag, "Failed to update peers: %v", err)
 		return
 	}
 
 	// for windows, we need to update the router with the new peer endpoint for routing
 	if runtime.GOOS == "windows" {
-		rConfig, err := parseToRouterConfig(conf, listenPort)
+		rConfig, err := parseToRouterConfig(conf, listenPort, ifOpts)
 		if err != nil {
 			logger.Errorf("Failed to parse new router config after DNS resolution: %v", err)
 			return
 		}
-		err = router.Set(rConfig)
-		if err != nil {
-			logger.Errorf("Failed to set new router config after DNS resolution: %v", err)
-			return
+		h.useDnsForwarder(rConfig)
+		// a paused tunnel picks the config up on resume
+		if !h.paused.Load() {
+			err = h.router.Set(h.stagedConfig(rConfig))
+			if err != nil {
+				logger.Errorf("Failed to set new router config after DNS resolution: %v", err)
+				return
+			}
 		}
+		h.routerCfg = rConfig
 	}
 
 	shared.LogDebug(tag, "Successfully updated peer with resolved endpoint for %s", host)
 	resolvingHandles.Delete(tunnelHandle)
 }
 
+// stagedConfig returns the config to set on the router, without DNS while the tunnel is staged.
+func (h *TunnelHandle) stagedConfig(c *router.Config) *router.Config {
+	if h.staged.Load() {
+		return withoutDNS(c)
+	}
+	return c
+}
+
 func (h *TunnelHandle) close() {
 	if h == nil {
 		return
@@ -311,11 +439,27 @@ func (h *TunnelHandle) close() {
 		_ = h.uapi.Close()
 	}
 
+	// stop sharing before the tunnel it forwards into goes away
+	h.stopSharing()
+	h.removeInboundPolicy()
+
 	// close router to clean up router and firewall rules
 	if h.router != nil {
 		_ = h.router.Close()
 	}
 
+	// remove the peer names of the tunnel
+	if h.ifName != "" {
+		if err := vpndns.RevertHosts(h.ifName); err != nil {
+			logger.Errorf("Remove peer names: %v", err)
+		}
+	}
+
+	// stop the DNS forwarder once the OS no longer points at it
+	if err := h.dnsForwarder.Close(); err != nil {
+		logger.Errorf("Stop DNS forwarder: %v", err)
+	}
+
 	// close tun device
 	if h.device != nil {
 		h.device.Close()
@@ -324,25 +468,45 @@ func (h *TunnelHandle) close() {
 
 //export awgTurnOff
 func awgTurnOff(tunnelHandle C.int) {
-	id := int32(tunnelHandle)
+	turnOff(int32(tunnelHandle))
+}
+
+// turnOff closes the handle's tunnel, cancelling a switch away from it. The switch closes the tunnel it staged.
+func turnOff(id int32) {
+	handlesMu.Lock()
 	handle, ok := tunnelHandles[id]
+	delete(tunnelHandles, id)
+	var cancelSwitch context.CancelFunc
+	if ok {
+		cancelSwitch = handle.cancelSwitch
+	}
+	handlesMu.Unlock()
 	if !ok {
 		shared.LogError(tag, "Tunnel is not up")
 		return
 	}
+	if cancelSwitch != nil {
+		cancelSwitch()
+	}
 
 	// clear the callback
 	shared.RemoveTunnelCallback(id)
 
-	delete(tunnelHandles, id)
 	handle.close()
 	resolvingHandles.Delete(id)
 }
 
+// getHandle returns the handle's tunnel.
+func getHandle(id int32) (*TunnelHandle, bool) {
+	handlesMu.Lock()
+	defer handlesMu.Unlock()
+	handle, ok := tunnelHandles[id]
+	return handle, ok
+}
+
 //export awgGetConfig
 func awgGetConfig(tunnelHandle C.int) *C.char {
-	goTunnelHandle := int32(tunnelHandle)
-	handle, ok := tunnelHandles[goTunnelHandle]
+	handle, ok := getHandle(int32(tunnelHandle))
 	if !ok {
 		return nil
 	}
@@ -356,10 +520,12 @@ func awgGetConfig(tunnelHandle C.int) *C.char {
 
 //export awgTurnOffAll
 func awgTurnOffAll() {
-	for handle := range tunnelHandles {
-		awgTurnOff(C.int(handle))
+	handlesMu.Lock()
+	ids := slices.Collect(maps.Keys(tunnelHandles))
+	handlesMu.Unlock()
+	for _, id := range ids {
+		turnOff(id)
 	}
-	tunnelHandles = make(map[int32]*TunnelHandle)
 }
 
 func newRouter(iface string, fw firewall.Firewall, tunnel tun.Device) (router.Router, error) {
@@ -370,14 +536,20 @@ func newFirewall() (firewall.Firewall, error) {
 	return firewallmgr.Get()
 }
 
-func parseToRouterConfig(conf *wireproxyawg.Configuration, listenPort uint16) (*router.Config, error) {
+func parseToRouterConfig(conf *wireproxyawg.Configuration, listenPort uint16, ifOpts interfaceOptions) (*router.Config, error) {
 	device := conf.Device
 	if device == nil {
 		return nil, errors.New("no [Interface] section found in config")
 	}
 
 	cfg := &router.Config{
-		MTU: device.MTU,
+		MTU:            device.MTU,
+		Table:          ifOpts.table,
+		FwMark:         ifOpts.fwMark,
+		BootstrapMark:  ifOpts.bootstrapMark,
+		RulePriority:   ifOpts.rulePriority,
+		Precedence:     ifOpts.precedence,
+		ExcludedRoutes: ifOpts.excludedIPs,
 	}
 
 	// Normalize and add tunnel addresses for router
@@ -391,7 +563,7 @@ func parseToRouterConfig(conf *wireproxyawg.Configuration, listenPort uint16) (*
 	}
 
 	cfg.DNS = device.DNS
-	cfg.SearchDomains = device.SearchDomains
+	cfg.SearchDomains, cfg.RoutingDomains = splitDomains(device.SearchDomains)
 	cfg.ListenPort = listenPort
 
 	for _, peer := range device.Peers {